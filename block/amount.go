@@ -0,0 +1,166 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is a quantity of coins counted in indivisible base units, so that
+// balances add up exactly no matter how many transactions they go through.
+type Amount int64
+
+const (
+	COIN_DECIMALS        = 8
+	COIN          Amount = 100_000_000
+	MAX_AMOUNT    Amount = math.MaxInt64
+)
+
+var ErrAmountOverflow = errors.New("amount overflow")
+
+// ParseAmount reads a decimal coin value such as "12.5" into base units. It
+// rejects values with more than COIN_DECIMALS fractional digits instead of
+// rounding them.
+func ParseAmount(s string) (Amount, error) {
+	str := strings.TrimSpace(s)
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(str, "-")
+
+	intPart, fracPart, hasPoint := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if hasPoint && fracPart == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(fracPart) > COIN_DECIMALS {
+		return 0, fmt.Errorf("invalid amount %q: more than %d decimal places", s, COIN_DECIMALS)
+	}
+	for _, c := range intPart + fracPart {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+
+	var whole int64
+	if intPart != "" {
+		var err error
+		whole, err = strconv.ParseInt(intPart, 10, 64)
+		if err != nil || whole > int64(MAX_AMOUNT/COIN) {
+			return 0, fmt.Errorf("invalid amount %q: %w", s, ErrAmountOverflow)
+		}
+	}
+
+	var frac int64
+	if fracPart != "" {
+		fracPart += strings.Repeat("0", COIN_DECIMALS-len(fracPart))
+		frac, _ = strconv.ParseInt(fracPart, 10, 64)
+	}
+
+	a, err := Amount(whole * int64(COIN)).Add(Amount(frac))
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", s, err)
+	}
+	if negative {
+		a = -a
+	}
+
+	return a, nil
+}
+
+// AmountFromFloat converts a legacy floating point coin value, rounding to
+// the nearest base unit.
+func AmountFromFloat(f float64) (Amount, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid amount %v", f)
+	}
+
+	units := math.Round(f * float64(COIN))
+	if units >= math.MaxInt64 || units <= math.MinInt64 {
+		return 0, ErrAmountOverflow
+	}
+
+	return Amount(units), nil
+}
+
+// Add returns a+b, or ErrAmountOverflow if the sum does not fit.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if (b > 0 && a > MAX_AMOUNT-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// Sub returns a-b, or ErrAmountOverflow if the difference does not fit.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if (b < 0 && a > MAX_AMOUNT+b) || (b > 0 && a < math.MinInt64+b) {
+		return 0, ErrAmountOverflow
+	}
+	return a - b, nil
+}
+
+// String formats a as a decimal coin value without trailing zeros, e.g.
+// "1", "0.5" or "-12.00000001".
+func (a Amount) String() string {
+	sign := ""
+	u := uint64(a)
+	if a < 0 {
+		sign = "-"
+		u = uint64(-(a + 1)) + 1
+	}
+
+	whole := u / uint64(COIN)
+	frac := u % uint64(COIN)
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", COIN_DECIMALS, frac), "0")
+	return fmt.Sprintf("%s%d.%s", sign, whole, fracStr)
+}
+
+// MarshalJSON writes a as a decimal string so that no JSON consumer parses
+// it into a float.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON accepts the decimal string form as well as the plain JSON
+// number older nodes and wallets send.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		v, err := ParseAmount(s)
+		if err != nil {
+			return err
+		}
+		*a = v
+		return nil
+	}
+
+	if v, err := ParseAmount(string(data)); err == nil {
+		*a = v
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	v, err := AmountFromFloat(f)
+	if err != nil {
+		return err
+	}
+	*a = v
+
+	return nil
+}
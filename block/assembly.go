@@ -0,0 +1,135 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// higherFeeRate reports whether a pays more fee per byte than b. The rates
+// are compared by cross-multiplying so no precision is lost to division,
+// with 128-bit products since a fee can be as large as the whole supply.
+// Fees of transactions in the pool are never negative.
+func higherFeeRate(a, b *Transaction) bool {
+	aHi, aLo := bits.Mul64(uint64(a.fee), uint64(b.Size()))
+	bHi, bLo := bits.Mul64(uint64(b.fee), uint64(a.Size()))
+	return aHi > bHi || (aHi == bHi && aLo > bLo)
+}
+
+// SelectTransactions picks transactions from the pool for the next block,
+// highest fee rate first, until no more fit in maxSize bytes. Transactions
+// that do not fit stay in the pool for a later block.
+func (bc *Blockchain) SelectTransactions(maxSize int) []*Transaction {
+	candidates := bc.CopyTransactions()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return higherFeeRate(candidates[i], candidates[j])
+	})
+
+	selected := make([]*Transaction, 0, len(candidates))
+	size := 0
+	for _, t := range candidates {
+		txSize := t.Size()
+		if size+txSize > maxSize {
+			continue
+		}
+		selected = append(selected, t)
+		size += txSize
+	}
+
+	return selected
+}
+
+// NewBlockCandidate assembles the next block for the miner at
+// blockchainAddress: a coinbase paying the block subsidy plus the fees of the
+// selected transactions, followed by those transactions. The nonce still has
+// to be found.
+func (bc *Blockchain) NewBlockCandidate(blockchainAddress string) (*Block, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	return bc.newBlockCandidate(blockchainAddress)
+}
+
+func (bc *Blockchain) newBlockCandidate(blockchainAddress string) (*Block, error) {
+	empty := NewBlock(0, bc.tip.hash, CalcNextBits(bc.params, bc.chain), []*Transaction{NewCoinbaseTransaction(blockchainAddress, MAX_AMOUNT)})
+	transactions := bc.SelectTransactions(MINING_MAX_BLOCK_SIZE - empty.Size() - blockSizeMargin)
+
+	reward := CalcBlockSubsidy(bc.params, bc.tip.height+1)
+	for _, t := range transactions {
+		var err error
+		if reward, err = reward.Add(t.fee); err != nil {
+			return nil, err
+		}
+	}
+
+	coinbase := NewCoinbaseTransaction(blockchainAddress, reward)
+	return NewBlock(0, bc.tip.hash, CalcNextBits(bc.params, bc.chain), append([]*Transaction{coinbase}, transactions...)), nil
+}
+
+// blockSizeMargin leaves room for the transaction count, whose encoded length
+// grows with the number of transactions selected.
+const blockSizeMargin = 64
+
+// BlockTemplateResponse describes the next block for an external miner to
+// solve: the header fields, the target the header hash must not exceed,
+// and the transactions, coinbase first. Height is that of the block, and
+// its timestamp must be later than MinTimestamp.
+type BlockTemplateResponse struct {
+	Height       int            `json:"height"`
+	PrevHash     string         `json:"prev_hash"`
+	MerkleRoot   string         `json:"merkle_root"`
+	Timestamp    int64          `json:"timestamp"`
+	MinTimestamp int64          `json:"min_timestamp"`
+	Bits         uint32         `json:"bits"`
+	Target       string         `json:"target"`
+	Coinbase     *Transaction   `json:"coinbase"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+// BlockTemplate assembles the next block for a miner paying
+// blockchainAddress, like NewBlockCandidate, and describes it for miners
+// outside the node. They submit the solved block to SubmitBlock.
+func (bc *Blockchain) BlockTemplate(blockchainAddress string) (*BlockTemplateResponse, error) {
+	if err := bc.CheckAddress(blockchainAddress); err != nil {
+		return nil, err
+	}
+
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	b, err := bc.newBlockCandidate(blockchainAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockTemplateResponse{
+		Height:       bc.tip.height + 1,
+		PrevHash:     fmt.Sprintf("%x", b.header.prevHash),
+		MerkleRoot:   fmt.Sprintf("%x", b.header.merkleRoot),
+		Timestamp:    b.header.timestamp,
+		MinTimestamp: medianTimePast(bc.chain),
+		Bits:         b.header.bits,
+		Target:       fmt.Sprintf("%064x", CompactToBig(b.header.bits)),
+		Coinbase:     b.transactions[0],
+		Transactions: b.transactions[1:],
+	}, nil
+}
+
+// Block rebuilds the block t describes with a zero nonce, ready to be
+// solved.
+func (t *BlockTemplateResponse) Block() (*Block, error) {
+	prevHash, err := HashStrToHash(t.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	if t.Coinbase == nil {
+		return nil, errors.New("block template without a coinbase")
+	}
+
+	b := NewBlock(0, prevHash, t.Bits, append([]*Transaction{t.Coinbase}, t.Transactions...))
+	b.header.timestamp = t.Timestamp
+	if fmt.Sprintf("%x", b.header.merkleRoot) != t.MerkleRoot {
+		return nil, errors.New("block template transactions do not match its merkle root")
+	}
+	return b, nil
+}
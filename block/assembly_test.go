@@ -0,0 +1,37 @@
+package block
+
+import "testing"
+
+func testFeeTransaction(outputs int, fee Amount) *Transaction {
+	outs := make([]*TxOutput, outputs)
+	for i := range outs {
+		outs[i] = NewTxOutput("recipient", COIN)
+	}
+	return NewTransaction("sender", []*TxInput{NewTxInput([32]byte{1}, 0)}, outs, fee)
+}
+
+func TestHigherFeeRate(t *testing.T) {
+	small := testFeeTransaction(1, 1000)
+	large := testFeeTransaction(10, 1000)
+	tests := []struct {
+		name string
+		a, b *Transaction
+		want bool
+	}{
+		{"same fee, smaller", small, large, true},
+		{"same fee, larger", large, small, false},
+		{"same rate", small, small, false},
+		{"no fee", testFeeTransaction(1, 0), small, false},
+		// Cross-multiplying these in 64 bits overflows and flips the order.
+		{"huge fee", testFeeTransaction(1, MAX_AMOUNT/2), large, true},
+		{"huge fee, other way", large, testFeeTransaction(1, MAX_AMOUNT/2), false},
+		{"huge fees", testFeeTransaction(1, MAX_AMOUNT), testFeeTransaction(10, MAX_AMOUNT), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := higherFeeRate(tt.a, tt.b); got != tt.want {
+				t.Errorf("higherFeeRate = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,55 +1,153 @@
 package block
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
 	"goblockchain/p2p"
 	"log"
-	"net/http"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	MINING_DIFFICULITY    = 3
-	MINING_SENDER_ADDRESS = "THE BLOCKCHAIN"
-	MINING_REWARD         = 1.0
-	MINING_TIMER_SEC      = 20
-
-	BLOCKCHAIN_IP_START     = 0
-	BLOCKCHAIN_IP_END       = 0
-	BLOCKCHAIN_PORT_START   = 5000
-	BLOCKCHAIN_PORT_END     = 5003
-	NEIGHBOR_SYNC_TIMER_SEC = 20
+	MINING_SENDER_ADDRESS     = "THE BLOCKCHAIN"
+	MINING_MAX_BLOCK_SIZE     = 1_000_000
+	MINING_MEDIAN_TIME_BLOCKS = 11
+	MINING_MAX_FUTURE_SEC     = 300
+	MINING_TIMER_SEC          = 20
+
+	MEMPOOL_MAX_SIZE         = 5 * MINING_MAX_BLOCK_SIZE
+	MEMPOOL_EXPIRY_SEC       = 60 * 60
+	MEMPOOL_EXPIRY_TIMER_SEC = 60
 )
 
+// BlockHeader is the part of a block that is hashed and mined. It commits to
+// the block's transactions through merkleRoot.
+type BlockHeader struct {
+	prevHash   [32]byte
+	merkleRoot [32]byte
+	timestamp  int64
+	bits       uint32
+	nonce      int
+}
+
+func (h *BlockHeader) PrevHash() [32]byte {
+	return h.prevHash
+}
+
+func (h *BlockHeader) MerkleRoot() [32]byte {
+	return h.merkleRoot
+}
+
+func (h *BlockHeader) Timestamp() int64 {
+	return h.timestamp
+}
+
+func (h *BlockHeader) Bits() uint32 {
+	return h.bits
+}
+
+func (h *BlockHeader) Nonce() int {
+	return h.nonce
+}
+
+func (h *BlockHeader) Hash() [32]byte {
+	return sha256.Sum256(h.Encode())
+}
+
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		PrevHash   string `json:"prev_hash"`
+		MerkleRoot string `json:"merkle_root"`
+		Timestamp  int64  `json:"timestamp"`
+		Bits       uint32 `json:"bits"`
+		Nonce      int    `json:"nonce"`
+	}{
+		PrevHash:   fmt.Sprintf("%x", h.prevHash),
+		MerkleRoot: fmt.Sprintf("%x", h.merkleRoot),
+		Timestamp:  h.timestamp,
+		Bits:       h.bits,
+		Nonce:      h.nonce,
+	})
+}
+
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var prevHash, merkleRoot string
+	v := &struct {
+		PrevHash   *string `json:"prev_hash"`
+		MerkleRoot *string `json:"merkle_root"`
+		Timestamp  *int64  `json:"timestamp"`
+		Bits       *uint32 `json:"bits"`
+		Nonce      *int    `json:"nonce"`
+	}{
+		PrevHash:   &prevHash,
+		MerkleRoot: &merkleRoot,
+		Timestamp:  &h.timestamp,
+		Bits:       &h.bits,
+		Nonce:      &h.nonce,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var err error
+	if h.prevHash, err = HashStrToHash(prevHash); err != nil {
+		return err
+	}
+	if h.merkleRoot, err = HashStrToHash(merkleRoot); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type Block struct {
-	nonce        int
-	prevHash     [32]byte
-	timestamp    int64
+	header       BlockHeader
 	transactions []*Transaction
 }
 
-func NewBlock(nonce int, prevHash [32]byte) *Block {
+func NewBlock(nonce int, prevHash [32]byte, bits uint32, transactions []*Transaction) *Block {
 	b := new(Block)
-	b.nonce = nonce
-	b.prevHash = prevHash
-	b.timestamp = time.Now().UnixNano()
+	b.header.nonce = nonce
+	b.header.bits = bits
+	b.header.prevHash = prevHash
+	b.header.merkleRoot = MerkleRoot(transactions)
+	b.header.timestamp = time.Now().UnixNano()
+	b.transactions = transactions
 	return b
 }
 
+func (b *Block) Header() *BlockHeader {
+	return &b.header
+}
+
 func (b *Block) Nonce() int {
-	return b.nonce
+	return b.header.nonce
 }
 
 func (b *Block) PrevHash() [32]byte {
-	return b.prevHash
+	return b.header.prevHash
+}
+
+func (b *Block) MerkleRoot() [32]byte {
+	return b.header.merkleRoot
+}
+
+func (b *Block) Timestamp() int64 {
+	return b.header.timestamp
+}
+
+func (b *Block) Bits() uint32 {
+	return b.header.bits
 }
 
 func (b *Block) Transactions() []*Transaction {
@@ -57,125 +155,254 @@ func (b *Block) Transactions() []*Transaction {
 }
 
 func (b *Block) Print() {
-	fmt.Printf("nonce            %d\n", b.nonce)
-	fmt.Printf("prevHash         %x\n", b.prevHash)
-	fmt.Printf("timestamp        %d\n", b.nonce)
+	fmt.Printf("nonce            %d\n", b.header.nonce)
+	fmt.Printf("prevHash         %x\n", b.header.prevHash)
+	fmt.Printf("merkleRoot       %x\n", b.header.merkleRoot)
+	fmt.Printf("timestamp        %d\n", b.header.timestamp)
+	fmt.Printf("bits             %08x\n", b.header.bits)
 	for _, t := range b.transactions {
 		t.Print()
 	}
 }
 
-func (b *Block) Hash() [32]byte {
-	m, err := json.Marshal(b)
-	if err != nil {
-		log.Fatal(err)
-	}
+// Size is the length of the block's canonical encoding in bytes, which is
+// what MINING_MAX_BLOCK_SIZE limits.
+func (b *Block) Size() int {
+	return len(b.Encode())
+}
 
-	sum := sha256.Sum256(m)
-	return sum
+// Hash identifies the block by its header alone; the transactions are
+// covered through the merkle root.
+func (b *Block) Hash() [32]byte {
+	return b.header.Hash()
 }
 
 func (b *Block) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Nonce        int            `json:"nonce"`
 		PrevHash     string         `json:"prev_hash"`
+		MerkleRoot   string         `json:"merkle_root"`
 		Timestamp    int64          `json:"timestamp"`
+		Bits         uint32         `json:"bits"`
 		Transactions []*Transaction `json:"transactions"`
 	}{
-		Nonce:        b.nonce,
-		PrevHash:     fmt.Sprintf("%x", b.prevHash),
-		Timestamp:    b.timestamp,
+		Nonce:        b.header.nonce,
+		PrevHash:     fmt.Sprintf("%x", b.header.prevHash),
+		MerkleRoot:   fmt.Sprintf("%x", b.header.merkleRoot),
+		Timestamp:    b.header.timestamp,
+		Bits:         b.header.bits,
 		Transactions: b.transactions,
 	})
 }
 
 func (b *Block) UnmarshalJSON(data []byte) error {
-	var prevHash string
+	if err := json.Unmarshal(data, &b.header); err != nil {
+		return err
+	}
+
 	v := &struct {
-		Nonce        *int            `json:"nonce"`
-		PrevHash     *string         `json:"prev_hash"`
-		Timestamp    *int64          `json:"timestamp"`
 		Transactions *[]*Transaction `json:"transactions"`
 	}{
-		Nonce:        &b.nonce,
-		PrevHash:     &prevHash,
-		Timestamp:    &b.timestamp,
 		Transactions: &b.transactions,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
 
-	ph, _ := hex.DecodeString(*v.PrevHash)
-	copy(b.prevHash[:], ph[:32])
-
 	return nil
 }
 
 type Blockchain struct {
-	transactionPool   []*Transaction
+	params            *chaincfg.Params
+	genesisHash       [32]byte
+	mempool           *Mempool
 	chain             []*Block
 	blockchainAddress string
 	port              uint16
+	store             BlockStore
+	tree              *blockTree
+	tip               *blockNode
+	utxos             *UTXOSet
+	index             *chainIndex
+	miningWorkers     int
 	mux               sync.Mutex
 
-	neighbors    []string
-	muxNeighbors sync.Mutex
+	// tipChanged is closed and replaced whenever the tip moves, which is
+	// how a proof of work on the old tip learns to stop. It is guarded by
+	// mux.
+	tipChanged chan struct{}
+	hashMeter  hashMeter
+
+	node *p2p.Node
+
+	// syncPeers and inFlight track the block download; both are guarded by
+	// mux.
+	syncPeers map[p2p.NodeID]*syncPeer
+	inFlight  map[[32]byte]*syncPeer
+
+	reorgSubscribers []chan<- *ReorgEvent
+	muxSubscribers   sync.Mutex
+}
+
+// GenesisBlock is the root of every chain on the network params describes.
+// It is fixed, rather than stamped with the time a node first starts, so
+// that all nodes share it and their block trees can connect. Nodes whose
+// genesis blocks differ are on different chains and never sync.
+func GenesisBlock(params *chaincfg.Params) *Block {
+	var transactions []*Transaction
+	if len(params.GenesisAllocations) > 0 {
+		outputs := make([]*TxOutput, len(params.GenesisAllocations))
+		for i, a := range params.GenesisAllocations {
+			outputs[i] = NewTxOutput(a.Address, Amount(a.Amount))
+		}
+		t := NewTransaction(MINING_SENDER_ADDRESS, nil, outputs, 0)
+		t.timestamp = params.GenesisTimestamp
+		transactions = []*Transaction{t}
+	}
+
+	b := NewBlock(0, [32]byte{}, params.PowLimitBits, transactions)
+	b.header.timestamp = params.GenesisTimestamp
+	return b
 }
 
-func NewBlockchain(blockchainAddress string, port uint16) *Blockchain {
-	b := new(Block)
+// NewBlockchain restores the block tree kept in store, or starts a new one
+// from the genesis block when store is empty. Every stored block is checked
+// as it is loaded, and a block that fails is reported as corruption rather
+// than silently discarded. The branch with the most work that connects
+// becomes the active chain.
+//
+// Two kinds of stored blocks are skipped rather than refused, since a
+// healthy node leaves them behind: blocks whose parent never arrived, as
+// blocks are fetched in parallel and stored in the order they come in, and
+// branches that failed to connect, as blocks are stored before they are
+// connected. Both are counted in the LoadChain log line.
+func NewBlockchain(params *chaincfg.Params, blockchainAddress string, port uint16, store BlockStore) (*Blockchain, error) {
 	bc := new(Blockchain)
-	bc.CreateBlock(0, b.Hash())
+	bc.params = params
+	bc.genesisHash = GenesisBlock(params).Hash()
 	bc.blockchainAddress = blockchainAddress
 	bc.port = port
-	return bc
-}
+	bc.store = store
+	bc.tree = newBlockTree()
+	bc.utxos = NewUTXOSet(params.CoinbaseMaturity)
+	bc.index = newChainIndex()
+	bc.mempool = NewMempool(MEMPOOL_MAX_SIZE, time.Second*MEMPOOL_EXPIRY_SEC)
+	bc.miningWorkers = runtime.NumCPU()
+	bc.tipChanged = make(chan struct{})
+	bc.syncPeers = make(map[p2p.NodeID]*syncPeer)
+	bc.inFlight = make(map[[32]byte]*syncPeer)
+
+	blocks, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
 
-func (bc *Blockchain) Chain() []*Block {
-	return bc.chain
+	if len(blocks) == 0 {
+		genesis := GenesisBlock(params)
+		if err := store.Append(genesis); err != nil {
+			return nil, err
+		}
+		blocks = []*Block{genesis}
+	}
+
+	orphans, invalid, err := bc.loadBlocks(blocks)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("action=LoadChain, status=success, network=%s, blocks=%d, height=%d, orphans=%d, invalid_branches=%d",
+		params.Name, len(blocks), bc.tip.height, orphans, invalid)
+
+	return bc, nil
 }
 
-func (bc *Blockchain) TransactionPool() *Transactions {
-	return NewTransactions(bc.transactionPool)
+// loadBlocks builds the block tree from the stored blocks and connects the
+// best branch. It returns how many blocks were skipped for lack of a parent
+// and how many branches failed to connect.
+func (bc *Blockchain) loadBlocks(blocks []*Block) (orphans, invalid int, err error) {
+	if blocks[0].Hash() != bc.genesisHash {
+		return 0, 0, errors.New("stored genesis block does not match")
+	}
+
+	genesis, _ := bc.tree.add(blocks[0])
+	undo, err := bc.utxos.Apply(blocks[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	genesis.undo = undo
+	bc.tip = genesis
+	bc.chain = []*Block{blocks[0]}
+	bc.index.connect(blocks[0], 0)
+
+	// Blocks fetched in parallel during sync can be stored ahead of their
+	// parent, so those are retried once the rest of the pass is in.
+	pending := blocks[1:]
+	for len(pending) > 0 {
+		var deferred []*Block
+		for _, b := range pending {
+			parent, ok := bc.tree.lookup(b.PrevHash())
+			if !ok {
+				deferred = append(deferred, b)
+				continue
+			}
+			if err := bc.checkBlock(b, parent); err != nil {
+				return 0, 0, fmt.Errorf("stored block %x: %w", b.Hash(), err)
+			}
+			if _, err := bc.tree.add(b); err != nil {
+				return 0, 0, fmt.Errorf("stored block %x: %w", b.Hash(), err)
+			}
+		}
+		if len(deferred) == len(pending) {
+			orphans = len(deferred)
+			log.Printf("Error: %d stored blocks have no parent and were skipped\n", orphans)
+			break
+		}
+		pending = deferred
+	}
+
+	// A stored branch may hold a block that was found not to connect after it
+	// was written; setTip marks it invalid and the next best branch is tried.
+	for {
+		err := bc.setTip(bc.tree.best())
+		if err == nil {
+			return orphans, invalid, nil
+		}
+		invalid++
+		log.Printf("Error: stored branch skipped: %v\n", err)
+	}
 }
 
-func (bc *Blockchain) ClearTransactionPool() {
-	bc.transactionPool = []*Transaction{}
+// Chain returns the active chain. The slice is replaced rather than
+// modified when the chain changes, so it stays valid after a reorg.
+func (bc *Blockchain) Chain() []*Block {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	return bc.chain
 }
 
-func (bc *Blockchain) Run() {
-	bc.StartMining()
-	bc.ResolveConflicts()
-	bc.SyncNeighbors()
+func (bc *Blockchain) Params() *chaincfg.Params {
+	return bc.params
 }
 
-func (bc *Blockchain) SetNeighbors() {
-	address := p2p.GetHost()
-	bc.neighbors = p2p.FindNeighbors(address, bc.port, BLOCKCHAIN_IP_START, BLOCKCHAIN_IP_END, BLOCKCHAIN_PORT_START, BLOCKCHAIN_PORT_END)
-	log.Printf("%v", bc.neighbors)
+func (bc *Blockchain) TransactionPool() *Transactions {
+	return NewTransactions(bc.mempool.Transactions())
 }
 
-func (bc *Blockchain) SyncNeighbors() {
-	bc.muxNeighbors.Lock()
-	defer bc.muxNeighbors.Unlock()
-	bc.SetNeighbors()
-	time.AfterFunc(time.Second*NEIGHBOR_SYNC_TIMER_SEC, bc.SyncNeighbors)
+// BlockchainAddress is the address the node was started with, which its
+// miner pays unless told otherwise.
+func (bc *Blockchain) BlockchainAddress() string {
+	return bc.blockchainAddress
 }
 
-func (bc *Blockchain) CreateBlock(nonce int, prevHash [32]byte) {
-	b := NewBlock(nonce, prevHash)
-	b.transactions = bc.transactionPool
-	bc.chain = append(bc.chain, b)
-	bc.ClearTransactionPool()
+func (bc *Blockchain) Mempool() *Mempool {
+	return bc.mempool
+}
 
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/transactions", n)
-		req, _ := http.NewRequest("DELETE", endpoint, nil)
-		client := http.Client{}
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
-	}
+// Run starts the background work of the node other than mining, which a
+// Miner runs.
+func (bc *Blockchain) Run() {
+	bc.StartMempoolExpiry()
+	bc.StartBlockDownload()
 }
 
 func (bc *Blockchain) Print() {
@@ -189,303 +416,530 @@ func (bc *Blockchain) Print() {
 }
 
 func (bc *Blockchain) LastBlock() *Block {
-	return bc.chain[len(bc.chain)-1]
+	chain := bc.Chain()
+	return chain[len(chain)-1]
+}
+
+// SubmitTransaction admits t to the mempool and announces it to our peers,
+// once its signature checks out and every input it spends is unspent both
+// on chain and in the mempool. A transaction whose ID is already in the
+// mempool or on chain is a replay and is rejected. Coinbase transactions are
+// only ever created by the miner assembling a block and are never accepted
+// into the mempool. ErrInvalidTransaction in the error means t can never be
+// valid.
+func (bc *Blockchain) SubmitTransaction(t *Transaction, senderPublicKey *ecdsa.PublicKey, signature *blockchain_crypto.Signature) error {
+	if err := bc.addTransaction(t, senderPublicKey, signature); err != nil {
+		return err
+	}
+	bc.announceTransaction(t.Hash(), nil)
+	return nil
 }
 
-func (bc *Blockchain) CreateTransaction(sender, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, signature *blockchain_crypto.Signature) bool {
-	isAdded := bc.AddTransaction(sender, recipient, value, senderPublicKey, signature)
+func (bc *Blockchain) addTransaction(t *Transaction, senderPublicKey *ecdsa.PublicKey, signature *blockchain_crypto.Signature) error {
+	if t.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase transaction submitted to the pool", ErrInvalidTransaction)
+	}
+
+	if bc.mempool.Has(t.Hash()) {
+		return fmt.Errorf("transaction %x: %w", t.Hash(), ErrTxInMempool)
+	}
 
-	if isAdded {
-		publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(), senderPublicKey.Y.Bytes())
-		signatureStr := signature.String()
+	t.SetSignature(senderPublicKey, signature)
+	if !t.VerifySignature(bc.params.AddressVersion) {
+		return fmt.Errorf("%w: transaction %x has an invalid signature", ErrInvalidTransaction, t.Hash())
+	}
+	if err := t.CheckRecipients(bc.params.AddressVersion); err != nil {
+		return err
+	}
 
-		for _, n := range bc.neighbors {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 
-			tr := TransactionRequest{
-				SenderBlockchainAddress:    &sender,
-				RecipientBlockchainAddress: &recipient,
-				Value:                      &value,
-				PublicKey:                  &publicKeyStr,
-				Signature:                  &signatureStr,
-			}
+	if err := bc.utxos.CheckTransaction(t, bc.mempool.Spends()); err != nil {
+		return err
+	}
+	return bc.mempool.Add(t)
+}
 
-			m, _ := json.Marshal(tr)
-			buf := bytes.NewBuffer(m)
-			endpoint := fmt.Sprintf("http://%s/transactions", n)
-			req, _ := http.NewRequest("PUT", endpoint, buf)
-			client := http.Client{}
-			resp, _ := client.Do(req)
+func (bc *Blockchain) CopyTransactions() []*Transaction {
+	transactions := make([]*Transaction, 0)
 
-			log.Printf("%v", resp)
-		}
+	for _, t := range bc.mempool.Transactions() {
+		c := *t
+		transactions = append(transactions, &c)
 	}
 
-	return isAdded
+	return transactions
 }
-func (bc *Blockchain) AddTransaction(sender, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, signature *blockchain_crypto.Signature) bool {
-	t := NewTransaction(sender, recipient, value)
 
-	if sender == MINING_SENDER_ADDRESS {
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+// ValidProof reports whether header hashes to a value no greater than the
+// target encoded in its bits, and whether that target is within the limit.
+func (bc *Blockchain) ValidProof(header *BlockHeader) bool {
+	target := CompactToBig(header.bits)
+	if target.Sign() <= 0 || target.Cmp(CompactToBig(bc.params.PowLimitBits)) > 0 {
+		return false
 	}
 
-	if bc.VerifySignature(senderPublicKey, signature, t) {
-		if bc.CalculateTotalAmount(sender) < value {
-			log.Println("Error: Not enough balance in a wallet")
-			return false
-		}
+	return HashToBig(header.Hash()).Cmp(target) <= 0
+}
 
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+// MineBlock assembles a block paying blockchainAddress on the current tip
+// and mines it. The chain is only locked while the block is assembled and
+// processed, so transactions and blocks from peers keep arriving during the
+// proof of work; if the tip moves meanwhile, the proof of work is abandoned
+// since the block could only end up on a side branch. It is also abandoned
+// when ctx is done.
+func (bc *Blockchain) MineBlock(ctx context.Context, blockchainAddress string) (*Block, error) {
+	b, err := bc.NewBlockCandidate(blockchainAddress)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return nil, err
 	}
 
-	log.Println("Error: Invalid signature")
-	return false
-}
+	ctx, cancel := bc.withTip(ctx, b.PrevHash())
+	defer cancel()
+	if err := bc.ProofOfWork(ctx, b); err != nil {
+		log.Printf("action=Mining, status=aborted, reason=%v", err)
+		return nil, err
+	}
+	if _, err := bc.SubmitBlock(b); err != nil {
+		log.Printf("Error: %v\n", err)
+		return nil, err
+	}
+	log.Printf("action=Mining, status=success, transactions=%d, hashrate=%.0f", len(b.transactions)-1, bc.HashRate())
 
-func (bc *Blockchain) VerifySignature(senderPublicKey *ecdsa.PublicKey, s *blockchain_crypto.Signature, t *Transaction) bool {
-	m, _ := json.Marshal(t)
-	h := sha256.Sum256(m)
-	return ecdsa.Verify(senderPublicKey, h[:], s.R, s.S)
+	return b, nil
 }
 
-func (bc *Blockchain) CopyTransactions() []*Transaction {
-	transactions := make([]*Transaction, 0)
-
-	for _, t := range bc.transactionPool {
-		transactions = append(transactions, NewTransaction(
-			t.senderBlockchainAddress,
-			t.recipientBlockchainAddress,
-			t.value,
-		))
+// SubmitBlock processes a block mined by this node or one of its miners and
+// announces it to the peers if it became the tip, which it reports.
+func (bc *Blockchain) SubmitBlock(b *Block) (bool, error) {
+	if err := bc.ProcessBlock(b); err != nil {
+		return false, err
 	}
+	if tip, _ := bc.ChainTip(); tip != b.Hash() {
+		return false, nil
+	}
+	bc.announceBlock(b.Header(), nil)
+	return true, nil
+}
 
-	return transactions
+// SetMiningWorkers sets how many goroutines share the proof of work, by
+// default one per CPU. It must be called before mining starts.
+func (bc *Blockchain) SetMiningWorkers(n int) {
+	bc.miningWorkers = n
 }
 
-func (bc *Blockchain) ValidProof(nonce int, prevHash [32]byte, transactions []*Transaction, difficulity int) bool {
-	guessBlock := Block{
-		nonce:        nonce,
-		prevHash:     prevHash,
-		transactions: transactions,
-		timestamp:    0,
+// StartMempoolExpiry periodically drops transactions that have waited in the
+// mempool for longer than MEMPOOL_EXPIRY_SEC.
+func (bc *Blockchain) StartMempoolExpiry() {
+	if n := bc.mempool.Expire(time.Now()); n > 0 {
+		log.Printf("action=MempoolExpiry, expired=%d", n)
 	}
+	time.AfterFunc(time.Second*MEMPOOL_EXPIRY_TIMER_SEC, bc.StartMempoolExpiry)
+}
 
-	guessHashStr := fmt.Sprintf("%x", guessBlock.Hash())
+// CalculateTotalAmount returns the balance of blockchainAddress, split into
+// funds it can spend and block rewards that are not mature yet.
+func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) (mature, immature Amount, err error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 
-	return guessHashStr[:difficulity] == strings.Repeat("0", difficulity)
+	return bc.utxos.Balance(blockchainAddress)
 }
 
-func (bc *Blockchain) ProofOfWork() (nonce int) {
-	prevHash := bc.LastBlock().Hash()
-	transactions := bc.CopyTransactions()
+// UTXOs lists the outputs owned by blockchainAddress that are neither spent
+// on chain nor by a transaction in the pool, nor immature coinbase outputs,
+// for wallets to build new transactions from.
+func (bc *Blockchain) UTXOs(blockchainAddress string) []*UTXOResponse {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 
-	for !bc.ValidProof(nonce, prevHash, transactions, MINING_DIFFICULITY) {
-		nonce++
+	pending := bc.mempool.Spends()
+	utxos := make([]*UTXOResponse, 0)
+
+	for _, op := range bc.utxos.FindByAddress(blockchainAddress) {
+		if pending[op] || !bc.utxos.IsMature(op) {
+			continue
+		}
+		out, _ := bc.utxos.Get(op)
+		utxos = append(utxos, &UTXOResponse{
+			TxHash:      fmt.Sprintf("%x", op.TxHash),
+			OutputIndex: op.Index,
+			Value:       out.value,
+		})
 	}
 
-	return
+	return utxos
+}
+
+func (bc *Blockchain) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Chain []*Block `json:"chain"`
+	}{
+		Chain: bc.Chain(),
+	})
 }
 
-func (bc *Blockchain) Mining() bool {
+// BlockByHash returns the block on the chain whose header hashes to hash.
+func (bc *Blockchain) BlockByHash(hash [32]byte) (*Block, bool) {
 	bc.mux.Lock()
 	defer bc.mux.Unlock()
 
-	// if len(bc.transactionPool) == 0 {
-	// 	return false
-	// }
-
-	bc.AddTransaction(MINING_SENDER_ADDRESS, bc.blockchainAddress, MINING_REWARD, nil, nil)
-	nonce := bc.ProofOfWork()
-	prevHash := bc.LastBlock().Hash()
-	bc.CreateBlock(nonce, prevHash)
-	log.Println("action=Mining, status=success")
-
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/consensus", n)
-		req, _ := http.NewRequest("PUT", endpoint, nil)
-		client := http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Println(err)
-			return false
-		}
+	b, _, ok := bc.blockByHash(hash)
+	return b, ok
+}
 
-		log.Printf("%v\n", resp)
+// blockByHash is BlockByHash also returning the block's height. It must be
+// called with bc.mux held.
+func (bc *Blockchain) blockByHash(hash [32]byte) (*Block, int, bool) {
+	n, ok := bc.tree.lookup(hash)
+	if !ok || n.height >= len(bc.chain) || bc.chain[n.height].Hash() != hash {
+		return nil, 0, false
 	}
+	return bc.chain[n.height], n.height, true
+}
 
-	return true
+// MerkleProof proves that the transaction txHash is included in the block
+// blockHash.
+func (bc *Blockchain) MerkleProof(blockHash, txHash [32]byte) (*MerkleProof, error) {
+	b, ok := bc.BlockByHash(blockHash)
+	if !ok {
+		return nil, errors.New("block not found")
+	}
+	return NewMerkleProof(b, txHash)
+}
+
+type TxInput struct {
+	prevTxHash  [32]byte
+	outputIndex int
 }
 
-func (bc *Blockchain) StartMining() {
-	bc.Mining()
-	time.AfterFunc(time.Second*MINING_TIMER_SEC, bc.StartMining)
+func NewTxInput(prevTxHash [32]byte, outputIndex int) *TxInput {
+	in := new(TxInput)
+	in.prevTxHash = prevTxHash
+	in.outputIndex = outputIndex
+	return in
 }
 
-func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) float32 {
-	var total float32 = 0.0
+func (in *TxInput) PrevTxHash() [32]byte {
+	return in.prevTxHash
+}
 
-	for _, b := range bc.chain {
-		for _, t := range b.transactions {
-			value := t.value
-			if t.recipientBlockchainAddress == blockchainAddress {
-				total += value
-			}
-			if t.senderBlockchainAddress == blockchainAddress {
-				total -= value
-			}
-		}
-	}
+func (in *TxInput) OutputIndex() int {
+	return in.outputIndex
+}
 
-	return total
+func (in *TxInput) OutPoint() OutPoint {
+	return OutPoint{TxHash: in.prevTxHash, Index: in.outputIndex}
 }
 
-func (bc *Blockchain) MarshalJSON() ([]byte, error) {
+func (in *TxInput) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Chain []*Block `json:"chain"`
+		PrevTxHash  string `json:"prev_tx_hash"`
+		OutputIndex int    `json:"output_index"`
 	}{
-		Chain: bc.chain,
+		PrevTxHash:  fmt.Sprintf("%x", in.prevTxHash),
+		OutputIndex: in.outputIndex,
 	})
 }
 
-func (bc *Blockchain) UnmarshalJSON(data []byte) error {
+func (in *TxInput) UnmarshalJSON(data []byte) error {
+	var prevTxHash string
 	v := &struct {
-		Chain *[]*Block `json:"chain"`
+		PrevTxHash  *string `json:"prev_tx_hash"`
+		OutputIndex *int    `json:"output_index"`
 	}{
-		Chain: &bc.chain,
+		PrevTxHash:  &prevTxHash,
+		OutputIndex: &in.outputIndex,
 	}
-
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
 
+	h, err := HashStrToHash(prevTxHash)
+	if err != nil {
+		return err
+	}
+	in.prevTxHash = h
+
 	return nil
 }
 
-func (bc *Blockchain) ValidChain(chain []*Block) bool {
-	prevBlock := chain[0]
-	for i := 1; i < len(chain); i++ {
-		currentBlock := chain[i]
+type TxOutput struct {
+	recipientBlockchainAddress string
+	value                      Amount
+}
+
+func NewTxOutput(recipient string, value Amount) *TxOutput {
+	out := new(TxOutput)
+	out.recipientBlockchainAddress = recipient
+	out.value = value
+	return out
+}
 
-		if currentBlock.prevHash != prevBlock.Hash() {
-			return false
-		}
+func (out *TxOutput) RecipientBlockchainAddress() string {
+	return out.recipientBlockchainAddress
+}
 
-		if !bc.ValidProof(currentBlock.Nonce(), currentBlock.PrevHash(), currentBlock.Transactions(), MINING_DIFFICULITY) {
-			return false
-		}
+func (out *TxOutput) Value() Amount {
+	return out.value
+}
+
+func (out *TxOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Recipient string `json:"recipient_blockchain_address"`
+		Value     Amount `json:"value"`
+	}{
+		Recipient: out.recipientBlockchainAddress,
+		Value:     out.value,
+	})
+}
 
-		prevBlock = currentBlock
+func (out *TxOutput) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		Recipient *string `json:"recipient_blockchain_address"`
+		Value     *Amount `json:"value"`
+	}{
+		Recipient: &out.recipientBlockchainAddress,
+		Value:     &out.value,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
 	}
 
-	return true
+	return nil
 }
 
-func (bc *Blockchain) ResolveConflicts() bool {
-	var longestChain []*Block
-	maxLength := len(bc.chain)
+// Transaction moves value from outputs owned by senderBlockchainAddress to a
+// new set of outputs. Its inputs must add up to exactly its outputs plus
+// fee, which goes to the miner of the block that includes it. A coinbase
+// transaction has no inputs and is sent by MINING_SENDER_ADDRESS.
+//
+// Every other transaction carries the sender's public key and a signature
+// over its hash. Neither is covered by the hash itself; the key is bound to
+// the transaction instead through the sender address it must derive to.
+type Transaction struct {
+	senderBlockchainAddress string
+	inputs                  []*TxInput
+	outputs                 []*TxOutput
+	fee                     Amount
+	timestamp               int64
 
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/chain", n)
-		resp, _ := http.Get(endpoint)
+	senderPublicKey *ecdsa.PublicKey
+	signature       *blockchain_crypto.Signature
+}
 
-		if resp.StatusCode == 200 {
-			var bcr *Blockchain
-			dec := json.NewDecoder(resp.Body)
-			if err := dec.Decode(&bcr); err != nil {
-				log.Println(err)
-				return false
-			}
+func NewTransaction(sender string, inputs []*TxInput, outputs []*TxOutput, fee Amount) *Transaction {
+	t := new(Transaction)
+	t.senderBlockchainAddress = sender
+	t.inputs = inputs
+	t.outputs = outputs
+	t.fee = fee
+	t.timestamp = time.Now().UnixNano()
+	return t
+}
 
-			chain := bcr.Chain()
+func NewCoinbaseTransaction(recipient string, value Amount) *Transaction {
+	return NewTransaction(MINING_SENDER_ADDRESS, nil, []*TxOutput{NewTxOutput(recipient, value)}, 0)
+}
 
-			if maxLength < len(chain) && bc.ValidChain(chain) {
-				longestChain = chain
-				maxLength = len(chain)
-			}
-		} else {
-			log.Println("Error: HTTP request error")
-			return false
+func (t *Transaction) SenderBlockchainAddress() string {
+	return t.senderBlockchainAddress
+}
+
+func (t *Transaction) Inputs() []*TxInput {
+	return t.inputs
+}
+
+func (t *Transaction) Outputs() []*TxOutput {
+	return t.outputs
+}
+
+func (t *Transaction) Fee() Amount {
+	return t.fee
+}
+
+func (t *Transaction) Timestamp() int64 {
+	return t.timestamp
+}
+
+func (t *Transaction) SenderPublicKey() *ecdsa.PublicKey {
+	return t.senderPublicKey
+}
+
+func (t *Transaction) Signature() *blockchain_crypto.Signature {
+	return t.signature
+}
+
+// SetSignature attaches the sender's public key and the signature over Hash
+// that authorize t.
+func (t *Transaction) SetSignature(senderPublicKey *ecdsa.PublicKey, signature *blockchain_crypto.Signature) {
+	t.senderPublicKey = senderPublicKey
+	t.signature = signature
+}
+
+// VerifySignature reports whether t is signed by the key that owns its
+// sender address, which has to carry the network's addressVersion.
+func (t *Transaction) VerifySignature(addressVersion byte) bool {
+	if t.senderPublicKey == nil || t.signature == nil {
+		return false
+	}
+	if blockchain_crypto.PublicKeyToAddress(t.senderPublicKey, addressVersion) != t.senderBlockchainAddress {
+		return false
+	}
+	h := t.Hash()
+	return ecdsa.Verify(t.senderPublicKey, h[:], t.signature.R, t.signature.S)
+}
+
+// CheckRecipients requires every output of t to pay a well-formed address of
+// the network whose addresses start with addressVersion; coins sent to any
+// other address could never be spent.
+func (t *Transaction) CheckRecipients(addressVersion byte) error {
+	for i, out := range t.outputs {
+		v, err := blockchain_crypto.AddressVersion(out.recipientBlockchainAddress)
+		if err != nil {
+			return fmt.Errorf("%w: transaction %x output %d: %v", ErrInvalidTransaction, t.Hash(), i, err)
+		}
+		if v != addressVersion {
+			return fmt.Errorf("%w: transaction %x output %d pays an address of another network", ErrInvalidTransaction, t.Hash(), i)
 		}
 	}
+	return nil
+}
+
+// Size is the length of the transaction's canonical encoding in bytes, the
+// basis of its fee rate.
+func (t *Transaction) Size() int {
+	return len(t.Encode())
+}
+
+func (t *Transaction) IsCoinbase() bool {
+	return t.senderBlockchainAddress == MINING_SENDER_ADDRESS && len(t.inputs) == 0
+}
 
-	if longestChain != nil {
-		bc.chain = longestChain
-		log.Println("Resolve confilicts replaced")
-		return true
+// OutputValue is the sum of t's outputs, or ErrAmountOverflow if they do
+// not fit in an Amount.
+func (t *Transaction) OutputValue() (Amount, error) {
+	var total Amount
+	for _, out := range t.outputs {
+		var err error
+		if total, err = total.Add(out.value); err != nil {
+			return 0, err
+		}
 	}
+	return total, nil
+}
 
-	log.Println("Resolve confilicts not replaced")
-	return false
+// Hash is the transaction ID and what the sender signs. It covers every
+// field but the public key and signature, the inputs included, so it is
+// unique as long as no transaction is included twice, which the chain
+// enforces.
+func (t *Transaction) Hash() [32]byte {
+	return sha256.Sum256(t.signingBytes())
 }
 
-type Transaction struct {
-	senderBlockchainAddress    string
-	recipientBlockchainAddress string
-	value                      float32
+type transactionPayload struct {
+	Sender    string      `json:"sender_blockchain_address"`
+	Inputs    []*TxInput  `json:"inputs"`
+	Outputs   []*TxOutput `json:"outputs"`
+	Fee       Amount      `json:"fee"`
+	Timestamp int64       `json:"timestamp"`
 }
 
-func NewTransaction(sender, recipient string, value float32) *Transaction {
-	t := new(Transaction)
-	t.senderBlockchainAddress = sender
-	t.recipientBlockchainAddress = recipient
-	t.value = value
-	return t
+func (t *Transaction) payload() *transactionPayload {
+	return &transactionPayload{
+		Sender:    t.senderBlockchainAddress,
+		Inputs:    t.inputs,
+		Outputs:   t.outputs,
+		Fee:       t.fee,
+		Timestamp: t.timestamp,
+	}
 }
 
 func (t *Transaction) Print() {
 	fmt.Println(strings.Repeat("-", 40))
+	fmt.Printf("hash                            %x\n", t.Hash())
 	fmt.Printf("senderBlockchainAddress         %s\n", t.senderBlockchainAddress)
-	fmt.Printf("recipientBlockchainAddress      %s\n", t.recipientBlockchainAddress)
-	fmt.Printf("value                           %.1f\n", t.value)
+	for _, in := range t.inputs {
+		fmt.Printf("input                           %x:%d\n", in.prevTxHash, in.outputIndex)
+	}
+	for _, out := range t.outputs {
+		fmt.Printf("output                          %s %s\n", out.recipientBlockchainAddress, out.value)
+	}
+	fmt.Printf("fee                             %s\n", t.fee)
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
+	v := struct {
+		*transactionPayload
+		PublicKey string `json:"sender_public_key,omitempty"`
+		Signature string `json:"signature,omitempty"`
 	}{
-		Sender:    t.senderBlockchainAddress,
-		Recipient: t.recipientBlockchainAddress,
-		Value:     t.value,
-	})
+		transactionPayload: t.payload(),
+	}
+	if t.senderPublicKey != nil {
+		v.PublicKey = blockchain_crypto.PublicKeyToStr(t.senderPublicKey)
+	}
+	if t.signature != nil {
+		v.Signature = t.signature.String()
+	}
+
+	return json.Marshal(v)
 }
 
 func (t *Transaction) UnmarshalJSON(data []byte) error {
 	v := &struct {
-		Sender    *string  `json:"sender_blockchain_address"`
-		Recipient *string  `json:"recipient_blockchain_address"`
-		Value     *float32 `json:"value"`
+		Sender    *string      `json:"sender_blockchain_address"`
+		Inputs    *[]*TxInput  `json:"inputs"`
+		Outputs   *[]*TxOutput `json:"outputs"`
+		Fee       *Amount      `json:"fee"`
+		Timestamp *int64       `json:"timestamp"`
+		PublicKey *string      `json:"sender_public_key"`
+		Signature *string      `json:"signature"`
 	}{
 		Sender:    &t.senderBlockchainAddress,
-		Recipient: &t.recipientBlockchainAddress,
-		Value:     &t.value,
+		Inputs:    &t.inputs,
+		Outputs:   &t.outputs,
+		Fee:       &t.fee,
+		Timestamp: &t.timestamp,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
 
+	if v.PublicKey != nil && *v.PublicKey != "" {
+		if !blockchain_crypto.IsTupleStr(*v.PublicKey) {
+			return errors.New("invalid sender public key")
+		}
+		t.senderPublicKey = blockchain_crypto.PublicKeyStrToPublicKey(*v.PublicKey)
+	}
+	if v.Signature != nil && *v.Signature != "" {
+		if !blockchain_crypto.IsTupleStr(*v.Signature) {
+			return errors.New("invalid signature")
+		}
+		t.signature = blockchain_crypto.SignatureStrToSignature(*v.Signature)
+	}
+
 	return nil
 }
 
 type TransactionRequest struct {
-	SenderBlockchainAddress    *string  `json:"sender_blockchain_address"`
-	RecipientBlockchainAddress *string  `json:"recipient_blockchain_address"`
-	Value                      *float32 `json:"value"`
-	PublicKey                  *string  `json:"public_key"`
-	Signature                  *string  `json:"signature"`
+	Transaction *Transaction `json:"transaction"`
+	PublicKey   *string      `json:"public_key"`
+	Signature   *string      `json:"signature"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
-	if tr.SenderBlockchainAddress == nil ||
-		tr.RecipientBlockchainAddress == nil ||
-		tr.Value == nil ||
+	if tr.Transaction == nil ||
 		tr.PublicKey == nil ||
 		tr.Signature == nil {
 		return false
 	}
+	if !blockchain_crypto.IsTupleStr(*tr.PublicKey) ||
+		!blockchain_crypto.IsTupleStr(*tr.Signature) {
+		return false
+	}
 	return true
 }
 
@@ -501,6 +955,45 @@ func NewTransactions(transactions []*Transaction) *Transactions {
 	}
 }
 
+// AmountResponse is the balance of an address. Amount is the total, of which
+// Immature is in coinbase outputs that cannot be spent yet.
 type AmountResponse struct {
-	Amount float32 `json:"amount"`
+	Amount   Amount `json:"amount"`
+	Mature   Amount `json:"mature"`
+	Immature Amount `json:"immature"`
+}
+
+type UTXOResponse struct {
+	TxHash      string `json:"tx_hash"`
+	OutputIndex int    `json:"output_index"`
+	Value       Amount `json:"value"`
+}
+
+type UTXOsResponse struct {
+	UTXOs []*UTXOResponse `json:"utxos"`
+}
+
+// SupplyResponse reports the coins in existence at the tip of the active
+// chain and the subsidy of the next block.
+type SupplyResponse struct {
+	Height            int    `json:"height"`
+	Supply            Amount `json:"supply"`
+	MaxSupply         Amount `json:"max_supply,omitempty"`
+	NextBlockSubsidy  Amount `json:"next_block_subsidy"`
+	NextHalvingHeight int    `json:"next_halving_height"`
+}
+
+func HashStrToHash(hashStr string) ([32]byte, error) {
+	var h [32]byte
+
+	b, err := hex.DecodeString(hashStr)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != len(h) {
+		return h, fmt.Errorf("invalid hash length %d", len(b))
+	}
+	copy(h[:], b)
+
+	return h, nil
 }
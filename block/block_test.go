@@ -0,0 +1,75 @@
+package block
+
+import (
+	"errors"
+	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
+	"testing"
+)
+
+func TestGenesisBlockPerNetwork(t *testing.T) {
+	seen := make(map[[32]byte]string)
+	for _, name := range chaincfg.Names() {
+		params, _ := chaincfg.ByName(name)
+		h := GenesisBlock(params).Hash()
+		if other, ok := seen[h]; ok {
+			t.Errorf("%s and %s share a genesis block", name, other)
+		}
+		seen[h] = name
+	}
+}
+
+func TestCheckRecipients(t *testing.T) {
+	key, regtest := testKey(t)
+	mainnet := blockchain_crypto.PublicKeyToAddress(&key.PublicKey, chaincfg.MainNetParams.AddressVersion)
+	corrupt := []byte(regtest)
+	corrupt[len(corrupt)-1] ^= 1
+
+	tests := []struct {
+		name      string
+		recipient string
+		valid     bool
+	}{
+		{"own network", regtest, true},
+		{"other network", mainnet, false},
+		{"bad checksum", string(corrupt), false},
+		{"not an address", "recipient", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := NewTransaction(regtest, nil, []*TxOutput{NewTxOutput(regtest, 1), NewTxOutput(tt.recipient, 1)}, 0)
+			err := tx.CheckRecipients(chaincfg.RegTestParams.AddressVersion)
+			if tt.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidTransaction) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidTransaction)
+			}
+		})
+	}
+}
+
+// TestRejectsOtherNetworkRecipients checks that coins cannot be sent to a
+// mainnet address on regtest, by a transaction or by a coinbase.
+func TestRejectsOtherNetworkRecipients(t *testing.T) {
+	bc := testChain(t)
+	aliceKey, alice := testKey(t)
+	mainnet := blockchain_crypto.PublicKeyToAddress(&aliceKey.PublicKey, chaincfg.MainNetParams.AddressVersion)
+	a1 := mineOn(t, bc, bc.LastBlock(), 1, alice)
+	processBlocks(t, bc, a1)
+
+	spend := testSpend(t, aliceKey, a1.Transactions()[0], mainnet)
+	if err := bc.SubmitTransaction(spend, spend.SenderPublicKey(), spend.Signature()); !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("transaction: got %v, want %v", err, ErrInvalidTransaction)
+	}
+	if err := bc.ProcessBlock(mineOn(t, bc, a1, 2, mainnet)); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("coinbase: got %v, want %v", err, ErrInvalidBlock)
+	}
+	if err := bc.ProcessBlock(mineOn(t, bc, a1, 2, alice, spend)); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("block: got %v, want %v", err, ErrInvalidBlock)
+	}
+	if bc.LastBlock() != a1 {
+		t.Fatal("a block paying mainnet addresses changed the tip")
+	}
+}
@@ -0,0 +1,356 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"goblockchain/p2p"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	ErrBlockKnown   = errors.New("block already known")
+	ErrOrphanBlock  = errors.New("parent block not found")
+	ErrInvalidChain = errors.New("block extends an invalid branch")
+	ErrInvalidBlock = errors.New("invalid block")
+)
+
+// ReorgEvent describes a switch of the active chain to a branch that does
+// not simply extend the old tip.
+type ReorgEvent struct {
+	OldTip    [32]byte
+	NewTip    [32]byte
+	ForkPoint [32]byte
+	// Disconnected lists the blocks removed from the active chain, old tip
+	// first.
+	Disconnected []*Block
+	// Connected lists the blocks added to the active chain, in chain order.
+	Connected []*Block
+}
+
+// SubscribeReorg registers ch to receive every ReorgEvent. Events are sent
+// without blocking, so a subscriber that falls behind misses events rather
+// than stalling the chain; give ch a buffer.
+func (bc *Blockchain) SubscribeReorg(ch chan<- *ReorgEvent) {
+	bc.muxSubscribers.Lock()
+	defer bc.muxSubscribers.Unlock()
+
+	bc.reorgSubscribers = append(bc.reorgSubscribers, ch)
+}
+
+func (bc *Blockchain) publishReorg(e *ReorgEvent) {
+	bc.muxSubscribers.Lock()
+	defer bc.muxSubscribers.Unlock()
+
+	for _, ch := range bc.reorgSubscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Println("Error: reorg subscriber is not keeping up, event dropped")
+		}
+	}
+}
+
+// ProcessBlock adds b to the block tree, or fills in its transactions if
+// only its header was known. If that makes a branch with more cumulative
+// work than the active chain connectable, the chain reorganizes onto it.
+func (bc *Blockchain) ProcessBlock(b *Block) error {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	return bc.processBlock(b)
+}
+
+func (bc *Blockchain) processBlock(b *Block) error {
+	n, ok := bc.tree.lookup(b.Hash())
+	if ok && n.hasData {
+		return ErrBlockKnown
+	}
+
+	if !ok {
+		if err := bc.processHeader(b.Header()); err != nil {
+			return err
+		}
+		n, _ = bc.tree.lookup(b.Hash())
+	} else if n.hasInvalidAncestor() {
+		return ErrInvalidChain
+	}
+
+	// A body that does not match the header says nothing about the block,
+	// only about whoever sent it; a matching body that breaks the rules
+	// makes the block invalid for good.
+	if b.MerkleRoot() != MerkleRoot(b.transactions) {
+		return fmt.Errorf("%w: merkle root does not match transactions", ErrInvalidBlock)
+	}
+	if err := bc.checkBody(b, n.height); err != nil {
+		bc.tree.markInvalid(n)
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	if err := bc.store.Append(b); err != nil {
+		return err
+	}
+	bc.tree.setData(n, b)
+
+	best := bc.tree.best()
+	if best.chainWork.Cmp(bc.tip.chainWork) <= 0 {
+		if n.connectable() && !n.isAncestorOf(bc.tip) {
+			log.Printf("action=ProcessBlock, status=side_branch, hash=%x, height=%d", n.hash, n.height)
+		}
+		return nil
+	}
+
+	if err := bc.setTip(best); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	return nil
+}
+
+// processHeader adds h to the block tree without its transactions, after
+// checking it against the branch it extends.
+func (bc *Blockchain) processHeader(h *BlockHeader) error {
+	if _, ok := bc.tree.lookup(h.Hash()); ok {
+		return ErrBlockKnown
+	}
+
+	// Our own genesis block is known, so this one starts another chain.
+	if h.PrevHash() == ([32]byte{}) {
+		return fmt.Errorf("%w: header %x", p2p.ErrGenesisMismatch, h.Hash())
+	}
+	parent, ok := bc.tree.lookup(h.PrevHash())
+	if !ok {
+		return ErrOrphanBlock
+	}
+	if parent.hasInvalidAncestor() {
+		return ErrInvalidChain
+	}
+	if err := bc.checkHeader(h, parent.height+1, parent.recent(bc.contextBlocks())); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	_, err := bc.tree.addHeader(h)
+	return err
+}
+
+// contextBlocks is how many of the blocks before a block its checks look
+// at: enough for the retarget window and the median time past.
+func (bc *Blockchain) contextBlocks() int {
+	if bc.params.RetargetInterval > MINING_MEDIAN_TIME_BLOCKS {
+		return bc.params.RetargetInterval
+	}
+	return MINING_MEDIAN_TIME_BLOCKS
+}
+
+// checkBlock runs the checks that do not depend on the UTXO set against the
+// branch that b extends.
+func (bc *Blockchain) checkBlock(b *Block, parent *blockNode) error {
+	return bc.checkBlockContext(b, parent.height+1, parent.recent(bc.contextBlocks()))
+}
+
+// checkBlockContext checks b as the block at height, following the blocks
+// in recent, which end with its parent and hold at least contextBlocks of
+// them: the header, the merkle root and the body. Whether the transactions
+// spend outputs that exist is left to the UTXO set.
+func (bc *Blockchain) checkBlockContext(b *Block, height int, recent []*Block) error {
+	if err := bc.checkHeader(b.Header(), height, recent); err != nil {
+		return err
+	}
+	if b.MerkleRoot() != MerkleRoot(b.transactions) {
+		return errors.New("merkle root does not match transactions")
+	}
+	return bc.checkBody(b, height)
+}
+
+// checkHeader checks h as the header at height, following the blocks in
+// recent as checkBlockContext: the difficulty the branch requires at this
+// height, the proof of work and the timestamp. This is all that can be
+// checked before the block's transactions arrive.
+func (bc *Blockchain) checkHeader(h *BlockHeader, height int, recent []*Block) error {
+	if h.Bits() != calcNextBits(bc.params, height, recent) {
+		return errors.New("block difficulty does not follow the retarget rule")
+	}
+	if !bc.ValidProof(h) {
+		return errors.New("invalid proof of work")
+	}
+	if h.Timestamp() <= medianTimePast(recent) {
+		return errors.New("block timestamp is not after the median of the previous blocks")
+	}
+	if h.Timestamp() > time.Now().Add(MINING_MAX_FUTURE_SEC*time.Second).UnixNano() {
+		return errors.New("block timestamp is too far in the future")
+	}
+	return nil
+}
+
+// checkBody checks the size and transactions of a block at height whose
+// merkle root matches them.
+func (bc *Blockchain) checkBody(b *Block, height int) error {
+	if b.Size() > MINING_MAX_BLOCK_SIZE {
+		return errors.New("block exceeds the maximum block size")
+	}
+	return bc.checkTransactions(b, height)
+}
+
+// medianTimePast is the median timestamp of the last
+// MINING_MEDIAN_TIME_BLOCKS blocks of chain. A block must be stamped later
+// than it, which keeps block times moving forward without requiring every
+// miner's clock to agree.
+func medianTimePast(chain []*Block) int64 {
+	start := len(chain) - MINING_MEDIAN_TIME_BLOCKS
+	if start < 0 {
+		start = 0
+	}
+
+	timestamps := make([]int64, 0, len(chain)-start)
+	for _, b := range chain[start:] {
+		timestamps = append(timestamps, b.Timestamp())
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// checkTransactions requires b to open with exactly one coinbase, paying the
+// subsidy for height plus the fees of the other transactions, every other
+// transaction to be signed by its sender, and every output to pay an address
+// of the chain's network.
+func (bc *Blockchain) checkTransactions(b *Block, height int) error {
+	if len(b.transactions) == 0 || !b.transactions[0].IsCoinbase() {
+		return errors.New("block does not start with a coinbase transaction")
+	}
+	for _, t := range b.transactions {
+		if err := t.CheckRecipients(bc.params.AddressVersion); err != nil {
+			return err
+		}
+	}
+
+	var fees Amount
+	for _, t := range b.transactions[1:] {
+		if t.IsCoinbase() {
+			return errors.New("block has more than one coinbase transaction")
+		}
+		if !t.VerifySignature(bc.params.AddressVersion) {
+			return fmt.Errorf("transaction %x has an invalid signature", t.Hash())
+		}
+		var err error
+		if fees, err = fees.Add(t.fee); err != nil {
+			return fmt.Errorf("block fees: %w", err)
+		}
+	}
+
+	reward, err := CalcBlockSubsidy(bc.params, height).Add(fees)
+	if err != nil {
+		return fmt.Errorf("block reward: %w", err)
+	}
+	value, err := b.transactions[0].OutputValue()
+	if err != nil {
+		return fmt.Errorf("coinbase: %w", err)
+	}
+	if value != reward {
+		return fmt.Errorf("coinbase pays %s instead of %s", value, reward)
+	}
+
+	return nil
+}
+
+// setTip makes newTip the end of the active chain. Blocks from the old tip
+// back to the fork point are disconnected from the UTXO set and the new
+// branch is connected in their place. If a block on the new branch does not
+// connect, it is marked invalid and the old chain is restored.
+func (bc *Blockchain) setTip(newTip *blockNode) error {
+	oldTip := bc.tip
+	fork := findFork(oldTip, newTip)
+
+	var disconnected []*blockNode
+	for n := oldTip; n != fork; n = n.parent {
+		bc.utxos.Disconnect(n.block, n.undo)
+		n.undo = nil
+		disconnected = append(disconnected, n)
+	}
+
+	var connected []*blockNode
+	for n := newTip; n != fork; n = n.parent {
+		connected = append(connected, n)
+	}
+	for i, j := 0, len(connected)-1; i < j; i, j = i+1, j-1 {
+		connected[i], connected[j] = connected[j], connected[i]
+	}
+
+	for i, n := range connected {
+		undo, err := bc.utxos.Apply(n.block)
+		if err != nil {
+			bc.tree.markInvalid(n)
+			for j := i - 1; j >= 0; j-- {
+				bc.utxos.Disconnect(connected[j].block, connected[j].undo)
+				connected[j].undo = nil
+			}
+			for j := len(disconnected) - 1; j >= 0; j-- {
+				disconnected[j].undo, _ = bc.utxos.Apply(disconnected[j].block)
+			}
+			return fmt.Errorf("block %x: %w", n.hash, err)
+		}
+		n.undo = undo
+	}
+
+	chain := make([]*Block, 0, newTip.height+1)
+	chain = append(chain, bc.chain[:fork.height+1]...)
+	for _, n := range connected {
+		chain = append(chain, n.block)
+	}
+	bc.chain = chain
+	bc.tip = newTip
+	for _, n := range disconnected {
+		bc.index.disconnect(n.block, n.height)
+	}
+	for _, n := range connected {
+		bc.index.connect(n.block, n.height)
+	}
+	close(bc.tipChanged)
+	bc.tipChanged = make(chan struct{})
+
+	for _, n := range connected {
+		bc.mempool.RemoveBlock(n.block)
+	}
+	if len(disconnected) == 0 {
+		return nil
+	}
+
+	// Transactions from the abandoned branch go back to the mempool, oldest
+	// block first, ahead of what was already waiting. What was waiting may
+	// have spent outputs of the abandoned branch, so everything is checked
+	// against the new chain again.
+	var candidates []*Transaction
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, t := range disconnected[i].block.transactions {
+			if !t.IsCoinbase() {
+				candidates = append(candidates, t)
+			}
+		}
+	}
+	candidates = append(candidates, bc.mempool.Clear()...)
+	for _, t := range candidates {
+		if err := bc.utxos.CheckTransaction(t, bc.mempool.Spends()); err != nil {
+			continue
+		}
+		bc.mempool.Add(t)
+	}
+
+	e := &ReorgEvent{
+		OldTip:    oldTip.hash,
+		NewTip:    newTip.hash,
+		ForkPoint: fork.hash,
+	}
+	for _, n := range disconnected {
+		e.Disconnected = append(e.Disconnected, n.block)
+	}
+	for _, n := range connected {
+		e.Connected = append(e.Connected, n.block)
+	}
+	log.Printf("action=Reorg, fork=%x, disconnected=%d, connected=%d", fork.hash, len(disconnected), len(connected))
+	bc.publishReorg(e)
+
+	return nil
+}
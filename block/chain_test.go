@@ -0,0 +1,116 @@
+package block
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"goblockchain/blockchain_crypto"
+	"testing"
+)
+
+func signTransaction(t *testing.T, key *ecdsa.PrivateKey, tx *Transaction) *Transaction {
+	t.Helper()
+	h := tx.Hash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.SetSignature(&key.PublicKey, &blockchain_crypto.Signature{R: r, S: s})
+	return tx
+}
+
+// solveOn returns a block on parent holding exactly transactions, with a
+// valid proof of work.
+func solveOn(t *testing.T, bc *Blockchain, parent *Block, transactions ...*Transaction) *Block {
+	t.Helper()
+	b := NewBlock(0, parent.Hash(), bc.params.PowLimitBits, transactions)
+	if err := bc.ProofOfWork(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProcessBlockRejectsInvalidBody(t *testing.T) {
+	bc := testChain(t)
+	aliceKey, alice := testKey(t)
+	bobKey, bob := testKey(t)
+	a1 := mineOn(t, bc, bc.LastBlock(), 1, alice)
+	processBlocks(t, bc, a1)
+
+	reward := a1.Transactions()[0]
+	subsidy := CalcBlockSubsidy(bc.params, 2)
+	coinbase := func(value Amount) *Transaction { return NewCoinbaseTransaction(bob, value) }
+	spend := func(fee Amount) *Transaction {
+		return NewTransaction(alice, []*TxInput{NewTxInput(reward.Hash(), 0)}, []*TxOutput{NewTxOutput(bob, reward.Outputs()[0].Value()-fee)}, fee)
+	}
+
+	tests := []struct {
+		name         string
+		transactions func() []*Transaction
+	}{
+		{"no transactions", func() []*Transaction { return nil }},
+		{"no coinbase", func() []*Transaction {
+			return []*Transaction{signTransaction(t, aliceKey, spend(0))}
+		}},
+		{"two coinbases", func() []*Transaction {
+			return []*Transaction{coinbase(subsidy), NewCoinbaseTransaction(alice, 0)}
+		}},
+		{"coinbase pays too much", func() []*Transaction {
+			return []*Transaction{coinbase(subsidy + 1)}
+		}},
+		{"coinbase leaves out the fees", func() []*Transaction {
+			return []*Transaction{coinbase(subsidy), signTransaction(t, aliceKey, spend(1000))}
+		}},
+		{"unsigned", func() []*Transaction {
+			return []*Transaction{coinbase(subsidy), spend(0)}
+		}},
+		{"signed by another key", func() []*Transaction {
+			return []*Transaction{coinbase(subsidy), signTransaction(t, bobKey, spend(0))}
+		}},
+		{"altered after signing", func() []*Transaction {
+			tx := signTransaction(t, aliceKey, spend(0))
+			tx.outputs[0] = NewTxOutput(bob, tx.outputs[0].value-1)
+			return []*Transaction{coinbase(subsidy), tx}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := solveOn(t, bc, a1, tt.transactions()...)
+			if err := bc.ProcessBlock(b); !errors.Is(err, ErrInvalidBlock) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidBlock)
+			}
+			if bc.LastBlock() != a1 {
+				t.Fatal("the invalid block changed the tip")
+			}
+			// The body matched the header, so the block is invalid for good.
+			if err := bc.ProcessBlock(b); !errors.Is(err, ErrInvalidChain) {
+				t.Fatalf("sent again: got %v, want %v", err, ErrInvalidChain)
+			}
+		})
+	}
+
+	b := solveOn(t, bc, a1, coinbase(subsidy+1000), signTransaction(t, aliceKey, spend(1000)))
+	processBlocks(t, bc, b)
+	if bc.LastBlock() != b {
+		t.Fatal("a valid block after the invalid ones did not become the tip")
+	}
+}
+
+// TestProcessBlockMismatchedBody sends a block whose transactions do not
+// match its header, which says nothing about the block itself.
+func TestProcessBlockMismatchedBody(t *testing.T) {
+	bc := testChain(t)
+	_, alice := testKey(t)
+	_, bob := testKey(t)
+	b := mineOn(t, bc, bc.LastBlock(), 1, alice)
+
+	forged := &Block{header: b.header, transactions: []*Transaction{NewCoinbaseTransaction(bob, CalcBlockSubsidy(bc.params, 1))}}
+	if err := bc.ProcessBlock(forged); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidBlock)
+	}
+	processBlocks(t, bc, b)
+	if bc.LastBlock() != b {
+		t.Fatal("the real block was refused after a mismatched body")
+	}
+}
@@ -0,0 +1,128 @@
+package block
+
+import (
+	"goblockchain/chaincfg"
+	"math/big"
+	"time"
+)
+
+// Difficulty is carried in each header as a compact target, the same nBits
+// encoding Bitcoin uses: the top byte is the length of the target in bytes
+// and the low three bytes are its most significant digits. A header is valid
+// when its hash, read as a big-endian integer, does not exceed the target.
+
+var bigOne = big.NewInt(1)
+
+// CompactToBig expands a compact target into the full integer it encodes.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if negative {
+		bn = bn.Neg(bn)
+	}
+
+	return bn
+}
+
+// BigToCompact packs n into compact form, dropping any precision beyond the
+// three most significant bytes.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Set(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+
+	// The sign bit lives in the mantissa, so a mantissa that would set it is
+	// shifted down a byte instead.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// CalcWork returns the expected number of hashes needed to find a header
+// that meets bits, 2^256 / (target+1).
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, bigOne)
+	return new(big.Int).Div(new(big.Int).Lsh(bigOne, 256), denominator)
+}
+
+// CalcNextBits returns the difficulty the block following chain has to use
+// under params. Difficulty stays fixed within a window of RetargetInterval
+// blocks; at the start of each new window the target is scaled by how long
+// the previous window actually took compared with TargetBlockSec per block,
+// limited to a factor of MaxRetargetFactor either way.
+func CalcNextBits(params *chaincfg.Params, chain []*Block) uint32 {
+	return calcNextBits(params, len(chain), chain)
+}
+
+// calcNextBits is CalcNextBits for the block at height, given only the
+// blocks just before it in recent: at least the last RetargetInterval of
+// them, or all of them near the genesis block.
+func calcNextBits(params *chaincfg.Params, height int, recent []*Block) uint32 {
+	if height == 0 || params.NoRetargeting {
+		return params.PowLimitBits
+	}
+
+	last := recent[len(recent)-1]
+	if height%params.RetargetInterval != 0 {
+		return last.header.bits
+	}
+
+	first := recent[len(recent)-params.RetargetInterval]
+	actual := last.header.timestamp - first.header.timestamp
+	expected := int64(time.Second) * params.TargetBlockSec * int64(params.RetargetInterval-1)
+
+	if actual < expected/params.MaxRetargetFactor {
+		actual = expected / params.MaxRetargetFactor
+	}
+	if actual > expected*params.MaxRetargetFactor {
+		actual = expected * params.MaxRetargetFactor
+	}
+
+	target := CompactToBig(last.header.bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if powLimit := CompactToBig(params.PowLimitBits); target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+
+	return BigToCompact(target)
+}
+
+// HashToBig reads a block hash as a big-endian integer so it can be compared
+// with a target.
+func HashToBig(hash [32]byte) *big.Int {
+	return new(big.Int).SetBytes(hash[:])
+}
@@ -0,0 +1,343 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goblockchain/blockchain_crypto"
+	"math"
+	"math/big"
+)
+
+// ENCODING_VERSION leads every encoded header and transaction. Any change to
+// the layout below must bump it, since hashes and signatures are computed
+// over these bytes.
+//
+// All integers are big-endian. Lengths and counts are unsigned varints.
+//
+//	header:      version uint32, prev hash [32], merkle root [32],
+//	             timestamp int64, bits uint32, nonce int64
+//	transaction: version uint32, sender string, input count,
+//	             inputs (tx hash [32], index uvarint), output count,
+//	             outputs (recipient string, value int64), fee int64,
+//	             timestamp int64, witness
+//	witness:     flag byte, then public key X, Y [32] if set,
+//	             flag byte, then signature R, S [32] if set
+//	block:       header, transaction count, transactions
+//
+// The transaction hash covers everything but the witness.
+const ENCODING_VERSION uint32 = 1
+
+var ErrEncoding = errors.New("malformed encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) hash(h [32]byte) {
+	e.buf = append(e.buf, h[:]...)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bigInt32(v *big.Int) {
+	var b [32]byte
+	v.FillBytes(b[:])
+	e.buf = append(e.buf, b[:]...)
+}
+
+// headerTimestampOffset and headerNonceOffset locate the fields a miner
+// varies within an encoded header.
+const (
+	headerTimestampOffset = 4 + 32 + 32
+	headerNonceOffset     = headerTimestampOffset + 8 + 4
+)
+
+func (e *encoder) header(h *BlockHeader) {
+	e.uint32(ENCODING_VERSION)
+	e.hash(h.prevHash)
+	e.hash(h.merkleRoot)
+	e.int64(h.timestamp)
+	e.uint32(h.bits)
+	e.int64(int64(h.nonce))
+}
+
+func (e *encoder) transaction(t *Transaction, witness bool) {
+	e.uint32(ENCODING_VERSION)
+	e.string(t.senderBlockchainAddress)
+	e.uvarint(uint64(len(t.inputs)))
+	for _, in := range t.inputs {
+		e.hash(in.prevTxHash)
+		e.uvarint(uint64(in.outputIndex))
+	}
+	e.uvarint(uint64(len(t.outputs)))
+	for _, out := range t.outputs {
+		e.string(out.recipientBlockchainAddress)
+		e.int64(int64(out.value))
+	}
+	e.int64(int64(t.fee))
+	e.int64(t.timestamp)
+	if !witness {
+		return
+	}
+
+	if t.senderPublicKey != nil {
+		e.buf = append(e.buf, 1)
+		e.bigInt32(t.senderPublicKey.X)
+		e.bigInt32(t.senderPublicKey.Y)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+	if t.signature != nil {
+		e.buf = append(e.buf, 1)
+		e.bigInt32(t.signature.R)
+		e.bigInt32(t.signature.S)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// decoder reads the encoding above. The first error sticks, so a sequence of
+// reads can be checked once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.fail("unexpected end of data")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("invalid varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads a length or count of items that each take at least minSize
+// bytes, rejecting values the remaining data cannot possibly hold before
+// anything is allocated for them.
+func (d *decoder) count(minSize int) int {
+	v := d.uvarint()
+	if d.err == nil && v > uint64(len(d.data)/minSize) {
+		d.fail("count %d exceeds the remaining data", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) hash() [32]byte {
+	var h [32]byte
+	copy(h[:], d.next(32))
+	return h
+}
+
+func (d *decoder) string() string {
+	return string(d.next(d.count(1)))
+}
+
+func (d *decoder) bigInt32() *big.Int {
+	return new(big.Int).SetBytes(d.next(32))
+}
+
+func (d *decoder) version() {
+	if v := d.uint32(); d.err == nil && v != ENCODING_VERSION {
+		d.fail("unsupported version %d", v)
+	}
+}
+
+func (d *decoder) header() *BlockHeader {
+	h := new(BlockHeader)
+	d.version()
+	h.prevHash = d.hash()
+	h.merkleRoot = d.hash()
+	h.timestamp = d.int64()
+	h.bits = d.uint32()
+	h.nonce = int(d.int64())
+	return h
+}
+
+func (d *decoder) transaction() *Transaction {
+	t := new(Transaction)
+	d.version()
+	t.senderBlockchainAddress = d.string()
+
+	n := d.count(33)
+	t.inputs = make([]*TxInput, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		in := &TxInput{prevTxHash: d.hash()}
+		index := d.uvarint()
+		if index > math.MaxInt32 {
+			d.fail("output index %d out of range", index)
+		}
+		in.outputIndex = int(index)
+		t.inputs = append(t.inputs, in)
+	}
+
+	n = d.count(9)
+	t.outputs = make([]*TxOutput, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		out := &TxOutput{recipientBlockchainAddress: d.string()}
+		out.value = Amount(d.int64())
+		t.outputs = append(t.outputs, out)
+	}
+
+	t.fee = Amount(d.int64())
+	t.timestamp = d.int64()
+
+	switch d.byte() {
+	case 0:
+	case 1:
+		t.senderPublicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: d.bigInt32(), Y: d.bigInt32()}
+	default:
+		d.fail("invalid public key flag")
+	}
+	switch d.byte() {
+	case 0:
+	case 1:
+		t.signature = &blockchain_crypto.Signature{R: d.bigInt32(), S: d.bigInt32()}
+	default:
+		d.fail("invalid signature flag")
+	}
+
+	return t
+}
+
+func (d *decoder) end() {
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+}
+
+// Encode returns the canonical encoding of h, which is what Hash covers.
+func (h *BlockHeader) Encode() []byte {
+	var e encoder
+	e.header(h)
+	return e.buf
+}
+
+func DecodeBlockHeader(data []byte) (*BlockHeader, error) {
+	d := decoder{data: data}
+	h := d.header()
+	d.end()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return h, nil
+}
+
+// Encode returns the canonical encoding of t including its public key and
+// signature.
+func (t *Transaction) Encode() []byte {
+	var e encoder
+	e.transaction(t, true)
+	return e.buf
+}
+
+// signingBytes is the encoding of t without its witness, which is what Hash
+// covers and the sender signs.
+func (t *Transaction) signingBytes() []byte {
+	var e encoder
+	e.transaction(t, false)
+	return e.buf
+}
+
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d := decoder{data: data}
+	t := d.transaction()
+	d.end()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return t, nil
+}
+
+// Encode returns the canonical encoding of b, its header followed by all of
+// its transactions.
+func (b *Block) Encode() []byte {
+	var e encoder
+	e.header(&b.header)
+	e.uvarint(uint64(len(b.transactions)))
+	for _, t := range b.transactions {
+		e.transaction(t, true)
+	}
+	return e.buf
+}
+
+func DecodeBlock(data []byte) (*Block, error) {
+	d := decoder{data: data}
+	b := &Block{header: *d.header()}
+	n := d.count(1)
+	b.transactions = make([]*Transaction, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		b.transactions = append(b.transactions, d.transaction())
+	}
+	d.end()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return b, nil
+}
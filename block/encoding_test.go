@@ -0,0 +1,147 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"goblockchain/blockchain_crypto"
+	"testing"
+)
+
+// testSignedTransaction returns a transaction carrying a public key and a
+// signature over its hash.
+func testSignedTransaction(t *testing.T) *Transaction {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := testTransactions(2)[1]
+	h := tx.Hash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.SetSignature(&key.PublicKey, &blockchain_crypto.Signature{R: r, S: s})
+	return tx
+}
+
+func TestTransactionEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *Transaction
+	}{
+		{"unsigned", testTransactions(1)[0]},
+		{"signed", testSignedTransaction(t)},
+		{"coinbase", NewTransaction(MINING_SENDER_ADDRESS, nil, []*TxOutput{NewTxOutput("miner", COIN)}, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.tx.Encode()
+			got, err := DecodeTransaction(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Encode(), data) {
+				t.Fatal("re-encoding the decoded transaction changed it")
+			}
+			if got.Hash() != tt.tx.Hash() {
+				t.Fatalf("hash %x, want %x", got.Hash(), tt.tx.Hash())
+			}
+			if (got.Signature() != nil) != (tt.tx.Signature() != nil) {
+				t.Fatal("witness lost in the round trip")
+			}
+		})
+	}
+}
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	b := NewBlock(7, [32]byte{9}, 0x207fffff, append(testTransactions(3), testSignedTransaction(t)))
+	data := b.Encode()
+
+	got, err := DecodeBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Encode(), data) {
+		t.Fatal("re-encoding the decoded block changed it")
+	}
+	if got.Hash() != b.Hash() || got.MerkleRoot() != b.MerkleRoot() {
+		t.Fatalf("hash %x, want %x", got.Hash(), b.Hash())
+	}
+
+	header, err := DecodeBlockHeader(b.header.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Hash() != b.Hash() {
+		t.Fatalf("header hash %x, want %x", header.Hash(), b.Hash())
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	tx := testSignedTransaction(t).Encode()
+	b := NewBlock(1, [32]byte{}, 0, testTransactions(2)).Encode()
+	header := b[:headerNonceOffset+8]
+
+	decoders := map[string]func([]byte) error{
+		"header": func(data []byte) error {
+			_, err := DecodeBlockHeader(data)
+			return err
+		},
+		"transaction": func(data []byte) error {
+			_, err := DecodeTransaction(data)
+			return err
+		},
+		"block": func(data []byte) error {
+			_, err := DecodeBlock(data)
+			return err
+		},
+	}
+	witnessFlag := len(tx) - 1 - 64 - 1 - 64
+
+	tests := []struct {
+		name    string
+		decoder string
+		data    []byte
+	}{
+		{"header trailing bytes", "header", append(append([]byte(nil), header...), 0)},
+		{"transaction trailing bytes", "transaction", append(append([]byte(nil), tx...), 0)},
+		{"block trailing bytes", "block", append(append([]byte(nil), b...), 0)},
+		{"empty", "transaction", nil},
+		{"version", "header", func() []byte {
+			data := append([]byte(nil), header...)
+			binary.BigEndian.PutUint32(data, ENCODING_VERSION+1)
+			return data
+		}()},
+		{"transaction count past the end", "block", func() []byte {
+			data := append([]byte(nil), header...)
+			return binary.AppendUvarint(data, 1<<40)
+		}()},
+		{"witness flag", "transaction", func() []byte {
+			data := append([]byte(nil), tx...)
+			data[witnessFlag] = 2
+			return data
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := decoders[tt.decoder](tt.data); !errors.Is(err, ErrEncoding) {
+				t.Fatalf("got %v, want %v", err, ErrEncoding)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for name, data := range map[string][]byte{"header": header, "transaction": tx, "block": b} {
+			for n := 0; n < len(data); n++ {
+				if err := decoders[name](data[:n]); !errors.Is(err, ErrEncoding) {
+					t.Fatalf("%s cut to %d bytes: got %v, want %v", name, n, err, ErrEncoding)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package block
+
+import "fmt"
+
+const (
+	// EXPLORER_DEFAULT_LIMIT is the page size of the explorer listings when
+	// none is asked for, and EXPLORER_MAX_LIMIT the largest page served.
+	EXPLORER_DEFAULT_LIMIT = 20
+	EXPLORER_MAX_LIMIT     = 100
+)
+
+// BlockSummaryResponse describes a block of the active chain without its
+// transactions.
+type BlockSummaryResponse struct {
+	Height        int    `json:"height"`
+	Hash          string `json:"hash"`
+	PrevHash      string `json:"prev_hash"`
+	MerkleRoot    string `json:"merkle_root"`
+	Timestamp     int64  `json:"timestamp"`
+	Bits          uint32 `json:"bits"`
+	Nonce         int    `json:"nonce"`
+	Size          int    `json:"size"`
+	TxCount       int    `json:"tx_count"`
+	Confirmations int    `json:"confirmations"`
+}
+
+// BlockInfoResponse is a block of the active chain with its transactions.
+// NextHash is empty for the tip.
+type BlockInfoResponse struct {
+	*BlockSummaryResponse
+	NextHash     string         `json:"next_hash,omitempty"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+// BlocksResponse is a page of blocks of the active chain, whose tip is at
+// Height.
+type BlocksResponse struct {
+	Height int                     `json:"height"`
+	Offset int                     `json:"offset"`
+	Limit  int                     `json:"limit"`
+	Blocks []*BlockSummaryResponse `json:"blocks"`
+}
+
+// TransactionInfoResponse is a transaction of the active chain or the
+// mempool. BlockHash and BlockHeight are left out while it is in the
+// mempool, with no confirmations.
+type TransactionInfoResponse struct {
+	Hash          string       `json:"hash"`
+	BlockHash     string       `json:"block_hash,omitempty"`
+	BlockHeight   *int         `json:"block_height,omitempty"`
+	Confirmations int          `json:"confirmations"`
+	Transaction   *Transaction `json:"transaction"`
+}
+
+// AddressTransactionResponse is a transaction in the history of an address:
+// Received is what its outputs pay the address, and Sent what the address
+// spent on it, outputs and fee, if it is the sender.
+type AddressTransactionResponse struct {
+	Hash          string `json:"hash"`
+	BlockHash     string `json:"block_hash"`
+	BlockHeight   int    `json:"block_height"`
+	Timestamp     int64  `json:"timestamp"`
+	Received      Amount `json:"received"`
+	Sent          Amount `json:"sent"`
+	Confirmations int    `json:"confirmations"`
+}
+
+// AddressHistoryResponse is a page of the transactions of an address on the
+// active chain, newest first, out of Total.
+type AddressHistoryResponse struct {
+	Address      string                        `json:"address"`
+	Total        int                           `json:"total"`
+	Offset       int                           `json:"offset"`
+	Limit        int                           `json:"limit"`
+	Transactions []*AddressTransactionResponse `json:"transactions"`
+}
+
+// BlockInfo returns the block of the active chain whose header hashes to
+// hash.
+func (bc *Blockchain) BlockInfo(hash [32]byte) (*BlockInfoResponse, bool) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	_, height, ok := bc.blockByHash(hash)
+	if !ok {
+		return nil, false
+	}
+	return bc.blockInfo(height), true
+}
+
+// BlockInfoAt returns the block of the active chain at height.
+func (bc *Blockchain) BlockInfoAt(height int) (*BlockInfoResponse, bool) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	if height < 0 || height >= len(bc.chain) {
+		return nil, false
+	}
+	return bc.blockInfo(height), true
+}
+
+// blockInfo must be called with bc.mux held.
+func (bc *Blockchain) blockInfo(height int) *BlockInfoResponse {
+	b := bc.chain[height]
+	info := &BlockInfoResponse{
+		BlockSummaryResponse: bc.blockSummary(height),
+		Transactions:         b.transactions,
+	}
+	if height+1 < len(bc.chain) {
+		info.NextHash = fmt.Sprintf("%x", bc.chain[height+1].Hash())
+	}
+	return info
+}
+
+// blockSummary must be called with bc.mux held.
+func (bc *Blockchain) blockSummary(height int) *BlockSummaryResponse {
+	b := bc.chain[height]
+	return &BlockSummaryResponse{
+		Height:        height,
+		Hash:          fmt.Sprintf("%x", b.Hash()),
+		PrevHash:      fmt.Sprintf("%x", b.header.prevHash),
+		MerkleRoot:    fmt.Sprintf("%x", b.header.merkleRoot),
+		Timestamp:     b.header.timestamp,
+		Bits:          b.header.bits,
+		Nonce:         b.header.nonce,
+		Size:          b.Size(),
+		TxCount:       len(b.transactions),
+		Confirmations: bc.tip.height - height + 1,
+	}
+}
+
+// ChainBlocks lists the blocks of the active chain from the genesis block
+// up, skipping the first offset.
+func (bc *Blockchain) ChainBlocks(offset, limit int) *BlocksResponse {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	start, end, limit := page(len(bc.chain), offset, limit)
+	r := &BlocksResponse{Height: bc.tip.height, Offset: start, Limit: limit, Blocks: make([]*BlockSummaryResponse, 0, end-start)}
+	for h := start; h < end; h++ {
+		r.Blocks = append(r.Blocks, bc.blockSummary(h))
+	}
+	return r
+}
+
+// LatestBlocks lists the blocks of the active chain from the tip down,
+// skipping the first offset.
+func (bc *Blockchain) LatestBlocks(offset, limit int) *BlocksResponse {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	start, end, limit := page(len(bc.chain), offset, limit)
+	r := &BlocksResponse{Height: bc.tip.height, Offset: start, Limit: limit, Blocks: make([]*BlockSummaryResponse, 0, end-start)}
+	for i := start; i < end; i++ {
+		r.Blocks = append(r.Blocks, bc.blockSummary(bc.tip.height-i))
+	}
+	return r
+}
+
+// TransactionInfo returns the transaction hash identifies, looking in the
+// mempool if it is not on the active chain.
+func (bc *Blockchain) TransactionInfo(hash [32]byte) (*TransactionInfoResponse, bool) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	if loc, ok := bc.index.transactions[hash]; ok {
+		b := bc.chain[loc.height]
+		height := loc.height
+		return &TransactionInfoResponse{
+			Hash:          fmt.Sprintf("%x", hash),
+			BlockHash:     fmt.Sprintf("%x", b.Hash()),
+			BlockHeight:   &height,
+			Confirmations: bc.tip.height - loc.height + 1,
+			Transaction:   b.transactions[loc.index],
+		}, true
+	}
+	if t, ok := bc.mempool.Get(hash); ok {
+		return &TransactionInfoResponse{Hash: fmt.Sprintf("%x", hash), Transaction: t}, true
+	}
+	return nil, false
+}
+
+// AddressHistory lists the transactions of the active chain that pay or are
+// sent by address, newest first, skipping the first offset.
+func (bc *Blockchain) AddressHistory(address string, offset, limit int) *AddressHistoryResponse {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	locs := bc.index.addresses[address]
+	start, end, limit := page(len(locs), offset, limit)
+	r := &AddressHistoryResponse{
+		Address:      address,
+		Total:        len(locs),
+		Offset:       start,
+		Limit:        limit,
+		Transactions: make([]*AddressTransactionResponse, 0, end-start),
+	}
+	for i := start; i < end; i++ {
+		loc := locs[len(locs)-1-i]
+		b := bc.chain[loc.height]
+		t := b.transactions[loc.index]
+
+		entry := &AddressTransactionResponse{
+			Hash:          fmt.Sprintf("%x", t.Hash()),
+			BlockHash:     fmt.Sprintf("%x", b.Hash()),
+			BlockHeight:   loc.height,
+			Timestamp:     t.timestamp,
+			Confirmations: bc.tip.height - loc.height + 1,
+		}
+		// The chain only holds transactions whose amounts add up, so the
+		// sums cannot overflow.
+		for _, out := range t.outputs {
+			if out.recipientBlockchainAddress == address {
+				entry.Received += out.value
+			}
+		}
+		if t.senderBlockchainAddress == address {
+			v, _ := t.OutputValue()
+			entry.Sent = v + t.fee
+		}
+		r.Transactions = append(r.Transactions, entry)
+	}
+	return r
+}
+
+// page bounds offset and limit to a listing of total entries and returns
+// the range of entries to serve with the limit applied.
+func page(total, offset, limit int) (start, end, boundedLimit int) {
+	if limit <= 0 {
+		limit = EXPLORER_DEFAULT_LIMIT
+	}
+	if limit > EXPLORER_MAX_LIMIT {
+		limit = EXPLORER_MAX_LIMIT
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end = offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end, limit
+}
@@ -0,0 +1,72 @@
+package block
+
+// txLocation is where a transaction sits on the active chain.
+type txLocation struct {
+	height int
+	index  int
+}
+
+// chainIndex locates the transactions of the active chain by hash and by
+// the addresses they involve, so that lookups need not scan the chain. It
+// follows the active chain through setTip and is guarded by bc.mux.
+type chainIndex struct {
+	transactions map[[32]byte]txLocation
+	// addresses lists, in chain order, the transactions that pay or are
+	// sent by each address.
+	addresses map[string][]txLocation
+}
+
+func newChainIndex() *chainIndex {
+	return &chainIndex{
+		transactions: make(map[[32]byte]txLocation),
+		addresses:    make(map[string][]txLocation),
+	}
+}
+
+// connect indexes b, which became the block at height.
+func (ci *chainIndex) connect(b *Block, height int) {
+	for i, t := range b.transactions {
+		loc := txLocation{height: height, index: i}
+		ci.transactions[t.Hash()] = loc
+		for _, address := range t.addresses() {
+			ci.addresses[address] = append(ci.addresses[address], loc)
+		}
+	}
+}
+
+// disconnect removes b, the block at height, which must be the last block
+// connected.
+func (ci *chainIndex) disconnect(b *Block, height int) {
+	for _, t := range b.transactions {
+		delete(ci.transactions, t.Hash())
+		for _, address := range t.addresses() {
+			locs := ci.addresses[address]
+			for len(locs) > 0 && locs[len(locs)-1].height >= height {
+				locs = locs[:len(locs)-1]
+			}
+			if len(locs) == 0 {
+				delete(ci.addresses, address)
+			} else {
+				ci.addresses[address] = locs
+			}
+		}
+	}
+}
+
+// addresses returns the addresses t involves: its sender, unless t creates
+// coins, and its recipients, each once.
+func (t *Transaction) addresses() []string {
+	var addresses []string
+	seen := make(map[string]bool)
+	if t.senderBlockchainAddress != MINING_SENDER_ADDRESS {
+		seen[t.senderBlockchainAddress] = true
+		addresses = append(addresses, t.senderBlockchainAddress)
+	}
+	for _, out := range t.outputs {
+		if !seen[out.recipientBlockchainAddress] {
+			seen[out.recipientBlockchainAddress] = true
+			addresses = append(addresses, out.recipientBlockchainAddress)
+		}
+	}
+	return addresses
+}
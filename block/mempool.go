@@ -0,0 +1,250 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTxInMempool = errors.New("transaction already in the mempool")
+	ErrTxConflict  = errors.New("transaction spends an output already spent in the mempool")
+	ErrMempoolFull = errors.New("mempool is full and the transaction pays too little to replace anything")
+	ErrTxTooLarge  = errors.New("transaction is larger than the mempool")
+)
+
+type mempoolEntry struct {
+	tx    *Transaction
+	hash  [32]byte
+	size  int
+	added time.Time
+	// seq orders entries by arrival, which is the order the pool is listed
+	// in.
+	seq uint64
+}
+
+// Mempool holds the transactions waiting to be mined. It only checks how
+// its transactions relate to each other; whether they spend outputs that
+// exist on chain is for the caller to check against the UTXO set first.
+type Mempool struct {
+	entries map[[32]byte]*mempoolEntry
+	// spends maps every output spent by a pooled transaction to the
+	// transaction spending it.
+	spends  map[OutPoint][32]byte
+	size    int
+	seq     uint64
+	maxSize int
+	expiry  time.Duration
+	mux     sync.Mutex
+}
+
+// NewMempool returns an empty pool that holds at most maxSize bytes of
+// encoded transactions and drops a transaction expiry after it was added.
+func NewMempool(maxSize int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		entries: make(map[[32]byte]*mempoolEntry),
+		spends:  make(map[OutPoint][32]byte),
+		maxSize: maxSize,
+		expiry:  expiry,
+	}
+}
+
+// Add admits t unless it is already pooled or spends an output another
+// pooled transaction spends. When the pool is full, the transactions paying
+// the lowest fee rate are evicted to make room, provided t pays more than
+// each of them.
+func (mp *Mempool) Add(t *Transaction) error {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	h := t.Hash()
+	if _, ok := mp.entries[h]; ok {
+		return ErrTxInMempool
+	}
+	for _, in := range t.inputs {
+		if other, ok := mp.spends[in.OutPoint()]; ok {
+			return fmt.Errorf("%w: %s is spent by %x", ErrTxConflict, in.OutPoint(), other)
+		}
+	}
+
+	e := &mempoolEntry{tx: t, hash: h, size: t.Size(), added: time.Now()}
+	if e.size > mp.maxSize {
+		return ErrTxTooLarge
+	}
+
+	var evict []*mempoolEntry
+	size := mp.size
+	for size+e.size > mp.maxSize {
+		lowest := mp.lowestFeeRate(evict)
+		if lowest == nil || !higherFeeRate(t, lowest.tx) {
+			return ErrMempoolFull
+		}
+		evict = append(evict, lowest)
+		size -= lowest.size
+	}
+	for _, v := range evict {
+		mp.remove(v.hash)
+	}
+
+	mp.seq++
+	e.seq = mp.seq
+	mp.entries[h] = e
+	for _, in := range t.inputs {
+		mp.spends[in.OutPoint()] = h
+	}
+	mp.size += e.size
+
+	return nil
+}
+
+// lowestFeeRate returns the entry paying the lowest fee rate, leaving out
+// those in skip, or nil if there is none. Among equal rates the newest entry
+// goes first.
+func (mp *Mempool) lowestFeeRate(skip []*mempoolEntry) *mempoolEntry {
+	var lowest *mempoolEntry
+	for _, e := range mp.entries {
+		skipped := false
+		for _, s := range skip {
+			if s == e {
+				skipped = true
+				break
+			}
+		}
+		if skipped {
+			continue
+		}
+		if lowest == nil || higherFeeRate(lowest.tx, e.tx) ||
+			(!higherFeeRate(e.tx, lowest.tx) && e.seq > lowest.seq) {
+			lowest = e
+		}
+	}
+	return lowest
+}
+
+func (mp *Mempool) remove(h [32]byte) {
+	e, ok := mp.entries[h]
+	if !ok {
+		return
+	}
+	for _, in := range e.tx.inputs {
+		delete(mp.spends, in.OutPoint())
+	}
+	delete(mp.entries, h)
+	mp.size -= e.size
+}
+
+// RemoveBlock drops the transactions b includes, along with any pooled
+// transaction that spends an output b spends, which can no longer be mined.
+func (mp *Mempool) RemoveBlock(b *Block) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	for _, t := range b.transactions {
+		mp.remove(t.Hash())
+		for _, in := range t.inputs {
+			if other, ok := mp.spends[in.OutPoint()]; ok {
+				mp.remove(other)
+			}
+		}
+	}
+}
+
+// Expire drops the transactions added before now minus the pool's expiry
+// and returns how many there were.
+func (mp *Mempool) Expire(now time.Time) int {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	n := 0
+	for h, e := range mp.entries {
+		if now.Sub(e.added) >= mp.expiry {
+			mp.remove(h)
+			n++
+		}
+	}
+	return n
+}
+
+// Has reports whether a transaction with ID h is pooled.
+func (mp *Mempool) Has(h [32]byte) bool {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	_, ok := mp.entries[h]
+	return ok
+}
+
+func (mp *Mempool) Get(h [32]byte) (*Transaction, bool) {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	e, ok := mp.entries[h]
+	if !ok {
+		return nil, false
+	}
+	return e.tx, true
+}
+
+// Spends returns the outputs spent by pooled transactions.
+func (mp *Mempool) Spends() map[OutPoint]bool {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	spent := make(map[OutPoint]bool, len(mp.spends))
+	for op := range mp.spends {
+		spent[op] = true
+	}
+	return spent
+}
+
+// Transactions lists the pooled transactions in the order they arrived.
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	return mp.list()
+}
+
+func (mp *Mempool) list() []*Transaction {
+	entries := make([]*mempoolEntry, 0, len(mp.entries))
+	for _, e := range mp.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	transactions := make([]*Transaction, 0, len(entries))
+	for _, e := range entries {
+		transactions = append(transactions, e.tx)
+	}
+	return transactions
+}
+
+// Clear removes every transaction and returns them in the order they
+// arrived.
+func (mp *Mempool) Clear() []*Transaction {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	transactions := mp.list()
+	mp.entries = make(map[[32]byte]*mempoolEntry)
+	mp.spends = make(map[OutPoint][32]byte)
+	mp.size = 0
+	return transactions
+}
+
+func (mp *Mempool) Len() int {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	return len(mp.entries)
+}
+
+// Size is the total encoded size of the pooled transactions in bytes.
+func (mp *Mempool) Size() int {
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	return mp.size
+}
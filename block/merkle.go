@@ -0,0 +1,228 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Interior nodes are hashed with a prefix so that they can never be confused
+// with a transaction hash. A node without a sibling is carried up unchanged
+// rather than paired with itself, which keeps distinct transaction lists from
+// sharing a root.
+const merkleNodePrefix = 0x01
+
+func hashMerkleNode(left, right [32]byte) [32]byte {
+	var buf [1 + 32 + 32]byte
+	buf[0] = merkleNodePrefix
+	copy(buf[1:33], left[:])
+	copy(buf[33:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+func nextMerkleLevel(level [][32]byte) [][32]byte {
+	next := make([][32]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, hashMerkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+func transactionHashes(transactions []*Transaction) [][32]byte {
+	hashes := make([][32]byte, len(transactions))
+	for i, t := range transactions {
+		hashes[i] = t.Hash()
+	}
+	return hashes
+}
+
+// MerkleRoot returns the root of the tree built over transactions. An empty
+// list has the zero hash as its root.
+func MerkleRoot(transactions []*Transaction) [32]byte {
+	level := transactionHashes(transactions)
+	if len(level) == 0 {
+		return [32]byte{}
+	}
+
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+
+	return level[0]
+}
+
+// MerkleStep is one level of an inclusion proof: the sibling hash and which
+// side of the running hash it sits on.
+type MerkleStep struct {
+	hash [32]byte
+	left bool
+}
+
+func (ms *MerkleStep) Hash() [32]byte {
+	return ms.hash
+}
+
+func (ms *MerkleStep) Left() bool {
+	return ms.left
+}
+
+func (ms *MerkleStep) MarshalJSON() ([]byte, error) {
+	position := "right"
+	if ms.left {
+		position = "left"
+	}
+
+	return json.Marshal(struct {
+		Hash     string `json:"hash"`
+		Position string `json:"position"`
+	}{
+		Hash:     fmt.Sprintf("%x", ms.hash),
+		Position: position,
+	})
+}
+
+func (ms *MerkleStep) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Hash     string `json:"hash"`
+		Position string `json:"position"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	h, err := HashStrToHash(v.Hash)
+	if err != nil {
+		return err
+	}
+	ms.hash = h
+
+	switch v.Position {
+	case "left":
+		ms.left = true
+	case "right":
+		ms.left = false
+	default:
+		return fmt.Errorf("invalid merkle step position %q", v.Position)
+	}
+
+	return nil
+}
+
+// MerkleProof shows that a transaction is committed to by the merkle root of
+// a block header, without shipping the rest of the block.
+type MerkleProof struct {
+	blockHash  [32]byte
+	merkleRoot [32]byte
+	txHash     [32]byte
+	path       []*MerkleStep
+}
+
+// NewMerkleProof builds the inclusion proof for txHash in b.
+func NewMerkleProof(b *Block, txHash [32]byte) (*MerkleProof, error) {
+	level := transactionHashes(b.transactions)
+
+	index := -1
+	for i, h := range level {
+		if h == txHash {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, errors.New("transaction not found in block")
+	}
+
+	var path []*MerkleStep
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			path = append(path, &MerkleStep{hash: level[sibling], left: sibling < index})
+		}
+
+		level = nextMerkleLevel(level)
+		index /= 2
+	}
+
+	return &MerkleProof{
+		blockHash:  b.Hash(),
+		merkleRoot: b.MerkleRoot(),
+		txHash:     txHash,
+		path:       path,
+	}, nil
+}
+
+func (mp *MerkleProof) BlockHash() [32]byte {
+	return mp.blockHash
+}
+
+func (mp *MerkleProof) MerkleRoot() [32]byte {
+	return mp.merkleRoot
+}
+
+func (mp *MerkleProof) TxHash() [32]byte {
+	return mp.txHash
+}
+
+func (mp *MerkleProof) Path() []*MerkleStep {
+	return mp.path
+}
+
+// VerifyMerkleProof reports whether proof links its transaction to
+// merkleRoot. Light clients should pass the root from a header they already
+// trust rather than the root carried inside the proof.
+func VerifyMerkleProof(proof *MerkleProof, merkleRoot [32]byte) bool {
+	h := proof.txHash
+	for _, step := range proof.path {
+		if step.left {
+			h = hashMerkleNode(step.hash, h)
+		} else {
+			h = hashMerkleNode(h, step.hash)
+		}
+	}
+	return h == merkleRoot
+}
+
+func (mp *MerkleProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		BlockHash  string        `json:"block_hash"`
+		MerkleRoot string        `json:"merkle_root"`
+		TxHash     string        `json:"tx_hash"`
+		Path       []*MerkleStep `json:"path"`
+	}{
+		BlockHash:  fmt.Sprintf("%x", mp.blockHash),
+		MerkleRoot: fmt.Sprintf("%x", mp.merkleRoot),
+		TxHash:     fmt.Sprintf("%x", mp.txHash),
+		Path:       mp.path,
+	})
+}
+
+func (mp *MerkleProof) UnmarshalJSON(data []byte) error {
+	var v struct {
+		BlockHash  string        `json:"block_hash"`
+		MerkleRoot string        `json:"merkle_root"`
+		TxHash     string        `json:"tx_hash"`
+		Path       []*MerkleStep `json:"path"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var err error
+	if mp.blockHash, err = HashStrToHash(v.BlockHash); err != nil {
+		return err
+	}
+	if mp.merkleRoot, err = HashStrToHash(v.MerkleRoot); err != nil {
+		return err
+	}
+	if mp.txHash, err = HashStrToHash(v.TxHash); err != nil {
+		return err
+	}
+	mp.path = v.Path
+
+	return nil
+}
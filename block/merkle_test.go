@@ -0,0 +1,137 @@
+package block
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testTransactions returns n transactions with distinct hashes.
+func testTransactions(n int) []*Transaction {
+	transactions := make([]*Transaction, n)
+	for i := range transactions {
+		transactions[i] = NewTransaction("sender", []*TxInput{NewTxInput([32]byte{byte(i)}, i)}, []*TxOutput{NewTxOutput("recipient", Amount(i+1))}, 0)
+	}
+	return transactions
+}
+
+func TestMerkleRoot(t *testing.T) {
+	txs := testTransactions(4)
+	a, b, c := txs[0].Hash(), txs[1].Hash(), txs[2].Hash()
+
+	tests := []struct {
+		name         string
+		transactions []*Transaction
+		want         [32]byte
+	}{
+		{"empty", nil, [32]byte{}},
+		{"one", txs[:1], a},
+		{"two", txs[:2], hashMerkleNode(a, b)},
+		{"odd one carried up", txs[:3], hashMerkleNode(hashMerkleNode(a, b), c)},
+		{"four", txs, hashMerkleNode(hashMerkleNode(a, b), hashMerkleNode(c, txs[3].Hash()))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MerkleRoot(tt.transactions); got != tt.want {
+				t.Errorf("MerkleRoot = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMerkleRootDuplicateLast checks that repeating the last transaction,
+// which pairing an odd node with itself would hide, changes the root.
+func TestMerkleRootDuplicateLast(t *testing.T) {
+	txs := testTransactions(3)
+	if MerkleRoot(txs) == MerkleRoot(append(txs, txs[2])) {
+		t.Fatal("duplicating the last transaction kept the root")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		txs := testTransactions(n)
+		b := NewBlock(1, [32]byte{}, 0, txs)
+		for i, tx := range txs {
+			proof, err := NewMerkleProof(b, tx.Hash())
+			if err != nil {
+				t.Fatalf("%d transactions, proof of %d: %v", n, i, err)
+			}
+			if proof.MerkleRoot() != b.MerkleRoot() || proof.BlockHash() != b.Hash() {
+				t.Fatalf("%d transactions, proof of %d names another block", n, i)
+			}
+			if !VerifyMerkleProof(proof, b.MerkleRoot()) {
+				t.Fatalf("%d transactions, proof of %d does not verify", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+	txs := testTransactions(5)
+	b := NewBlock(1, [32]byte{}, 0, txs)
+	other := testTransactions(6)[5]
+
+	tests := []struct {
+		name   string
+		tamper func(proof *MerkleProof) [32]byte
+	}{
+		{"other root", func(proof *MerkleProof) [32]byte { return MerkleRoot(txs[:4]) }},
+		{"other transaction", func(proof *MerkleProof) [32]byte {
+			proof.txHash = other.Hash()
+			return b.MerkleRoot()
+		}},
+		{"altered sibling", func(proof *MerkleProof) [32]byte {
+			proof.path[0].hash[0] ^= 0xff
+			return b.MerkleRoot()
+		}},
+		{"flipped side", func(proof *MerkleProof) [32]byte {
+			proof.path[0].left = !proof.path[0].left
+			return b.MerkleRoot()
+		}},
+		{"missing step", func(proof *MerkleProof) [32]byte {
+			proof.path = proof.path[1:]
+			return b.MerkleRoot()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := NewMerkleProof(b, txs[1].Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root := tt.tamper(proof); VerifyMerkleProof(proof, root) {
+				t.Fatal("tampered proof verified")
+			}
+		})
+	}
+}
+
+func TestMerkleProofNotInBlock(t *testing.T) {
+	b := NewBlock(1, [32]byte{}, 0, testTransactions(3))
+	if _, err := NewMerkleProof(b, testTransactions(4)[3].Hash()); err == nil {
+		t.Fatal("built a proof for a transaction the block does not have")
+	}
+}
+
+func TestMerkleProofJSON(t *testing.T) {
+	b := NewBlock(1, [32]byte{}, 0, testTransactions(5))
+	proof, err := NewMerkleProof(b, b.Transactions()[4].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got MerkleProof
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, proof) {
+		t.Fatalf("round trip gave %s", data)
+	}
+	if !VerifyMerkleProof(&got, b.MerkleRoot()) {
+		t.Fatal("decoded proof does not verify")
+	}
+}
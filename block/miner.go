@@ -0,0 +1,384 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goblockchain/blockchain_crypto"
+	"log"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MINING_BATCH_NONCES is how many nonces a proof of work worker tries
+// between checking whether to stop and adding to the hash count.
+const MINING_BATCH_NONCES = 1 << 12
+
+// miningNonceRange is the number of nonces each worker of SolveBlock owns,
+// so that no two workers ever hash the same header.
+const miningNonceRange = 1 << 32
+
+// hashMeter counts the hashes of the proof of work and the rate of the last
+// search. It has its own lock since searches run without bc.mux.
+type hashMeter struct {
+	mux    sync.Mutex
+	hashes uint64
+	rate   float64
+}
+
+func (m *hashMeter) record(hashes uint64, elapsed time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.hashes += hashes
+	if elapsed > 0 {
+		m.rate = float64(hashes) / elapsed.Seconds()
+	}
+}
+
+// HashRate returns the hashes per second of the last proof of work.
+func (bc *Blockchain) HashRate() float64 {
+	bc.hashMeter.mux.Lock()
+	defer bc.hashMeter.mux.Unlock()
+	return bc.hashMeter.rate
+}
+
+// Hashes returns the number of hashes computed by every proof of work so far.
+func (bc *Blockchain) Hashes() uint64 {
+	bc.hashMeter.mux.Lock()
+	defer bc.hashMeter.mux.Unlock()
+	return bc.hashMeter.hashes
+}
+
+// withTip returns a context derived from parent that is also canceled once
+// the tip is no longer prevHash.
+func (bc *Blockchain) withTip(parent context.Context, prevHash [32]byte) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	bc.mux.Lock()
+	changed := bc.tipChanged
+	moved := bc.tip.hash != prevHash
+	bc.mux.Unlock()
+
+	if moved {
+		cancel()
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// ProofOfWork solves b with the node's mining workers, see SolveBlock, and
+// records the hash rate.
+func (bc *Blockchain) ProofOfWork(ctx context.Context, b *Block) error {
+	start := time.Now()
+	hashes, err := SolveBlock(ctx, b, bc.miningWorkers)
+	bc.hashMeter.record(hashes, time.Since(start))
+	return err
+}
+
+// SolveBlock searches for a nonce that makes b's header hash meet its
+// target with SearchHeader, giving each of the workers goroutines
+// miningNonceRange nonces, and leaves it set on b. If ctx is done before a
+// nonce is found, b is left as it was and ctx's error is returned. Either
+// way SolveBlock returns the number of hashes it tried.
+func SolveBlock(ctx context.Context, b *Block, workers int) (uint64, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mux sync.Mutex
+	var solved bool
+	var nonce uint64
+	var timestamp int64
+	hashes, err := SearchHeader(ctx, b.header.Encode(), CompactToBig(b.header.bits), 0, uint64(workers)*miningNonceRange, workers,
+		func(n uint64, ts int64) bool {
+			mux.Lock()
+			defer mux.Unlock()
+			if !solved {
+				solved, nonce, timestamp = true, n, ts
+			}
+			return false
+		})
+	if err != nil {
+		return hashes, err
+	}
+	if !solved {
+		return hashes, ctx.Err()
+	}
+
+	b.header.nonce = int(nonce)
+	b.header.timestamp = timestamp
+	return hashes, nil
+}
+
+// SearchHeader hashes header, an encoded block header, with the nonces from
+// base to base+size-1 split evenly across workers goroutines, each of which
+// hashes its own copy with only the nonce changing, and calls found with
+// the nonce and timestamp of every hash that does not exceed target. A
+// worker that runs out of nonces moves the timestamp forward, which serves
+// as the extra nonce, and starts over. The search ends when found returns
+// false or ctx is done; found may be called by several workers at once.
+// SearchHeader returns the number of hashes it tried.
+func SearchHeader(ctx context.Context, header []byte, target *big.Int, base, size uint64, workers int,
+	found func(nonce uint64, timestamp int64) bool) (uint64, error) {
+	if target.Sign() <= 0 || target.BitLen() > 256 {
+		return 0, errors.New("target is out of range")
+	}
+	if len(header) != headerNonceOffset+8 {
+		return 0, fmt.Errorf("%w: header of %d bytes", ErrEncoding, len(header))
+	}
+	if workers < 1 || size/uint64(workers) == 0 {
+		return 0, errors.New("nonce range is too small for the workers")
+	}
+	var t [32]byte
+	target.FillBytes(t[:])
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashes atomic.Uint64
+	var wg sync.WaitGroup
+	share := size / uint64(workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(base uint64) {
+			defer wg.Done()
+			searchNonces(ctx, header, &t, base, share, &hashes, func(nonce uint64, timestamp int64) bool {
+				if !found(nonce, timestamp) {
+					cancel()
+					return false
+				}
+				return true
+			})
+		}(base + uint64(i)*share)
+	}
+	wg.Wait()
+
+	return hashes.Load(), nil
+}
+
+// searchNonces is a single worker of SearchHeader, trying the size nonces
+// from base.
+func searchNonces(ctx context.Context, header []byte, target *[32]byte, base, size uint64, hashes *atomic.Uint64,
+	found func(nonce uint64, timestamp int64) bool) {
+	buf := append([]byte(nil), header...)
+	timestamp := int64(binary.BigEndian.Uint64(buf[headerTimestampOffset:]))
+
+	var n uint64
+	for {
+		for i := 0; i < MINING_BATCH_NONCES; i++ {
+			binary.BigEndian.PutUint64(buf[headerNonceOffset:], base+n)
+			h := sha256.Sum256(buf)
+			if bytes.Compare(h[:], target[:]) <= 0 && !found(base+n, timestamp) {
+				hashes.Add(uint64(i + 1))
+				return
+			}
+
+			n++
+			if n == size {
+				n = 0
+				if now := time.Now().UnixNano(); now > timestamp {
+					timestamp = now
+				} else {
+					timestamp++
+				}
+				binary.BigEndian.PutUint64(buf[headerTimestampOffset:], uint64(timestamp))
+			}
+		}
+		hashes.Add(MINING_BATCH_NONCES)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Solved returns a copy of b with the nonce and timestamp of a solution
+// that SearchHeader found for its header.
+func (b *Block) Solved(nonce uint64, timestamp int64) *Block {
+	s := *b
+	s.header.nonce = int(nonce)
+	s.header.timestamp = timestamp
+	return &s
+}
+
+// ErrMinerAddress rejects a reward address that is malformed or belongs to
+// another network.
+var ErrMinerAddress = errors.New("invalid miner address")
+
+// CheckAddress requires address to be an address of the chain's network,
+// as block rewards must be paid to.
+func (bc *Blockchain) CheckAddress(address string) error {
+	if v, err := blockchain_crypto.AddressVersion(address); err != nil || v != bc.params.AddressVersion {
+		return fmt.Errorf("%w: %q", ErrMinerAddress, address)
+	}
+	return nil
+}
+
+// Miner runs the mining loop of a node: it mines a block, waits for the
+// mining interval and starts over. However often Start is called, at most
+// one loop runs, and Stop interrupts the proof of work in progress.
+type Miner struct {
+	bc       *Blockchain
+	interval time.Duration
+
+	// control serializes Start and Stop, so that a loop has exited before
+	// another can start.
+	control sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mux           sync.Mutex
+	address       string
+	blocksFound   int
+	lastBlockTime time.Time
+}
+
+// NewMiner returns a stopped miner that pays the node's own address, which
+// must be an address of the chain's network.
+func NewMiner(bc *Blockchain, interval time.Duration) (*Miner, error) {
+	if err := bc.CheckAddress(bc.BlockchainAddress()); err != nil {
+		return nil, err
+	}
+	return &Miner{
+		bc:       bc,
+		interval: interval,
+		address:  bc.BlockchainAddress(),
+	}, nil
+}
+
+// Start starts the mining loop, or reports false if it is already running.
+func (m *Miner) Start() bool {
+	m.control.Lock()
+	defer m.control.Unlock()
+
+	if m.cancel != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go m.run(ctx, m.done)
+
+	log.Printf("action=MinerStart, address=%s", m.Address())
+	return true
+}
+
+// Stop stops the mining loop and waits for it to exit, or reports false if
+// it is not running.
+func (m *Miner) Stop() bool {
+	m.control.Lock()
+	defer m.control.Unlock()
+
+	if m.cancel == nil {
+		return false
+	}
+	m.cancel()
+	<-m.done
+	m.cancel = nil
+	m.done = nil
+
+	log.Println("action=MinerStop")
+	return true
+}
+
+// Running reports whether the mining loop is running.
+func (m *Miner) Running() bool {
+	m.control.Lock()
+	defer m.control.Unlock()
+	return m.cancel != nil
+}
+
+func (m *Miner) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		m.Mine(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+// Mine mines a single block paying the miner's address, whether or not the
+// loop is running, and reports whether it was accepted.
+func (m *Miner) Mine(ctx context.Context) bool {
+	if _, err := m.bc.MineBlock(ctx, m.Address()); err != nil {
+		return false
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.blocksFound++
+	m.lastBlockTime = time.Now()
+	return true
+}
+
+func (m *Miner) Address() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.address
+}
+
+// SetAddress changes the address the following blocks pay. It must be an
+// address of the chain's network.
+func (m *Miner) SetAddress(address string) error {
+	if err := m.bc.CheckAddress(address); err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.address = address
+	log.Printf("action=MinerAddress, address=%s", address)
+	return nil
+}
+
+// Status reports the state of the miner.
+func (m *Miner) Status() *MinerStatusResponse {
+	s := &MinerStatusResponse{
+		Running:     m.Running(),
+		Workers:     m.bc.miningWorkers,
+		IntervalSec: m.interval.Seconds(),
+		HashRate:    m.bc.HashRate(),
+		Hashes:      m.bc.Hashes(),
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s.Address = m.address
+	s.BlocksFound = m.blocksFound
+	if !m.lastBlockTime.IsZero() {
+		s.LastBlockTime = m.lastBlockTime.UnixNano()
+	}
+	return s
+}
+
+// MinerStatusResponse is the state of a Miner. HashRate is in hashes per
+// second over the last proof of work, and LastBlockTime in Unix nanoseconds
+// like block timestamps, or zero before the first block.
+type MinerStatusResponse struct {
+	Running       bool    `json:"running"`
+	Address       string  `json:"address"`
+	Workers       int     `json:"workers"`
+	IntervalSec   float64 `json:"interval_sec"`
+	HashRate      float64 `json:"hash_rate"`
+	Hashes        uint64  `json:"hashes"`
+	BlocksFound   int     `json:"blocks_found"`
+	LastBlockTime int64   `json:"last_block_time,omitempty"`
+}
@@ -0,0 +1,358 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"goblockchain/p2p"
+	"log"
+	"time"
+)
+
+// SetNode makes bc announce its blocks and transactions through n. n
+// should be created with bc as its handler.
+func (bc *Blockchain) SetNode(n *p2p.Node) {
+	bc.node = n
+}
+
+func (bc *Blockchain) Node() *p2p.Node {
+	return bc.node
+}
+
+func (bc *Blockchain) ChainTip() ([32]byte, uint64) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	return bc.tip.hash, uint64(bc.tip.height)
+}
+
+func (bc *Blockchain) GenesisHash() [32]byte {
+	return bc.genesisHash
+}
+
+// PeerConnected adds p to the block download, and asks it for headers if
+// it announced a tip we do not know.
+func (bc *Blockchain) PeerConnected(p *p2p.Peer) {
+	bc.mux.Lock()
+	sp := &syncPeer{peer: p, inFlight: make(map[[32]byte]time.Time)}
+	if n, ok := bc.tree.lookup(p.Version().TipHash); ok {
+		sp.best = n
+	}
+	bc.syncPeers[p.ID()] = sp
+	bc.requestMissingBlocks()
+	bc.mux.Unlock()
+
+	if sp.best == nil {
+		bc.requestHeaders(p)
+	}
+}
+
+// PeerDisconnected hands the blocks in flight from p to other peers.
+func (bc *Blockchain) PeerDisconnected(p *p2p.Peer) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	sp, ok := bc.syncPeers[p.ID()]
+	if !ok || sp.peer != p {
+		return
+	}
+	for hash := range sp.inFlight {
+		delete(bc.inFlight, hash)
+	}
+	delete(bc.syncPeers, p.ID())
+	bc.requestMissingBlocks()
+}
+
+// HasBlock reports whether the block with hash, not just its header, is in
+// the block tree.
+func (bc *Blockchain) HasBlock(hash [32]byte) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	n, ok := bc.tree.lookup(hash)
+	return ok && n.hasData
+}
+
+// requestHeaders asks p for the headers that follow the branch with the most
+// work we know of.
+func (bc *Blockchain) requestHeaders(p *p2p.Peer) {
+	bc.mux.Lock()
+	locator := bc.tree.bestHeader().locator()
+	bc.mux.Unlock()
+
+	sendGetHeaders(p, locator)
+}
+
+func sendGetHeaders(p *p2p.Peer, locator [][32]byte) {
+	p.Send(p2p.NewMessage(p2p.MsgGetHeaders, (&p2p.GetHeadersMessage{Locator: locator}).Encode()))
+}
+
+func (bc *Blockchain) HandleMessage(p *p2p.Peer, msg *p2p.Message) {
+	var err error
+	switch msg.Type {
+	case p2p.MsgInv:
+		err = bc.handleInv(p, msg)
+	case p2p.MsgGetData:
+		err = bc.handleGetData(p, msg)
+	case p2p.MsgGetHeaders:
+		err = bc.handleGetHeaders(p, msg)
+	case p2p.MsgHeaders:
+		err = bc.handleHeaders(p, msg)
+	case p2p.MsgBlock:
+		err = bc.handleBlock(p, msg)
+	case p2p.MsgTx:
+		err = bc.handleTx(p, msg)
+	default:
+		err = fmt.Errorf("%w: unexpected %s message", errProtocol, msg.Type)
+	}
+	if err != nil {
+		log.Printf("Error: %s from peer %s: %v\n", msg.Type, p, err)
+		if score := misbehaviorScore(err); score > 0 {
+			p.Misbehaving(score, err.Error())
+		}
+	}
+}
+
+var errProtocol = errors.New("protocol violation")
+
+// misbehaviorScore is how much err counts against the peer that caused it.
+// Errors that an honest peer can cause, such as a block we already have or
+// a transaction that lost a race for its inputs, do not count.
+func misbehaviorScore(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidBlock), errors.Is(err, ErrInvalidChain), errors.Is(err, p2p.ErrGenesisMismatch):
+		return p2p.MISBEHAVIOR_INVALID_BLOCK
+	case errors.Is(err, p2p.ErrMalformedMessage), errors.Is(err, ErrEncoding):
+		return p2p.MISBEHAVIOR_MALFORMED
+	case errors.Is(err, errProtocol):
+		return p2p.MISBEHAVIOR_PROTOCOL
+	case errors.Is(err, ErrInvalidTransaction):
+		return p2p.MISBEHAVIOR_INVALID_TX
+	default:
+		return 0
+	}
+}
+
+// handleInv asks for every announced transaction we do not have yet. An
+// unknown block is asked for by its header first, like any other.
+func (bc *Blockchain) handleInv(p *p2p.Peer, msg *p2p.Message) error {
+	inv, err := p2p.DecodeInvMessage(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	var want []p2p.InvItem
+	unknownBlock := false
+	for _, item := range inv.Items {
+		switch item.Type {
+		case p2p.InvBlock:
+			if !bc.hasHeader(item.Hash) {
+				unknownBlock = true
+			}
+		case p2p.InvTx:
+			if !bc.mempool.Has(item.Hash) && !bc.hasTransaction(item.Hash) {
+				want = append(want, item)
+			}
+		}
+	}
+
+	if len(want) > 0 {
+		p.Send(p2p.NewMessage(p2p.MsgGetData, (&p2p.InvMessage{Items: want}).Encode()))
+	}
+	if unknownBlock {
+		bc.requestHeaders(p)
+	}
+	return nil
+}
+
+func (bc *Blockchain) hasHeader(hash [32]byte) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	_, ok := bc.tree.lookup(hash)
+	return ok
+}
+
+func (bc *Blockchain) hasTransaction(hash [32]byte) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	return bc.utxos.HasTransaction(hash)
+}
+
+// handleGetData sends the requested blocks we have, from any branch, and the
+// requested transactions that are in the mempool.
+func (bc *Blockchain) handleGetData(p *p2p.Peer, msg *p2p.Message) error {
+	req, err := p2p.DecodeInvMessage(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range req.Items {
+		switch item.Type {
+		case p2p.InvBlock:
+			bc.mux.Lock()
+			n, ok := bc.tree.lookup(item.Hash)
+			ok = ok && n.hasData
+			bc.mux.Unlock()
+			if ok {
+				p.Send(p2p.NewMessage(p2p.MsgBlock, n.block.Encode()))
+			}
+		case p2p.InvTx:
+			if t, ok := bc.mempool.Get(item.Hash); ok {
+				p.Send(p2p.NewMessage(p2p.MsgTx, t.Encode()))
+			}
+		}
+	}
+	return nil
+}
+
+// handleGetHeaders replies with the headers of the active chain's blocks
+// after the first locator hash that is on it.
+func (bc *Blockchain) handleGetHeaders(p *p2p.Peer, msg *p2p.Message) error {
+	req, err := p2p.DecodeGetHeadersMessage(msg.Payload)
+	if err != nil {
+		return err
+	}
+	// Every locator ends with the genesis block of the chain it describes.
+	if len(req.Locator) > 0 && req.Locator[len(req.Locator)-1] != bc.genesisHash {
+		return fmt.Errorf("%w: locator ends at %x", p2p.ErrGenesisMismatch, req.Locator[len(req.Locator)-1])
+	}
+
+	bc.mux.Lock()
+	start := 0
+	for _, h := range req.Locator {
+		if n, ok := bc.tree.lookup(h); ok && n.height < len(bc.chain) && bc.chain[n.height] == n.block {
+			start = n.height
+			break
+		}
+	}
+	var headers [][]byte
+	for _, b := range bc.chain[start+1:] {
+		headers = append(headers, b.Header().Encode())
+		if b.Hash() == req.Stop || len(headers) == p2p.MAX_HEADERS_PER_MESSAGE {
+			break
+		}
+	}
+	bc.mux.Unlock()
+
+	if len(headers) > 0 {
+		p.Send(p2p.NewMessage(p2p.MsgHeaders, (&p2p.HeadersMessage{Headers: headers}).Encode()))
+	}
+	return nil
+}
+
+// handleHeaders adds the headers that pass the header checks to the block
+// tree and requests the blocks the best branch now lacks. A full batch means
+// the peer has more, so the next batch is asked for right away.
+func (bc *Blockchain) handleHeaders(p *p2p.Peer, msg *p2p.Message) error {
+	m, err := p2p.DecodeHeadersMessage(msg.Payload)
+	if err != nil {
+		return err
+	}
+	headers := make([]*BlockHeader, 0, len(m.Headers))
+	for _, data := range m.Headers {
+		h, err := DecodeBlockHeader(data)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, h)
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	var last *blockNode
+	for _, h := range headers {
+		err := bc.processHeader(h)
+		switch {
+		case errors.Is(err, ErrOrphanBlock):
+			// The peer announced a block on a branch we have not seen the
+			// start of; ask for it from where our headers end.
+			sendGetHeaders(p, bc.tree.bestHeader().locator())
+			return nil
+		case err != nil && !errors.Is(err, ErrBlockKnown):
+			return fmt.Errorf("header %x: %w", h.Hash(), err)
+		}
+		last, _ = bc.tree.lookup(h.Hash())
+	}
+
+	bc.peerHasHeader(p, last)
+	if len(headers) == p2p.MAX_HEADERS_PER_MESSAGE {
+		sendGetHeaders(p, last.locator())
+	}
+	bc.requestMissingBlocks()
+	return nil
+}
+
+// handleBlock processes a block, usually one requested by the block
+// download, and announces the tip to the other peers if it moved.
+func (bc *Blockchain) handleBlock(p *p2p.Peer, msg *p2p.Message) error {
+	b, err := DecodeBlock(msg.Payload)
+	if err != nil {
+		return err
+	}
+	hash := b.Hash()
+
+	bc.mux.Lock()
+	oldTip := bc.tip
+	err = bc.processBlock(b)
+	if n, ok := bc.tree.lookup(hash); ok {
+		bc.peerHasHeader(p, n)
+	}
+	bc.blockReceived(hash)
+	bc.requestMissingBlocks()
+	newTip := bc.tip
+	bc.mux.Unlock()
+
+	switch {
+	case errors.Is(err, ErrBlockKnown):
+		return nil
+	case errors.Is(err, ErrOrphanBlock):
+		bc.requestHeaders(p)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if newTip != oldTip {
+		bc.announceBlock(newTip.block.Header(), p)
+	}
+	return nil
+}
+
+func (bc *Blockchain) handleTx(p *p2p.Peer, msg *p2p.Message) error {
+	t, err := DecodeTransaction(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	if err := bc.addTransaction(t, t.SenderPublicKey(), t.Signature()); err != nil {
+		if errors.Is(err, ErrInvalidTransaction) {
+			return err
+		}
+		return nil
+	}
+	bc.announceTransaction(t.Hash(), p)
+	return nil
+}
+
+// announceBlock sends the header of a new tip to every peer but except,
+// which then request the block if they want it.
+func (bc *Blockchain) announceBlock(h *BlockHeader, except *p2p.Peer) {
+	if bc.node == nil {
+		return
+	}
+	m := &p2p.HeadersMessage{Headers: [][]byte{h.Encode()}}
+	bc.node.Broadcast(p2p.NewMessage(p2p.MsgHeaders, m.Encode()), except)
+}
+
+func (bc *Blockchain) announceTransaction(hash [32]byte, except *p2p.Peer) {
+	if bc.node == nil {
+		return
+	}
+	inv := &p2p.InvMessage{Items: []p2p.InvItem{{Type: p2p.InvTx, Hash: hash}}}
+	bc.node.Broadcast(p2p.NewMessage(p2p.MsgInv, inv.Encode()), except)
+}
@@ -0,0 +1,254 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlockStore persists the blocks of a Blockchain so that a node keeps its
+// history across restarts. Blocks on side branches are stored as well, so
+// the store is a log of every block the node accepted rather than a copy of
+// the active chain.
+type BlockStore interface {
+	// Load returns every stored block in the order it was appended, which
+	// places each block after its parent.
+	Load() ([]*Block, error)
+	// Append durably adds b to the store.
+	Append(b *Block) error
+	Close() error
+}
+
+// MemoryStore is a BlockStore that keeps blocks in memory only. It is meant
+// for tests and throwaway nodes.
+type MemoryStore struct {
+	blocks []*Block
+	mux    sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return new(MemoryStore)
+}
+
+func (ms *MemoryStore) Load() ([]*Block, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	return append([]*Block{}, ms.blocks...), nil
+}
+
+func (ms *MemoryStore) Append(b *Block) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	ms.blocks = append(ms.blocks, b)
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// A record in a FileStore is laid out as
+//
+//	length   uint32 big endian, size of payload
+//	checksum uint32 big endian, CRC-32 (IEEE) of payload
+//	payload  Block in its canonical encoding
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 32 << 20
+)
+
+// FileStore is an append-only BlockStore backed by a single file. Every
+// append is fsynced before it returns, and a torn record left behind by a
+// crash at the end of the file is cut off on the next Load. A corrupt record
+// anywhere else fails the Load instead, since cutting it off would discard
+// the valid blocks after it.
+type FileStore struct {
+	path string
+	file *os.File
+	mux  sync.Mutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path, file: f}, nil
+}
+
+func (fs *FileStore) Path() string {
+	return fs.path
+}
+
+func (fs *FileStore) Load() ([]*Block, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	info, err := fs.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var chain []*Block
+	var offset int64
+	r := bufio.NewReader(fs.file)
+
+	for {
+		payload, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, errTornRecord) {
+				return nil, fmt.Errorf("%s: %w at offset %d", fs.path, err, offset)
+			}
+			log.Printf("Error: %s: %v at offset %d, truncating", fs.path, err, offset)
+			if err := fs.truncate(offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		b, err := DecodeBlock(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%s: decode block at offset %d: %w", fs.path, offset, err)
+		}
+		chain = append(chain, b)
+		offset += recordHeaderSize + int64(len(payload))
+	}
+
+	return chain, nil
+}
+
+func (fs *FileStore) Append(b *Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	record, err := encodeRecord(b)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.file.Write(record); err != nil {
+		return err
+	}
+
+	return fs.file.Sync()
+}
+
+func (fs *FileStore) Close() error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	return fs.file.Close()
+}
+
+func (fs *FileStore) truncate(offset int64) error {
+	if err := fs.file.Truncate(offset); err != nil {
+		return err
+	}
+
+	return fs.file.Sync()
+}
+
+func encodeRecord(b *Block) ([]byte, error) {
+	payload := b.Encode()
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	return record, nil
+}
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	// errTornRecord is a bad record that is the last in the file, which
+	// is what an append interrupted by a crash leaves behind.
+	errTornRecord = errors.New("torn record")
+)
+
+// readRecord reads the record at the start of r, which has remaining bytes
+// left in the file. Only a record that is the last in the file, running to
+// or past its end, is reported as torn. A length field damaged to point past
+// the end also runs past it, so the rest of the file is searched for a
+// record that follows.
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: short header (%d bytes)", errTornRecord, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("%w: record length %d", errCorruptRecord, length)
+	}
+	end := recordHeaderSize + int64(length)
+	if end > remaining {
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if holdsRecord(rest) {
+			return nil, fmt.Errorf("%w: record length %d runs over the records after it", errCorruptRecord, length)
+		}
+		return nil, fmt.Errorf("%w: record of %d bytes with %d left in the file", errTornRecord, end, remaining)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		if end == remaining {
+			return nil, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+		}
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+
+	return payload, nil
+}
+
+// holdsRecord reports whether a whole record holding a block starts
+// anywhere in data.
+func holdsRecord(data []byte) bool {
+	for i := 0; i+recordHeaderSize < len(data); i++ {
+		length := binary.BigEndian.Uint32(data[i : i+4])
+		if length == 0 || int64(length) > int64(len(data)-i-recordHeaderSize) {
+			continue
+		}
+		payload := data[i+recordHeaderSize : i+recordHeaderSize+int(length)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[i+4:i+8]) {
+			continue
+		}
+		if _, err := DecodeBlock(payload); err == nil {
+			return true
+		}
+	}
+	return false
+}
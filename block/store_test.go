@@ -0,0 +1,161 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"goblockchain/chaincfg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBlocks returns a chain of n blocks starting from the regtest genesis
+// block, each paying a coinbase.
+func testBlocks(n int) []*Block {
+	params := &chaincfg.RegTestParams
+	blocks := []*Block{GenesisBlock(params)}
+	for i := 1; i < n; i++ {
+		coinbase := NewTransaction(MINING_SENDER_ADDRESS, nil, []*TxOutput{NewTxOutput("miner", COIN)}, 0)
+		blocks = append(blocks, NewBlock(i, blocks[i-1].Hash(), params.PowLimitBits, []*Transaction{coinbase}))
+	}
+	return blocks
+}
+
+// writeStore appends blocks to a new FileStore and returns its path and
+// the offset each record starts at.
+func writeStore(t *testing.T, blocks []*Block) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	var offsets []int64
+	var offset int64
+	for _, b := range blocks {
+		offsets = append(offsets, offset)
+		if err := fs.Append(b); err != nil {
+			t.Fatal(err)
+		}
+		offset += recordHeaderSize + int64(len(b.Encode()))
+	}
+	return path, offsets
+}
+
+func loadStore(t *testing.T, path string) ([]*Block, error) {
+	t.Helper()
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	return fs.Load()
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// damage applies f to the contents of the file at path.
+func damage(t *testing.T, path string, f func(data []byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, f(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreLoad(t *testing.T) {
+	blocks := testBlocks(4)
+	path, _ := writeStore(t, blocks)
+
+	loaded, err := loadStore(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(blocks) {
+		t.Fatalf("loaded %d blocks, want %d", len(loaded), len(blocks))
+	}
+	for i := range blocks {
+		if loaded[i].Hash() != blocks[i].Hash() {
+			t.Errorf("block %d: hash %x, want %x", i, loaded[i].Hash(), blocks[i].Hash())
+		}
+	}
+}
+
+func TestFileStoreTornRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte, last int64) []byte
+	}{
+		{"short header", func(data []byte, last int64) []byte { return data[:last+3] }},
+		{"short payload", func(data []byte, last int64) []byte { return data[:len(data)-5] }},
+		{"checksum mismatch", func(data []byte, last int64) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := testBlocks(4)
+			path, offsets := writeStore(t, blocks)
+			last := offsets[len(offsets)-1]
+			damage(t, path, func(data []byte) []byte { return tt.damage(data, last) })
+
+			loaded, err := loadStore(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != len(blocks)-1 {
+				t.Errorf("loaded %d blocks, want %d", len(loaded), len(blocks)-1)
+			}
+			if size := fileSize(t, path); size != last {
+				t.Errorf("file size %d, want the torn record cut off at %d", size, last)
+			}
+		})
+	}
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte, offset int64)
+	}{
+		{"checksum mismatch", func(data []byte, offset int64) {
+			data[offset+recordHeaderSize+10] ^= 0xff
+		}},
+		{"length past the end", func(data []byte, offset int64) {
+			binary.BigEndian.PutUint32(data[offset:], uint32(len(data)))
+		}},
+		{"length over the limit", func(data []byte, offset int64) {
+			binary.BigEndian.PutUint32(data[offset:], maxRecordSize+1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := writeStore(t, testBlocks(4))
+			size := fileSize(t, path)
+			damage(t, path, func(data []byte) []byte {
+				tt.damage(data, offsets[1])
+				return data
+			})
+
+			if _, err := loadStore(t, path); !errors.Is(err, errCorruptRecord) {
+				t.Fatalf("Load error %v, want %v", err, errCorruptRecord)
+			}
+			if got := fileSize(t, path); got != size {
+				t.Errorf("file size %d, want it left at %d", got, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package block
+
+import "goblockchain/chaincfg"
+
+// CalcBlockSubsidy is what the coinbase of the block at height may pay on
+// top of the fees under params: InitialSubsidy halved once for every
+// HalvingInterval blocks before it, cut short where it would take the
+// supply past MaxSupply. The genesis block has no subsidy.
+func CalcBlockSubsidy(params *chaincfg.Params, height int) Amount {
+	if height <= 0 {
+		return 0
+	}
+	return CalcSupply(params, height) - CalcSupply(params, height-1)
+}
+
+// CalcSupply is the number of coins in existence once the block at height
+// is mined: the genesis allocations plus every subsidy up to it. Fees only
+// move coins and do not count.
+func CalcSupply(params *chaincfg.Params, height int) Amount {
+	var supply int64
+	for _, a := range params.GenesisAllocations {
+		supply += a.Amount
+	}
+	limit := params.MaxSupply
+	if limit > 0 && supply >= limit {
+		return Amount(supply)
+	}
+
+	// Sum the subsidies era by era, an era being the HalvingInterval
+	// blocks that share a subsidy.
+	for era := 0; era < 63 && height > 0; era++ {
+		subsidy := params.InitialSubsidy >> era
+		if subsidy == 0 {
+			break
+		}
+		first := era * params.HalvingInterval
+		if first < 1 {
+			first = 1
+		}
+		last := (era+1)*params.HalvingInterval - 1
+		if last > height {
+			last = height
+		}
+		if last < first {
+			break
+		}
+		supply += subsidy * int64(last-first+1)
+		if limit > 0 && supply >= limit {
+			return Amount(limit)
+		}
+	}
+	return Amount(supply)
+}
+
+// NextHalvingHeight is the height of the first block after height whose
+// subsidy is halved.
+func NextHalvingHeight(params *chaincfg.Params, height int) int {
+	return (height/params.HalvingInterval + 1) * params.HalvingInterval
+}
+
+// Supply reports the supply at the tip of the active chain.
+func (bc *Blockchain) Supply() *SupplyResponse {
+	bc.mux.Lock()
+	height := bc.tip.height
+	bc.mux.Unlock()
+
+	return &SupplyResponse{
+		Height:            height,
+		Supply:            CalcSupply(bc.params, height),
+		MaxSupply:         Amount(bc.params.MaxSupply),
+		NextBlockSubsidy:  CalcBlockSubsidy(bc.params, height+1),
+		NextHalvingHeight: NextHalvingHeight(bc.params, height),
+	}
+}
@@ -0,0 +1,124 @@
+package block
+
+import (
+	"goblockchain/p2p"
+	"log"
+	"time"
+)
+
+const (
+	// MAX_BLOCKS_IN_FLIGHT caps the blocks requested from one peer at a
+	// time, which spreads a download across every peer that has the blocks.
+	MAX_BLOCKS_IN_FLIGHT = 16
+	// BLOCK_DOWNLOAD_WINDOW caps how far past the fork with the active chain
+	// blocks are requested, so that the next blocks to connect go first.
+	BLOCK_DOWNLOAD_WINDOW      = 1024
+	BLOCK_DOWNLOAD_TIMEOUT_SEC = 30
+	BLOCK_DOWNLOAD_TIMER_SEC   = 5
+)
+
+// syncPeer is what the block download knows about a peer: the header with
+// the most work it is known to have, and the blocks requested from it with
+// the time they were requested.
+type syncPeer struct {
+	peer     *p2p.Peer
+	best     *blockNode
+	inFlight map[[32]byte]time.Time
+}
+
+// StartBlockDownload periodically gives up on blocks a peer has not
+// delivered within BLOCK_DOWNLOAD_TIMEOUT_SEC and requests them again.
+func (bc *Blockchain) StartBlockDownload() {
+	bc.mux.Lock()
+	now := time.Now()
+	for hash, sp := range bc.inFlight {
+		if now.Sub(sp.inFlight[hash]) >= time.Second*BLOCK_DOWNLOAD_TIMEOUT_SEC {
+			log.Printf("action=BlockDownload, status=timeout, hash=%x, peer=%s", hash, sp.peer)
+			delete(sp.inFlight, hash)
+			delete(bc.inFlight, hash)
+		}
+	}
+	bc.requestMissingBlocks()
+	bc.mux.Unlock()
+
+	time.AfterFunc(time.Second*BLOCK_DOWNLOAD_TIMER_SEC, bc.StartBlockDownload)
+}
+
+// requestMissingBlocks asks peers for the blocks, parent first, that the
+// branch with the most work still lacks. Each block goes to the least busy
+// peer known to have it. bc.mux must be held.
+func (bc *Blockchain) requestMissingBlocks() {
+	target := bc.tree.bestHeader()
+	if target.chainWork.Cmp(bc.tip.chainWork) <= 0 {
+		return
+	}
+
+	requests := make(map[*syncPeer][]p2p.InvItem)
+	now := time.Now()
+	for _, n := range missingBlocks(bc.tip, target) {
+		if _, ok := bc.inFlight[n.hash]; ok {
+			continue
+		}
+		sp := bc.downloadPeer(n)
+		if sp == nil {
+			continue
+		}
+		sp.inFlight[n.hash] = now
+		bc.inFlight[n.hash] = sp
+		requests[sp] = append(requests[sp], p2p.InvItem{Type: p2p.InvBlock, Hash: n.hash})
+	}
+
+	for sp, items := range requests {
+		sp.peer.Send(p2p.NewMessage(p2p.MsgGetData, (&p2p.InvMessage{Items: items}).Encode()))
+	}
+}
+
+// missingBlocks lists, parent first, the blocks on the branch ending in
+// target whose transactions have not arrived, up to BLOCK_DOWNLOAD_WINDOW
+// past its fork with tip.
+func missingBlocks(tip, target *blockNode) []*blockNode {
+	fork := findFork(tip, target)
+
+	var missing []*blockNode
+	for n := target; n != fork; n = n.parent {
+		if !n.hasData && n.height <= fork.height+BLOCK_DOWNLOAD_WINDOW {
+			missing = append(missing, n)
+		}
+	}
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing
+}
+
+// downloadPeer returns the peer with the fewest blocks in flight that has
+// room for another and is known to have n, or nil if there is none.
+func (bc *Blockchain) downloadPeer(n *blockNode) *syncPeer {
+	var chosen *syncPeer
+	for _, sp := range bc.syncPeers {
+		if len(sp.inFlight) >= MAX_BLOCKS_IN_FLIGHT || sp.best == nil || !n.isAncestorOf(sp.best) {
+			continue
+		}
+		if chosen == nil || len(sp.inFlight) < len(chosen.inFlight) {
+			chosen = sp
+		}
+	}
+	return chosen
+}
+
+// blockReceived clears hash from the blocks in flight. bc.mux must be held.
+func (bc *Blockchain) blockReceived(hash [32]byte) {
+	if sp, ok := bc.inFlight[hash]; ok {
+		delete(sp.inFlight, hash)
+		delete(bc.inFlight, hash)
+	}
+}
+
+// peerHasHeader records that p has the branch ending in n. bc.mux must be
+// held.
+func (bc *Blockchain) peerHasHeader(p *p2p.Peer, n *blockNode) {
+	sp, ok := bc.syncPeers[p.ID()]
+	if ok && (sp.best == nil || n.chainWork.Cmp(sp.best.chainWork) > 0) {
+		sp.best = n
+	}
+}
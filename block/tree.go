@@ -0,0 +1,258 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+)
+
+// blockNode is a block in the block tree together with what the chain needs
+// to know about its position: its parent, height and the cumulative work of
+// the branch ending in it.
+type blockNode struct {
+	block     *Block
+	hash      [32]byte
+	parent    *blockNode
+	height    int
+	chainWork *big.Int
+
+	// seq is the position of the node in blockTree.order.
+	seq      int
+	children []*blockNode
+
+	// undo is set while the block is connected to the active chain and
+	// holds the outputs it spent.
+	undo *BlockUndo
+	// invalid marks a block whose transactions failed to connect, and
+	// invalidBranch a block that is invalid or built on one.
+	invalid       bool
+	invalidBranch bool
+	// hasData is false while only the header is known; block then holds
+	// no transactions. fullBranch is set once every block from the root
+	// to this one has arrived.
+	hasData    bool
+	fullBranch bool
+}
+
+// recent returns the last count blocks of the branch ending in n, n
+// included, oldest first; fewer if the branch is shorter.
+func (n *blockNode) recent(count int) []*Block {
+	if count > n.height+1 {
+		count = n.height + 1
+	}
+	blocks := make([]*Block, count)
+	node := n
+	for i := count - 1; i >= 0; i-- {
+		blocks[i] = node.block
+		node = node.parent
+	}
+	return blocks
+}
+
+func (n *blockNode) hasInvalidAncestor() bool {
+	return n.invalidBranch
+}
+
+// connectable reports whether the branch ending in n can become the active
+// chain: every block on it has arrived and none is invalid.
+func (n *blockNode) connectable() bool {
+	return n.fullBranch && !n.invalidBranch
+}
+
+// moreWork reports whether n is preferred to m as a tip: it has more
+// cumulative work, or as much and was seen first.
+func (n *blockNode) moreWork(m *blockNode) bool {
+	if c := n.chainWork.Cmp(m.chainWork); c != 0 {
+		return c > 0
+	}
+	return n.seq < m.seq
+}
+
+// blockTree keeps every known block that connects to genesis, including the
+// side branches that are not part of the active chain. During sync it also
+// holds headers whose blocks have not arrived yet. The best nodes are kept
+// up to date as nodes are added, filled in and invalidated, so that looking
+// them up does not cost a pass over the tree.
+type blockTree struct {
+	nodes map[[32]byte]*blockNode
+	// order lists the nodes as they were added, which decides ties in work
+	// in favor of the branch seen first.
+	order          []*blockNode
+	root           *blockNode
+	bestNode       *blockNode
+	bestHeaderNode *blockNode
+}
+
+func newBlockTree() *blockTree {
+	return &blockTree{nodes: make(map[[32]byte]*blockNode)}
+}
+
+func (t *blockTree) lookup(hash [32]byte) (*blockNode, bool) {
+	n, ok := t.nodes[hash]
+	return n, ok
+}
+
+// add links b under its parent. The first block added becomes the root.
+func (t *blockTree) add(b *Block) (*blockNode, error) {
+	n, err := t.addHeader(b.Header())
+	if err != nil {
+		return nil, err
+	}
+	t.setData(n, b)
+	return n, nil
+}
+
+// addHeader links a node for h under its parent without the block's
+// transactions, which are filled in by setData once they arrive.
+func (t *blockTree) addHeader(h *BlockHeader) (*blockNode, error) {
+	hash := h.Hash()
+	if _, ok := t.nodes[hash]; ok {
+		return nil, errors.New("block already known")
+	}
+
+	n := &blockNode{
+		block:     &Block{header: *h},
+		hash:      hash,
+		chainWork: CalcWork(h.bits),
+		seq:       len(t.order),
+	}
+
+	if t.root == nil {
+		t.root = n
+		t.bestNode = n
+		t.bestHeaderNode = n
+		t.nodes[hash] = n
+		t.order = append(t.order, n)
+		return n, nil
+	}
+
+	parent, ok := t.nodes[h.prevHash]
+	if !ok {
+		return nil, errors.New("parent block not found")
+	}
+	n.parent = parent
+	n.height = parent.height + 1
+	n.chainWork.Add(n.chainWork, parent.chainWork)
+	n.invalidBranch = parent.invalidBranch
+	parent.children = append(parent.children, n)
+	t.nodes[hash] = n
+	t.order = append(t.order, n)
+
+	if !n.invalidBranch && n.moreWork(t.bestHeaderNode) {
+		t.bestHeaderNode = n
+	}
+	return n, nil
+}
+
+// setData fills in the transactions of n. Every block built on n whose
+// blocks have all arrived now completes a branch and may become the best.
+func (t *blockTree) setData(n *blockNode, b *Block) {
+	n.block = b
+	n.hasData = true
+	if n.parent != nil && !n.parent.fullBranch {
+		return
+	}
+
+	stack := []*blockNode{n}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node.fullBranch = true
+		if node.connectable() && node.moreWork(t.bestNode) {
+			t.bestNode = node
+		}
+		for _, child := range node.children {
+			if child.hasData {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// markInvalid marks n invalid along with every block built on it, and looks
+// for new best nodes if the current ones were among them.
+func (t *blockTree) markInvalid(n *blockNode) {
+	n.invalid = true
+	stack := []*blockNode{n}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node.invalidBranch && node != n {
+			continue
+		}
+		node.invalidBranch = true
+		stack = append(stack, node.children...)
+	}
+
+	if t.bestNode.invalidBranch {
+		t.bestNode = t.root
+		for _, node := range t.order {
+			if node.connectable() && node.moreWork(t.bestNode) {
+				t.bestNode = node
+			}
+		}
+	}
+	if t.bestHeaderNode.invalidBranch {
+		t.bestHeaderNode = t.root
+		for _, node := range t.order {
+			if !node.invalidBranch && node.moreWork(t.bestHeaderNode) {
+				t.bestHeaderNode = node
+			}
+		}
+	}
+}
+
+// best returns the node with the most cumulative work whose branch is
+// connectable.
+func (t *blockTree) best() *blockNode {
+	return t.bestNode
+}
+
+// bestHeader returns the node with the most cumulative work that is not
+// built on an invalid block, whether or not its blocks have arrived. It is
+// where sync is heading.
+func (t *blockTree) bestHeader() *blockNode {
+	return t.bestHeaderNode
+}
+
+// isAncestorOf reports whether n is on the branch ending in m.
+func (n *blockNode) isAncestorOf(m *blockNode) bool {
+	for m != nil && m.height > n.height {
+		m = m.parent
+	}
+	return m == n
+}
+
+// locator lists hashes from n back to the root, dense near n and thinning
+// out exponentially, so that a peer can find where its chain and n's branch
+// meet in few round trips.
+func (n *blockNode) locator() [][32]byte {
+	var hashes [][32]byte
+	step := 1
+	for node := n; ; {
+		hashes = append(hashes, node.hash)
+		if node.parent == nil {
+			return hashes
+		}
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step && node.parent != nil; i++ {
+			node = node.parent
+		}
+	}
+}
+
+// findFork returns the last block a and b have in common.
+func findFork(a, b *blockNode) *blockNode {
+	for a.height > b.height {
+		a = a.parent
+	}
+	for b.height > a.height {
+		b = b.parent
+	}
+	for a != b {
+		a = a.parent
+		b = b.parent
+	}
+	return a
+}
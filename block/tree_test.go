@@ -0,0 +1,220 @@
+package block
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
+	"testing"
+)
+
+// testTreeBlocks returns a block built on parent for every nonce, distinct
+// so that siblings get different hashes.
+func testTreeBlocks(parent *Block, nonces ...int) []*Block {
+	blocks := make([]*Block, len(nonces))
+	for i, nonce := range nonces {
+		blocks[i] = NewBlock(nonce, parent.Hash(), chaincfg.RegTestParams.PowLimitBits, nil)
+	}
+	return blocks
+}
+
+func TestBlockTreeBest(t *testing.T) {
+	tree := newBlockTree()
+	genesis, _ := tree.add(GenesisBlock(&chaincfg.RegTestParams))
+
+	a1, _ := tree.add(testTreeBlocks(genesis.block, 1)[0])
+	b1, _ := tree.add(testTreeBlocks(genesis.block, 2)[0])
+	if tree.best() != a1 {
+		t.Fatal("a tie in work did not go to the branch seen first")
+	}
+
+	// b2's header arrives before b1's child has its body.
+	b2, _ := tree.addHeader(testTreeBlocks(b1.block, 3)[0].Header())
+	if tree.bestHeader() != b2 || tree.best() != a1 {
+		t.Fatal("a header without its block counted as a full branch")
+	}
+	b3Block := testTreeBlocks(b2.block, 4)[0]
+	b3, _ := tree.add(b3Block)
+	if b3.connectable() || tree.best() != a1 {
+		t.Fatal("a branch with a missing block became the best")
+	}
+	tree.setData(b2, NewBlock(3, b1.hash, chaincfg.RegTestParams.PowLimitBits, nil))
+	if !b3.connectable() || tree.best() != b3 {
+		t.Fatal("filling in the missing block did not complete the branch")
+	}
+
+	tree.markInvalid(b2)
+	if !b3.hasInvalidAncestor() || b1.hasInvalidAncestor() {
+		t.Fatal("invalid mark did not follow the branch")
+	}
+	if tree.best() != a1 || tree.bestHeader() != a1 {
+		t.Fatalf("best moved to height %d instead of back to a1", tree.best().height)
+	}
+	b4, _ := tree.add(testTreeBlocks(b3Block, 5)[0])
+	if !b4.hasInvalidAncestor() || tree.best() != a1 {
+		t.Fatal("a block built on an invalid branch was not marked")
+	}
+}
+
+// testKey returns a key and the regtest address it owns.
+func testKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, blockchain_crypto.PublicKeyToAddress(&key.PublicKey, chaincfg.RegTestParams.AddressVersion)
+}
+
+// testSpend returns a transaction from the owner of key spending the whole
+// of output 0 of prev to recipient, signed.
+func testSpend(t *testing.T, key *ecdsa.PrivateKey, prev *Transaction, recipient string) *Transaction {
+	t.Helper()
+	sender := blockchain_crypto.PublicKeyToAddress(&key.PublicKey, chaincfg.RegTestParams.AddressVersion)
+	tx := NewTransaction(sender, []*TxInput{NewTxInput(prev.Hash(), 0)}, []*TxOutput{NewTxOutput(recipient, prev.Outputs()[0].Value())}, 0)
+	return signTransaction(t, key, tx)
+}
+
+// testChain is a regtest chain whose rewards can be spent right away.
+func testChain(t *testing.T) *Blockchain {
+	t.Helper()
+	params := chaincfg.RegTestParams
+	params.CoinbaseMaturity = 0
+	_, miner := testKey(t)
+	bc, err := NewBlockchain(&params, miner, 0, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+// mineOn returns a block at height on parent paying its reward to miner
+// and carrying transactions, with a valid proof of work.
+func mineOn(t *testing.T, bc *Blockchain, parent *Block, height int, miner string, transactions ...*Transaction) *Block {
+	t.Helper()
+	coinbase := NewCoinbaseTransaction(miner, CalcBlockSubsidy(bc.params, height))
+	b := NewBlock(0, parent.Hash(), bc.params.PowLimitBits, append([]*Transaction{coinbase}, transactions...))
+	if err := bc.ProofOfWork(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func processBlocks(t *testing.T, bc *Blockchain, blocks ...*Block) {
+	t.Helper()
+	for _, b := range blocks {
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatalf("block at %x: %v", b.Hash(), err)
+		}
+	}
+}
+
+func unspent(bc *Blockchain, t *Transaction) bool {
+	_, ok := bc.utxos.Get(OutPoint{TxHash: t.Hash(), Index: 0})
+	return ok
+}
+
+// TestReorg switches between two branches that fork after a1, one of which
+// spends a1's reward, and checks that the UTXO set and the mempool follow.
+func TestReorg(t *testing.T) {
+	bc := testChain(t)
+	aliceKey, alice := testKey(t)
+	_, bob := testKey(t)
+	_, carol := testKey(t)
+	genesis := bc.LastBlock()
+
+	a1 := mineOn(t, bc, genesis, 1, alice)
+	spend := testSpend(t, aliceKey, a1.Transactions()[0], bob)
+	a2 := mineOn(t, bc, a1, 2, alice, spend)
+	b2 := mineOn(t, bc, a1, 2, carol)
+	b3 := mineOn(t, bc, b2, 3, carol)
+	a3 := mineOn(t, bc, a2, 3, alice)
+	a4 := mineOn(t, bc, a3, 4, alice)
+
+	events := make(chan *ReorgEvent, 4)
+	bc.SubscribeReorg(events)
+
+	processBlocks(t, bc, a1, a2)
+	if unspent(bc, a1.Transactions()[0]) || !unspent(bc, spend) {
+		t.Fatal("the spend in a2 was not applied")
+	}
+
+	processBlocks(t, bc, b2, b3)
+	if bc.LastBlock() != b3 {
+		t.Fatal("the branch with more work did not become the active chain")
+	}
+	e := <-events
+	if len(e.Disconnected) != 1 || len(e.Connected) != 2 || e.ForkPoint != a1.Hash() {
+		t.Fatalf("reorg disconnected %d and connected %d blocks from %x", len(e.Disconnected), len(e.Connected), e.ForkPoint)
+	}
+	if !unspent(bc, a1.Transactions()[0]) || unspent(bc, spend) || unspent(bc, a2.Transactions()[0]) {
+		t.Fatal("disconnecting a2 did not restore the outputs it spent and remove its own")
+	}
+	if !bc.mempool.Has(spend.Hash()) {
+		t.Fatal("the spend did not return to the mempool")
+	}
+
+	// a3 only ties with b3, which was seen first.
+	processBlocks(t, bc, a3)
+	if bc.LastBlock() != b3 {
+		t.Fatal("a tie in work moved the active chain")
+	}
+
+	processBlocks(t, bc, a4)
+	if bc.LastBlock() != a4 {
+		t.Fatal("the chain did not move back to the branch with more work")
+	}
+	if e := <-events; len(e.Disconnected) != 2 || len(e.Connected) != 3 {
+		t.Fatalf("reorg back disconnected %d and connected %d blocks", len(e.Disconnected), len(e.Connected))
+	}
+	if unspent(bc, a1.Transactions()[0]) || !unspent(bc, spend) || unspent(bc, b2.Transactions()[0]) {
+		t.Fatal("reconnecting a2 did not spend a1's reward again")
+	}
+	if bc.mempool.Has(spend.Hash()) {
+		t.Fatal("the spend stayed in the mempool after it was mined again")
+	}
+	if len(bc.Chain()) != 5 {
+		t.Fatalf("active chain has %d blocks, want 5", len(bc.Chain()))
+	}
+}
+
+// TestReorgOntoInvalidBranch tries to switch to a branch with more work
+// whose first block spends an output the branch does not have.
+func TestReorgOntoInvalidBranch(t *testing.T) {
+	bc := testChain(t)
+	aliceKey, alice := testKey(t)
+	_, bob := testKey(t)
+	genesis := bc.LastBlock()
+
+	a1 := mineOn(t, bc, genesis, 1, alice)
+	a2 := mineOn(t, bc, a1, 2, alice)
+	processBlocks(t, bc, a1, a2)
+
+	// b1 spends a2's reward, which only exists on the other branch.
+	b1 := mineOn(t, bc, genesis, 1, bob, testSpend(t, aliceKey, a2.Transactions()[0], bob))
+	b2 := mineOn(t, bc, b1, 2, bob)
+	b3 := mineOn(t, bc, b2, 3, bob)
+	processBlocks(t, bc, b1, b2)
+	if err := bc.ProcessBlock(b3); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidBlock)
+	}
+
+	if bc.LastBlock() != a2 {
+		t.Fatal("the active chain did not stay on a2")
+	}
+	if !unspent(bc, a1.Transactions()[0]) || !unspent(bc, a2.Transactions()[0]) || unspent(bc, b1.Transactions()[0]) {
+		t.Fatal("the UTXO set was not restored")
+	}
+	if n, _ := bc.tree.lookup(b1.Hash()); !n.invalid {
+		t.Fatal("b1 was not marked invalid")
+	}
+	if bc.tree.best().hash != a2.Hash() {
+		t.Fatal("the invalid branch is still the best")
+	}
+	if err := bc.ProcessBlock(mineOn(t, bc, b3, 4, bob)); !errors.Is(err, ErrInvalidChain) {
+		t.Fatalf("block on the invalid branch: got %v, want %v", err, ErrInvalidChain)
+	}
+}
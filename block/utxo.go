@@ -0,0 +1,335 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrInvalidTransaction marks a transaction that breaks the rules whatever
+// the state of the chain, as opposed to one that spends an output that is
+// missing or already spent.
+var ErrInvalidTransaction = errors.New("invalid transaction")
+
+// ErrImmatureCoinbase marks a spend of a coinbase output that has fewer
+// confirmations than the coinbase maturity. The same spend becomes valid
+// once the chain is long enough.
+var ErrImmatureCoinbase = errors.New("coinbase output is not mature")
+
+// OutPoint identifies a single output of a transaction.
+type OutPoint struct {
+	TxHash [32]byte
+	Index  int
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%x:%d", op.TxHash, op.Index)
+}
+
+// UTXOSet holds every transaction output that has not been spent yet by the
+// blocks applied to it, along with the ID of every transaction in those
+// blocks. The IDs outlive the outputs so that a transaction whose outputs are
+// all spent still cannot be included a second time.
+//
+// Coinbase outputs can only be spent by a block coinbaseMaturity blocks or
+// more after the one that created them, since a reorganization can make a
+// block reward vanish along with everything that spent it. The genesis
+// allocations are exempt.
+type UTXOSet struct {
+	outputs      map[OutPoint]*TxOutput
+	transactions map[[32]byte]bool
+	// coinbaseHeights holds the height of the block that created each
+	// unspent coinbase output.
+	coinbaseHeights  map[OutPoint]int
+	coinbaseMaturity int
+	// height is that of the last block applied, -1 before the genesis
+	// block.
+	height int
+}
+
+func NewUTXOSet(coinbaseMaturity int) *UTXOSet {
+	return &UTXOSet{
+		outputs:          make(map[OutPoint]*TxOutput),
+		transactions:     make(map[[32]byte]bool),
+		coinbaseHeights:  make(map[OutPoint]int),
+		coinbaseMaturity: coinbaseMaturity,
+		height:           -1,
+	}
+}
+
+func (us *UTXOSet) Get(op OutPoint) (*TxOutput, bool) {
+	out, ok := us.outputs[op]
+	return out, ok
+}
+
+// IsMature reports whether op could be spent by the next block, which only
+// coinbase outputs younger than the coinbase maturity cannot.
+func (us *UTXOSet) IsMature(op OutPoint) bool {
+	h, ok := us.coinbaseHeights[op]
+	return !ok || us.height+1-h >= us.coinbaseMaturity
+}
+
+// HasTransaction reports whether a transaction with ID h is in one of the
+// applied blocks.
+func (us *UTXOSet) HasTransaction(h [32]byte) bool {
+	return us.transactions[h]
+}
+
+// Validate checks that every transaction in b spends only unspent outputs,
+// including outputs created earlier in the same block, and that no output is
+// spent twice. The set is left unchanged.
+func (us *UTXOSet) Validate(b *Block) error {
+	_, _, err := us.connect(b)
+	return err
+}
+
+// BlockUndo records the outputs a block spent so that the block can later
+// be disconnected again.
+type BlockUndo struct {
+	spent           map[OutPoint]*TxOutput
+	coinbaseHeights map[OutPoint]int
+}
+
+// Apply validates b and then moves the set past it.
+func (us *UTXOSet) Apply(b *Block) (*BlockUndo, error) {
+	spent, created, err := us.connect(b)
+	if err != nil {
+		return nil, err
+	}
+
+	undo := &BlockUndo{
+		spent:           make(map[OutPoint]*TxOutput, len(spent)),
+		coinbaseHeights: make(map[OutPoint]int),
+	}
+	for op := range spent {
+		undo.spent[op] = us.outputs[op]
+		delete(us.outputs, op)
+		if h, ok := us.coinbaseHeights[op]; ok {
+			undo.coinbaseHeights[op] = h
+			delete(us.coinbaseHeights, op)
+		}
+	}
+	for op, out := range created {
+		us.outputs[op] = out
+	}
+	us.height++
+	for _, t := range b.transactions {
+		h := t.Hash()
+		us.transactions[h] = true
+		if t.IsCoinbase() && us.height > 0 {
+			for i := range t.outputs {
+				if op := (OutPoint{TxHash: h, Index: i}); created[op] != nil {
+					us.coinbaseHeights[op] = us.height
+				}
+			}
+		}
+	}
+
+	return undo, nil
+}
+
+// Disconnect reverses Apply for b, the most recently applied block.
+func (us *UTXOSet) Disconnect(b *Block, undo *BlockUndo) {
+	for _, t := range b.transactions {
+		h := t.Hash()
+		for i := range t.outputs {
+			delete(us.outputs, OutPoint{TxHash: h, Index: i})
+			delete(us.coinbaseHeights, OutPoint{TxHash: h, Index: i})
+		}
+		delete(us.transactions, h)
+	}
+	for op, out := range undo.spent {
+		us.outputs[op] = out
+	}
+	for op, h := range undo.coinbaseHeights {
+		us.coinbaseHeights[op] = h
+	}
+	us.height--
+}
+
+func (us *UTXOSet) connect(b *Block) (map[OutPoint]bool, map[OutPoint]*TxOutput, error) {
+	spent := make(map[OutPoint]bool)
+	created := make(map[OutPoint]*TxOutput)
+	seen := make(map[[32]byte]bool)
+
+	for _, t := range b.transactions {
+		h := t.Hash()
+		if us.transactions[h] || seen[h] {
+			return nil, nil, fmt.Errorf("transaction %x is already on chain", h)
+		}
+		seen[h] = true
+
+		if err := us.checkSpends(t, spent, created); err != nil {
+			return nil, nil, err
+		}
+		if err := us.checkMaturity(t, us.height+1, b.transactions[0]); err != nil {
+			return nil, nil, err
+		}
+
+		for _, in := range t.inputs {
+			op := in.OutPoint()
+			if _, ok := created[op]; ok {
+				delete(created, op)
+			} else {
+				spent[op] = true
+			}
+		}
+
+		for i, out := range t.outputs {
+			created[OutPoint{TxHash: h, Index: i}] = out
+		}
+	}
+
+	return spent, created, nil
+}
+
+func (us *UTXOSet) checkSpends(t *Transaction, spent map[OutPoint]bool, created map[OutPoint]*TxOutput) error {
+	h := t.Hash()
+
+	if len(t.outputs) == 0 {
+		return fmt.Errorf("%w: transaction %x has no outputs", ErrInvalidTransaction, h)
+	}
+	if _, err := t.OutputValue(); err != nil {
+		return fmt.Errorf("%w: transaction %x: outputs: %w", ErrInvalidTransaction, h, err)
+	}
+	for _, out := range t.outputs {
+		// A coinbase pays nothing once the subsidy has run out in a block
+		// without fees.
+		if out.value < 0 || out.value == 0 && !t.IsCoinbase() {
+			return fmt.Errorf("%w: transaction %x has a non-positive output", ErrInvalidTransaction, h)
+		}
+	}
+
+	if t.fee < 0 {
+		return fmt.Errorf("%w: transaction %x has a negative fee", ErrInvalidTransaction, h)
+	}
+
+	if len(t.inputs) == 0 {
+		if !t.IsCoinbase() {
+			return fmt.Errorf("%w: transaction %x has no inputs", ErrInvalidTransaction, h)
+		}
+		if t.fee != 0 {
+			return fmt.Errorf("%w: coinbase transaction %x has a fee", ErrInvalidTransaction, h)
+		}
+		return nil
+	}
+
+	var inputValue Amount
+	seen := make(map[OutPoint]bool)
+	for _, in := range t.inputs {
+		op := in.OutPoint()
+		if seen[op] {
+			return fmt.Errorf("%w: transaction %x spends %s twice", ErrInvalidTransaction, h, op)
+		}
+		seen[op] = true
+
+		out, ok := created[op]
+		if !ok && !spent[op] {
+			out, ok = us.outputs[op]
+		}
+		if !ok {
+			return fmt.Errorf("transaction %x spends missing or spent output %s", h, op)
+		}
+		if out.recipientBlockchainAddress != t.senderBlockchainAddress {
+			return fmt.Errorf("%w: transaction %x spends %s not owned by %s", ErrInvalidTransaction, h, op, t.senderBlockchainAddress)
+		}
+		var err error
+		if inputValue, err = inputValue.Add(out.value); err != nil {
+			return fmt.Errorf("%w: transaction %x: inputs: %w", ErrInvalidTransaction, h, err)
+		}
+	}
+
+	outputValue, err := t.OutputValue()
+	if err != nil {
+		return fmt.Errorf("%w: transaction %x: outputs: %w", ErrInvalidTransaction, h, err)
+	}
+	spendValue, err := outputValue.Add(t.fee)
+	if err != nil {
+		return fmt.Errorf("%w: transaction %x: outputs: %w", ErrInvalidTransaction, h, err)
+	}
+	if inputValue != spendValue {
+		return fmt.Errorf("%w: transaction %x: inputs %s do not equal outputs plus fee %s", ErrInvalidTransaction, h, inputValue, spendValue)
+	}
+
+	return nil
+}
+
+// checkMaturity requires the coinbase outputs t spends to be mature at
+// height. coinbase is the first transaction of the block t is in, whose
+// outputs are as young as they get; it is nil for the mempool.
+func (us *UTXOSet) checkMaturity(t *Transaction, height int, coinbase *Transaction) error {
+	var coinbaseHash [32]byte
+	if coinbase != nil && coinbase.IsCoinbase() {
+		coinbaseHash = coinbase.Hash()
+	}
+	for _, in := range t.inputs {
+		op := in.OutPoint()
+		created, ok := us.coinbaseHeights[op]
+		if coinbase != nil && op.TxHash == coinbaseHash {
+			created, ok = height, true
+		}
+		if ok && height-created < us.coinbaseMaturity {
+			return fmt.Errorf("transaction %x spends %s at %d confirmations, %d needed: %w",
+				t.Hash(), op, height-created, us.coinbaseMaturity, ErrImmatureCoinbase)
+		}
+	}
+	return nil
+}
+
+// CheckTransaction validates a single transaction against the set, treating
+// the outputs in pending as already spent.
+func (us *UTXOSet) CheckTransaction(t *Transaction, pending map[OutPoint]bool) error {
+	if h := t.Hash(); us.transactions[h] {
+		return fmt.Errorf("transaction %x is already on chain", h)
+	}
+
+	spent := make(map[OutPoint]bool, len(pending))
+	for op := range pending {
+		spent[op] = true
+	}
+
+	if err := us.checkSpends(t, spent, map[OutPoint]*TxOutput{}); err != nil {
+		return err
+	}
+	return us.checkMaturity(t, us.height+1, nil)
+}
+
+// FindByAddress returns the unspent outputs owned by address, sorted so that
+// repeated calls select coins in the same order.
+func (us *UTXOSet) FindByAddress(address string) []OutPoint {
+	var ops []OutPoint
+	for op, out := range us.outputs {
+		if out.recipientBlockchainAddress == address {
+			ops = append(ops, op)
+		}
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].TxHash != ops[j].TxHash {
+			return string(ops[i].TxHash[:]) < string(ops[j].TxHash[:])
+		}
+		return ops[i].Index < ops[j].Index
+	})
+
+	return ops
+}
+
+// Balance sums the unspent outputs owned by address, split into those the
+// next block could spend and coinbase outputs that are not mature yet. It
+// fails rather than wrap around if a total does not fit in an Amount.
+func (us *UTXOSet) Balance(address string) (mature, immature Amount, err error) {
+	for op, out := range us.outputs {
+		if out.recipientBlockchainAddress != address {
+			continue
+		}
+		if us.IsMature(op) {
+			mature, err = mature.Add(out.value)
+		} else {
+			immature, err = immature.Add(out.value)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return mature, immature, nil
+}
@@ -0,0 +1,72 @@
+package blockchain_crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// PublicKeyToAddress derives the blockchain address owned by publicKey on
+// the network whose addresses start with version.
+func PublicKeyToAddress(publicKey *ecdsa.PublicKey, version byte) string {
+	// 1. Perform SHA-256 hashing on the public key (32 bytes).
+	h1 := sha256.New()
+	h1.Write(publicKey.X.Bytes())
+	h1.Write(publicKey.Y.Bytes())
+	digest1 := h1.Sum(nil)
+
+	// 2. Perform RIPEMD-160 hashing on the result of SHA-256 (20 bytes).
+	h2 := ripemd160.New()
+	h2.Write(digest1)
+	digest2 := h2.Sum(nil)
+
+	// 3. Add version byte in front of RIPEMD-160 hash.
+	vd3 := make([]byte, 21)
+	vd3[0] = version
+	copy(vd3[1:], digest2[:])
+
+	// 4. Perform SHA-256 hash on the extended RIPEMD-160 result.
+	h4 := sha256.New()
+	h4.Write(vd3)
+	digest4 := h4.Sum(nil)
+
+	// 5. Perform SHA-256 hash on the result of the previous SHA-256 hash.
+	h5 := sha256.New()
+	h5.Write(digest4)
+	digest5 := h5.Sum(nil)
+
+	// 6. Take the first 4 bytes of the second SHA-256 hash for checksum.
+	chsum := digest5[:4]
+
+	// 7. Add the 4 checksum bytes from 6 at the end of extended RIPEMD-160 hash from 3 (25 bytes).
+	dc7 := make([]byte, 25)
+	copy(dc7[:21], vd3[:])
+	copy(dc7[21:], chsum[:])
+
+	// 8. Convert the result from a byte string into base58.
+	return base58.Encode(dc7)
+}
+
+// AddressVersion checks the length and checksum of address and returns its
+// version byte, which tells the network it belongs to.
+func AddressVersion(address string) (byte, error) {
+	b := base58.Decode(address)
+	if len(b) != 25 {
+		return 0, errors.New("address has the wrong length")
+	}
+	digest := sha256.Sum256(b[:21])
+	digest = sha256.Sum256(digest[:])
+	if !bytes.Equal(digest[:4], b[21:]) {
+		return 0, errors.New("address checksum does not match")
+	}
+	return b[0], nil
+}
+
+func PublicKeyToStr(publicKey *ecdsa.PublicKey) string {
+	return fmt.Sprintf("%064x%064x", publicKey.X.Bytes(), publicKey.Y.Bytes())
+}
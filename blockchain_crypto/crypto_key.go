@@ -7,6 +7,16 @@ import (
 	"math/big"
 )
 
+// IsTupleStr reports whether str is the 128 hex digit form of a key or
+// signature that StringToBigIntTuple expects.
+func IsTupleStr(str string) bool {
+	if len(str) != 128 {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
 func StringToBigIntTuple(str string) (*big.Int, *big.Int) {
 	bX, _ := hex.DecodeString(str[:64])
 	bY, _ := hex.DecodeString(str[64:])
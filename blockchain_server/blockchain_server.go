@@ -2,39 +2,66 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"goblockchain/api"
 	"goblockchain/block"
 	"goblockchain/blockchain_crypto"
+	"goblockchain/config"
+	"goblockchain/p2p"
 	"goblockchain/wallet"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// MAX_MINE_BLOCKS caps the blocks a single /mine request may ask for.
+const MAX_MINE_BLOCKS = 1000
+
 var cache map[string]*block.Blockchain = make(map[string]*block.Blockchain)
 
 type BlockchainServer struct {
-	port uint16
+	cfg   *config.BlockchainServerConfig
+	miner *block.Miner
 }
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
-	return &BlockchainServer{port}
+func NewBlockchainServer(cfg *config.BlockchainServerConfig) *BlockchainServer {
+	return &BlockchainServer{cfg: cfg}
 }
 
 func (bcs *BlockchainServer) Port() uint16 {
-	return bcs.port
+	return bcs.cfg.Port
+}
+
+func (bcs *BlockchainServer) DataDir() string {
+	return bcs.cfg.DataDir
 }
 
 func (bcs *BlockchainServer) GetBlockChain() *block.Blockchain {
 	bc, ok := cache["blockChain"]
 	if !ok {
-		minerWallet := wallet.NewWallet()
-		bc = block.NewBlockchain(minerWallet.BlockchainAddress(), bcs.port)
+		store, err := block.NewFileStore(filepath.Join(bcs.DataDir(), "blocks.dat"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		minerAddress := bcs.cfg.MinerAddress
+		if minerAddress == "" {
+			minerWallet := wallet.NewWallet(bcs.cfg.Params())
+			minerAddress = minerWallet.BlockchainAddress()
+			log.Printf("privateKey   %s", minerWallet.PrivateKeyStr())
+			log.Printf("publicKey   %s", minerWallet.PublicKeyStr())
+		}
+		bc, err = block.NewBlockchain(bcs.cfg.Params(), minerAddress, bcs.Port(), store)
+		if err != nil {
+			log.Fatal(err)
+		}
 		cache["blockChain"] = bc
-		log.Printf("privateKey   %s", minerWallet.PrivateKeyStr())
-		log.Printf("publicKey   %s", minerWallet.PublicKeyStr())
-		log.Printf("blockChainAddress   %s", minerWallet.BlockchainAddress())
+		log.Printf("blockChainAddress   %s", minerAddress)
 	}
 
 	return bc
@@ -67,47 +94,29 @@ func (bcs *BlockchainServer) CreateTransaction(w http.ResponseWriter, r *http.Re
 		io.WriteString(w, string(m))
 
 	case http.MethodPost:
-		dec := json.NewDecoder(r.Body)
-		var btr block.TransactionRequest
-
-		if err := dec.Decode(&btr); err != nil {
-			log.Printf("Error: %v\n", err)
-			io.WriteString(w, string(api.JsonStatus("failed")))
-			return
-		}
-		if !btr.Validate() {
-			log.Println("Error: Missing field(s)")
-			io.WriteString(w, string(api.JsonStatus("failed")))
-			return
-		}
-
-		publicKey := blockchain_crypto.PublicKeyStrToPublicKey(*btr.PublicKey)
-		signature := blockchain_crypto.SignatureStrToSignature(*btr.Signature)
-
+		// Clients are scored like peers, so one that keeps sending invalid
+		// transactions gets banned.
 		bc := bcs.GetBlockChain()
-		isCreated := bc.CreateTransaction(*btr.SenderBlockchainAddress, *btr.RecipientBlockchainAddress, *btr.Value, publicKey, signature)
-
-		var m []byte
-		if isCreated {
-			w.WriteHeader(http.StatusCreated)
-			m = api.JsonStatus("success")
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			m = api.JsonStatus("fail")
+		node := bc.Node()
+		host := p2p.HostOf(r.RemoteAddr)
+		if node.BanManager().IsBanned(host) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, string(api.JsonStatus("banned")))
+			return
 		}
-		io.WriteString(w, string(m))
 
-	case http.MethodPut:
 		dec := json.NewDecoder(r.Body)
 		var btr block.TransactionRequest
 
 		if err := dec.Decode(&btr); err != nil {
 			log.Printf("Error: %v\n", err)
+			node.Misbehaving(host, p2p.MISBEHAVIOR_MALFORMED, err.Error())
 			io.WriteString(w, string(api.JsonStatus("failed")))
 			return
 		}
 		if !btr.Validate() {
 			log.Println("Error: Missing field(s)")
+			node.Misbehaving(host, p2p.MISBEHAVIOR_MALFORMED, "missing transaction fields")
 			io.WriteString(w, string(api.JsonStatus("failed")))
 			return
 		}
@@ -115,11 +124,16 @@ func (bcs *BlockchainServer) CreateTransaction(w http.ResponseWriter, r *http.Re
 		publicKey := blockchain_crypto.PublicKeyStrToPublicKey(*btr.PublicKey)
 		signature := blockchain_crypto.SignatureStrToSignature(*btr.Signature)
 
-		bc := bcs.GetBlockChain()
-		isAdded := bc.AddTransaction(*btr.SenderBlockchainAddress, *btr.RecipientBlockchainAddress, *btr.Value, publicKey, signature)
+		err := bc.SubmitTransaction(btr.Transaction, publicKey, signature)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			if errors.Is(err, block.ErrInvalidTransaction) {
+				node.Misbehaving(host, p2p.MISBEHAVIOR_INVALID_TX, err.Error())
+			}
+		}
 
 		var m []byte
-		if isAdded {
+		if err == nil {
 			w.WriteHeader(http.StatusCreated)
 			m = api.JsonStatus("success")
 		} else {
@@ -128,20 +142,37 @@ func (bcs *BlockchainServer) CreateTransaction(w http.ResponseWriter, r *http.Re
 		}
 		io.WriteString(w, string(m))
 
-	case http.MethodDelete:
-		bcs.GetBlockChain().ClearTransactionPool()
-
 	default:
 		log.Println("Error: Invalid HTTP Method")
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
+// Mine mines one block, or as many as the blocks parameter asks for, which
+// on regtest takes no time and lets tests advance the chain at will. Like
+// the other mining controls, it only serves requests from this machine.
 func (bcs *BlockchainServer) Mine(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(api.JsonStatus("forbidden")))
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		bc := bcs.GetBlockChain()
-		isMined := bc.Mining()
+		n := 1
+		if s := r.URL.Query().Get("blocks"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 1 || n > MAX_MINE_BLOCKS {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(api.JsonStatus("bad blocks")))
+				return
+			}
+		}
+		isMined := true
+		for i := 0; i < n && isMined; i++ {
+			isMined = bcs.miner.Mine(r.Context())
+		}
 		var m []byte
 
 		if isMined {
@@ -155,11 +186,96 @@ func (bcs *BlockchainServer) Mine(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// StartMine starts the mining loop unless it is already running. It only
+// serves requests from this machine.
 func (bcs *BlockchainServer) StartMine(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(api.JsonStatus("forbidden")))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		w.Header().Add("Content-Type", "application/json")
+		if !bcs.miner.Start() {
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, string(api.JsonStatus("already running")))
+			return
+		}
+		io.WriteString(w, string(api.JsonStatus("success")))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// StopMine stops the mining loop, abandoning the block being mined. It only
+// serves requests from this machine.
+func (bcs *BlockchainServer) StopMine(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(api.JsonStatus("forbidden")))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		w.Header().Add("Content-Type", "application/json")
+		if !bcs.miner.Stop() {
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, string(api.JsonStatus("not running")))
+			return
+		}
+		io.WriteString(w, string(api.JsonStatus("success")))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// MineStatus reports whether the miner is running, what it pays and how it
+// has done.
+func (bcs *BlockchainServer) MineStatus(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		bc := bcs.GetBlockChain()
-		bc.StartMining()
+		m, _ := json.Marshal(bcs.miner.Status())
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// MineAddress sets the address block rewards are paid to from a JSON body
+// of the form {"address": "..."}. Since it redirects the rewards, it only
+// serves requests from this machine.
+func (bcs *BlockchainServer) MineAddress(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(api.JsonStatus("forbidden")))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("fail")))
+			return
+		}
+		if err := bcs.miner.SetAddress(req.Address); err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("invalid address")))
+			return
+		}
 
 		w.Header().Add("Content-Type", "application/json")
 		io.WriteString(w, string(api.JsonStatus("success")))
@@ -169,14 +285,115 @@ func (bcs *BlockchainServer) StartMine(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// MineTemplate returns a block template for an external miner, paying the
+// address given by ?address= or else the miner's.
+func (bcs *BlockchainServer) MineTemplate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			address = bcs.miner.Address()
+		}
+
+		t, err := bcs.GetBlockChain().BlockTemplate(address)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			if errors.Is(err, block.ErrMinerAddress) {
+				io.WriteString(w, string(api.JsonStatus("invalid address")))
+			} else {
+				io.WriteString(w, string(api.JsonStatus("fail")))
+			}
+			return
+		}
+		m, _ := json.Marshal(t)
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// MineSubmit accepts a block solved by an external miner, in the JSON form
+// /chain lists blocks in. It answers "success" if the block became the tip
+// and "stale" if it was valid but the chain has moved on. Clients are
+// scored for invalid blocks like peers.
+func (bcs *BlockchainServer) MineSubmit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		bc := bcs.GetBlockChain()
+		node := bc.Node()
+		host := p2p.HostOf(r.RemoteAddr)
+		w.Header().Add("Content-Type", "application/json")
+		if node.BanManager().IsBanned(host) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, string(api.JsonStatus("banned")))
+			return
+		}
+
+		var b block.Block
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			log.Printf("Error: %v\n", err)
+			node.Misbehaving(host, p2p.MISBEHAVIOR_MALFORMED, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("fail")))
+			return
+		}
+
+		isTip, err := bc.SubmitBlock(&b)
+		switch {
+		case err == nil && isTip:
+			log.Printf("action=SubmitBlock, status=success, hash=%x, host=%s", b.Hash(), host)
+			io.WriteString(w, string(api.JsonStatus("success")))
+		case err == nil:
+			log.Printf("action=SubmitBlock, status=stale, hash=%x, host=%s", b.Hash(), host)
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, string(api.JsonStatus("stale")))
+		case errors.Is(err, block.ErrBlockKnown):
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, string(api.JsonStatus("duplicate")))
+		case errors.Is(err, block.ErrInvalidBlock), errors.Is(err, block.ErrInvalidChain), errors.Is(err, p2p.ErrGenesisMismatch):
+			log.Printf("Error: %v\n", err)
+			node.Misbehaving(host, p2p.MISBEHAVIOR_INVALID_BLOCK, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("rejected")))
+		default:
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("fail")))
+		}
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// fromLoopback reports whether r was sent from this machine.
+func fromLoopback(r *http.Request) bool {
+	ip := net.ParseIP(p2p.HostOf(r.RemoteAddr))
+	return ip != nil && ip.IsLoopback()
+}
+
 func (bcs *BlockchainServer) Amount(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		address := r.URL.Query().Get("blockchain_address")
 
 		bc := bcs.GetBlockChain()
-		amountValue := bc.CalculateTotalAmount(address)
-		amount := &block.AmountResponse{Amount: amountValue}
+		mature, immature, err := bc.CalculateTotalAmount(address)
+		var total block.Amount
+		if err == nil {
+			total, err = mature.Add(immature)
+		}
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(api.JsonStatus("fail")))
+			return
+		}
+		amount := &block.AmountResponse{Amount: total, Mature: mature, Immature: immature}
 		m, _ := json.Marshal(amount)
 
 		w.Header().Add("Content-Type", "application/json")
@@ -187,17 +404,247 @@ func (bcs *BlockchainServer) Amount(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, r *http.Request) {
+// Supply reports the coins in existence at the current height.
+func (bcs *BlockchainServer) Supply(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case http.MethodPut:
+	case http.MethodGet:
 		bc := bcs.GetBlockChain()
-		isResolved := bc.ResolveConflicts()
+		m, _ := json.Marshal(bc.Supply())
 
-		if isResolved {
-			io.WriteString(w, string(api.JsonStatus("success")))
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) UTXOs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		address := r.URL.Query().Get("blockchain_address")
+
+		bc := bcs.GetBlockChain()
+		utxos := &block.UTXOsResponse{UTXOs: bc.UTXOs(address)}
+		m, _ := json.Marshal(utxos)
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Blocks routes requests under /blocks/. Supported paths:
+//
+//	/blocks?offset=&limit=             active chain from the genesis block up
+//	/blocks/latest?offset=&limit=      active chain from the tip down
+//	/blocks/{height}                   block at a height of the active chain
+//	/blocks/{hash}                     block of the active chain by hash
+//	/blocks/{hash}/proof?tx={tx_hash}  merkle inclusion proof
+func (bcs *BlockchainServer) Blocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bc := bcs.GetBlockChain()
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/blocks"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" || path == "latest":
+		offset, limit, ok := pageParams(w, r)
+		if !ok {
+			return
+		}
+		var blocks *block.BlocksResponse
+		if path == "" {
+			blocks = bc.ChainBlocks(offset, limit)
 		} else {
-			io.WriteString(w, string(api.JsonStatus("fail")))
+			blocks = bc.LatestBlocks(offset, limit)
+		}
+		m, _ := json.Marshal(blocks)
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+		return
+	case len(parts) == 1:
+		bcs.Block(w, r, parts[0])
+		return
+	case len(parts) == 2 && parts[1] == "proof":
+		bcs.MerkleProof(w, r, parts[0])
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	io.WriteString(w, string(api.JsonStatus("not found")))
+}
+
+// Block returns the block of the active chain id names, by hash or by
+// height.
+func (bcs *BlockchainServer) Block(w http.ResponseWriter, r *http.Request, id string) {
+	bc := bcs.GetBlockChain()
+	var info *block.BlockInfoResponse
+	var found bool
+	if height, err := strconv.Atoi(id); err == nil && len(id) < 64 {
+		info, found = bc.BlockInfoAt(height)
+	} else {
+		hash, err := block.HashStrToHash(id)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("invalid block hash or height")))
+			return
 		}
+		info, found = bc.BlockInfo(hash)
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, string(api.JsonStatus("not found")))
+		return
+	}
+
+	m, _ := json.Marshal(info)
+	w.Header().Add("Content-Type", "application/json")
+	io.WriteString(w, string(m))
+}
+
+// Transaction returns the transaction /transactions/{hash} names, from the
+// active chain with its confirmations or from the mempool.
+func (bcs *BlockchainServer) Transaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hash, err := block.HashStrToHash(strings.TrimPrefix(r.URL.Path, "/transactions/"))
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(api.JsonStatus("invalid transaction hash")))
+		return
+	}
+	info, ok := bcs.GetBlockChain().TransactionInfo(hash)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, string(api.JsonStatus("not found")))
+		return
+	}
+
+	m, _ := json.Marshal(info)
+	w.Header().Add("Content-Type", "application/json")
+	io.WriteString(w, string(m))
+}
+
+// AddressHistory lists the transactions on the active chain of the address
+// /addresses/{address} names, newest first, a page at a time.
+func (bcs *BlockchainServer) AddressHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	address := strings.TrimPrefix(r.URL.Path, "/addresses/")
+	if _, err := blockchain_crypto.AddressVersion(address); err != nil {
+		log.Printf("Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(api.JsonStatus("invalid address")))
+		return
+	}
+	offset, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	m, _ := json.Marshal(bcs.GetBlockChain().AddressHistory(address, offset, limit))
+	w.Header().Add("Content-Type", "application/json")
+	io.WriteString(w, string(m))
+}
+
+// pageParams reads the ?offset= and ?limit= of an explorer listing, both
+// optional, answering the request itself if they are malformed.
+func pageParams(w http.ResponseWriter, r *http.Request) (offset, limit int, ok bool) {
+	q := r.URL.Query()
+	var err error
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("invalid offset")))
+			return 0, 0, false
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("invalid limit")))
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+func (bcs *BlockchainServer) MerkleProof(w http.ResponseWriter, r *http.Request, blockHashStr string) {
+	blockHash, err := block.HashStrToHash(blockHashStr)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(api.JsonStatus("invalid block hash")))
+		return
+	}
+	txHash, err := block.HashStrToHash(r.URL.Query().Get("tx"))
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(api.JsonStatus("invalid transaction hash")))
+		return
+	}
+
+	bc := bcs.GetBlockChain()
+	proof, err := bc.MerkleProof(blockHash, txHash)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, string(api.JsonStatus("not found")))
+		return
+	}
+
+	m, _ := json.Marshal(proof)
+	w.Header().Add("Content-Type", "application/json")
+	io.WriteString(w, string(m))
+}
+
+// AdminBans lists the bans in effect on GET, and on DELETE lifts the ban on
+// the host given by ?host=, or every ban without it. It only serves requests
+// from this machine.
+func (bcs *BlockchainServer) AdminBans(w http.ResponseWriter, r *http.Request) {
+	if !fromLoopback(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(api.JsonStatus("forbidden")))
+		return
+	}
+
+	bans := bcs.GetBlockChain().Node().BanManager()
+	switch r.Method {
+	case http.MethodGet:
+		m, _ := json.Marshal(&p2p.BansResponse{Bans: bans.Bans()})
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	case http.MethodDelete:
+		if host := r.URL.Query().Get("host"); host != "" {
+			if !bans.Unban(host) {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, string(api.JsonStatus("not found")))
+				return
+			}
+			log.Printf("action=Unban, host=%s", host)
+		} else {
+			log.Printf("action=ClearBans, bans=%d", bans.Clear())
+		}
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(api.JsonStatus("success")))
 	default:
 		log.Println("Error: Invalid HTTP Method")
 		w.WriteHeader(http.StatusBadRequest)
@@ -205,12 +652,68 @@ func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (bcs *BlockchainServer) Start() {
-	bcs.GetBlockChain().Run()
+	bc := bcs.GetBlockChain()
+	cfg := bcs.cfg
+	key, err := p2p.LoadNodeKey(filepath.Join(cfg.DataDir, "node.key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	book, err := p2p.NewAddrBook(filepath.Join(cfg.DataDir, "peers.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	node := p2p.NewNode(key, cfg.Params().Magic, cfg.P2PPort, bc)
+	node.SetAddrBook(book)
+	bans, err := p2p.NewBanManager(filepath.Join(cfg.DataDir, "banlist.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.SetBanManager(bans)
+	seeds := cfg.Seeds
+	if len(seeds) == 0 {
+		// Without seeds, look for other nodes of a development network on
+		// this machine, assuming they keep the same distance between their
+		// HTTP and P2P ports as this one.
+		offset := cfg.P2PPort - cfg.Port
+		seeds = p2p.LocalNeighbors(p2p.GetHost(), cfg.P2PPort, cfg.LocalIPStart, cfg.LocalIPEnd,
+			cfg.LocalPortStart+offset, cfg.LocalPortEnd+offset)
+	}
+	node.SetSeeds(seeds)
+	node.SetDialInterval(time.Second * time.Duration(cfg.DialIntervalSec))
+	bc.SetNode(node)
+	if err := node.Start(); err != nil {
+		log.Fatal(err)
+	}
+	node.StartDialer(cfg.MaxOutbound)
+
+	bc.Run()
+	if cfg.MiningWorkers > 0 {
+		bc.SetMiningWorkers(cfg.MiningWorkers)
+	}
+	miner, err := block.NewMiner(bc, time.Second*time.Duration(cfg.MiningIntervalSec))
+	if err != nil {
+		log.Fatal(err)
+	}
+	bcs.miner = miner
+	if cfg.Mining && !cfg.Params().MineOnDemand {
+		bcs.miner.Start()
+	}
 	http.HandleFunc("/chain", bcs.GetChain)
 	http.HandleFunc("/transactions", bcs.CreateTransaction)
+	http.HandleFunc("/transactions/", bcs.Transaction)
 	http.HandleFunc("/mine", bcs.Mine)
 	http.HandleFunc("/mine/start", bcs.StartMine)
+	http.HandleFunc("/mine/stop", bcs.StopMine)
+	http.HandleFunc("/mine/status", bcs.MineStatus)
+	http.HandleFunc("/mine/address", bcs.MineAddress)
+	http.HandleFunc("/mine/template", bcs.MineTemplate)
+	http.HandleFunc("/mine/submit", bcs.MineSubmit)
 	http.HandleFunc("/amount", bcs.Amount)
-	http.HandleFunc("/consensus", bcs.Consensus)
-	http.ListenAndServe(":"+strconv.Itoa(int(bcs.port)), nil)
+	http.HandleFunc("/utxos", bcs.UTXOs)
+	http.HandleFunc("/supply", bcs.Supply)
+	http.HandleFunc("/blocks", bcs.Blocks)
+	http.HandleFunc("/blocks/", bcs.Blocks)
+	http.HandleFunc("/addresses/", bcs.AddressHistory)
+	http.HandleFunc("/admin/bans", bcs.AdminBans)
+	http.ListenAndServe(":"+strconv.Itoa(int(bcs.Port())), nil)
 }
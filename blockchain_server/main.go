@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"goblockchain/config"
 	"log"
+	"os"
 )
 
 func init() {
@@ -10,8 +13,17 @@ func init() {
 }
 
 func main() {
-	port := flag.Uint("port", 5000, "TCP port number for Blockchain Server")
-	flag.Parse()
-	bcs := NewBlockchainServer(uint16(*port))
+	cfg, err := config.LoadBlockchainServerConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Log.Setup("BlockChain: "); err != nil {
+		log.Fatal(err)
+	}
+
+	bcs := NewBlockchainServer(cfg)
 	bcs.Start()
 }
@@ -0,0 +1,154 @@
+// Package chaincfg defines the networks a node can run on. Each network has
+// its own genesis block, consensus rules, address prefix, P2P magic and
+// default port, so nodes and wallets of different networks never mix.
+package chaincfg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Params are the parameters that set one network apart from another.
+type Params struct {
+	Name string
+	// Magic starts every P2P message, so peers of another network are
+	// dropped on their first message.
+	Magic uint32
+	// AddressVersion is the first byte of every address before base58
+	// encoding.
+	AddressVersion byte
+	// DefaultPort is the HTTP port of the blockchain server; the P2P port
+	// follows it at a fixed offset.
+	DefaultPort uint16
+
+	// GenesisTimestamp is the timestamp of the genesis block, in Unix
+	// nanoseconds like every block timestamp. The genesis block uses
+	// PowLimitBits and pays out GenesisAllocations, if there are any, in a
+	// single coinbase transaction.
+	GenesisTimestamp   int64
+	GenesisAllocations []GenesisAllocation
+	// CustomGenesis allows GenesisAllocations to be configured, which makes
+	// a new chain; only private networks allow it.
+	CustomGenesis bool
+
+	// PowLimitBits is the easiest target a block may use, in compact form.
+	PowLimitBits uint32
+	// Difficulty is retargeted every RetargetInterval blocks to aim at
+	// TargetBlockSec per block, by at most MaxRetargetFactor either way.
+	// With NoRetargeting every block uses PowLimitBits.
+	TargetBlockSec    int64
+	RetargetInterval  int
+	MaxRetargetFactor int64
+	NoRetargeting     bool
+
+	// The miner of each block is paid its fees and a subsidy that starts at
+	// InitialSubsidy and halves every HalvingInterval blocks. The subsidies
+	// stop once the coins in existence, counting the genesis allocations,
+	// reach MaxSupply; zero means no limit. Amounts are in the smallest
+	// unit of the coin, 1e-8 of it.
+	InitialSubsidy  int64
+	HalvingInterval int
+	MaxSupply       int64
+	// CoinbaseMaturity is the number of blocks after the one that created
+	// it before a coinbase output can be spent. The genesis allocations can
+	// be spent right away.
+	CoinbaseMaturity int
+
+	// MineOnDemand leaves mining to explicit requests instead of a timer.
+	MineOnDemand bool
+}
+
+// GenesisAllocation is an output of the genesis block.
+type GenesisAllocation struct {
+	Address string
+	// Amount is in the smallest unit of the coin, like InitialSubsidy.
+	Amount int64
+}
+
+// MainNetParams is the network nodes join by default.
+var MainNetParams = Params{
+	Name:           "mainnet",
+	Magic:          0x676f6263,
+	AddressVersion: 0x00,
+	DefaultPort:    5000,
+
+	GenesisTimestamp: 0,
+
+	PowLimitBits:      0x1f0fffff,
+	TargetBlockSec:    30,
+	RetargetInterval:  10,
+	MaxRetargetFactor: 4,
+
+	InitialSubsidy:   100_000_000,
+	HalvingInterval:  210_000,
+	MaxSupply:        420_000 * 100_000_000,
+	CoinbaseMaturity: 100,
+}
+
+// TestNetParams is a public network for trying things out with coins of no
+// value. Its rules are those of mainnet.
+var TestNetParams = Params{
+	Name:           "testnet",
+	Magic:          0x676f6274,
+	AddressVersion: 0x6f,
+	DefaultPort:    15000,
+
+	GenesisTimestamp: 1_704_067_200_000_000_000,
+
+	PowLimitBits:      0x1f0fffff,
+	TargetBlockSec:    30,
+	RetargetInterval:  10,
+	MaxRetargetFactor: 4,
+
+	InitialSubsidy:   100_000_000,
+	HalvingInterval:  210_000,
+	MaxSupply:        420_000 * 100_000_000,
+	CoinbaseMaturity: 100,
+}
+
+// RegTestParams is a private network for integration tests. Half of all
+// hashes meet its fixed target, so blocks are mined instantly, and only when
+// asked for.
+var RegTestParams = Params{
+	Name:           "regtest",
+	Magic:          0x676f6272,
+	AddressVersion: 0x6f,
+	DefaultPort:    25000,
+
+	GenesisTimestamp: 1_704_153_600_000_000_000,
+
+	PowLimitBits:      0x207fffff,
+	TargetBlockSec:    30,
+	RetargetInterval:  10,
+	MaxRetargetFactor: 4,
+	NoRetargeting:     true,
+
+	InitialSubsidy:   100_000_000,
+	HalvingInterval:  150,
+	MaxSupply:        21_000_000 * 100_000_000,
+	CoinbaseMaturity: 100,
+
+	MineOnDemand:  true,
+	CustomGenesis: true,
+}
+
+var networks = []*Params{&MainNetParams, &TestNetParams, &RegTestParams}
+
+// ByName returns the parameters of the network called name.
+func ByName(name string) (*Params, error) {
+	for _, p := range networks {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q, want one of %s", name, strings.Join(Names(), ", "))
+}
+
+// Names lists the known networks.
+func Names() []string {
+	names := make([]string, len(networks))
+	for i, p := range networks {
+		names[i] = p.Name
+	}
+	return names
+}
@@ -0,0 +1,40 @@
+package chaincfg
+
+import "testing"
+
+func TestByName(t *testing.T) {
+	for _, want := range networks {
+		got, err := ByName(want.Name)
+		if err != nil {
+			t.Fatalf("%s: %v", want.Name, err)
+		}
+		if got != want {
+			t.Errorf("ByName(%q) returned the parameters of %s", want.Name, got.Name)
+		}
+	}
+	for _, name := range []string{"", "Mainnet", "simnet"} {
+		if _, err := ByName(name); err == nil {
+			t.Errorf("ByName(%q) found a network", name)
+		}
+	}
+}
+
+// TestNetworksDistinct checks that no two networks share a magic or a
+// port, and that no address of a network without value is a mainnet one.
+func TestNetworksDistinct(t *testing.T) {
+	magics := make(map[uint32]string)
+	ports := make(map[uint16]string)
+	for _, p := range networks {
+		if other, ok := magics[p.Magic]; ok {
+			t.Errorf("%s and %s share the magic %x", p.Name, other, p.Magic)
+		}
+		if other, ok := ports[p.DefaultPort]; ok {
+			t.Errorf("%s and %s share the port %d", p.Name, other, p.DefaultPort)
+		}
+		if p != &MainNetParams && p.AddressVersion == MainNetParams.AddressVersion {
+			t.Errorf("%s addresses are mainnet addresses", p.Name)
+		}
+		magics[p.Magic] = p.Name
+		ports[p.DefaultPort] = p.Name
+	}
+}
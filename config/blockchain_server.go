@@ -0,0 +1,203 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
+	"goblockchain/p2p"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// DEFAULT_P2P_PORT_OFFSET puts the P2P port at a fixed distance from
+	// the HTTP port when it is not set.
+	DEFAULT_P2P_PORT_OFFSET = 1000
+	// DEFAULT_LOCAL_PORTS is how many HTTP ports from the network's default
+	// port local discovery scans when no range is set.
+	DEFAULT_LOCAL_PORTS = 4
+)
+
+// BlockchainServerConfig holds the settings of a blockchain node.
+type BlockchainServerConfig struct {
+	// Network picks the chain parameters; see chaincfg.
+	Network string `json:"network"`
+	// Port defaults to the network's default port.
+	Port uint16 `json:"port"`
+	// P2PPort defaults to Port + DEFAULT_P2P_PORT_OFFSET.
+	P2PPort uint16 `json:"p2p_port"`
+	// DataDir defaults to data/<port>, or data/<network>/<port> off mainnet.
+	DataDir string `json:"data_dir"`
+
+	Seeds           []string `json:"seeds"`
+	MaxOutbound     int      `json:"max_outbound"`
+	DialIntervalSec int      `json:"dial_interval_sec"`
+	// Without seeds, the node looks for peers on this machine, or on the
+	// addresses up to LocalIPEnd after its own, on the HTTP ports from
+	// LocalPortStart to LocalPortEnd shifted to their P2P ports. The port
+	// range defaults to DEFAULT_LOCAL_PORTS from the network's default port.
+	LocalIPStart   uint8  `json:"local_ip_start"`
+	LocalIPEnd     uint8  `json:"local_ip_end"`
+	LocalPortStart uint16 `json:"local_port_start"`
+	LocalPortEnd   uint16 `json:"local_port_end"`
+
+	// GenesisAllocations start a private chain of its own whose genesis
+	// block pays them out. Only networks with chaincfg.Params.CustomGenesis
+	// accept them, and every node of the chain needs the same list.
+	GenesisAllocations []GenesisAllocation `json:"genesis_allocations"`
+
+	// MinerAddress receives the block rewards; empty means a new wallet is
+	// created at startup. Mining is ignored on networks that only mine on
+	// demand. MiningWorkers is the number of goroutines the proof of work
+	// is split across; zero means one per CPU.
+	MinerAddress      string `json:"miner_address"`
+	Mining            bool   `json:"mining"`
+	MiningIntervalSec int    `json:"mining_interval_sec"`
+	MiningWorkers     int    `json:"mining_workers"`
+
+	Log LogConfig `json:"log"`
+
+	params *chaincfg.Params
+}
+
+// GenesisAllocation pays Amount to Address in the genesis block.
+type GenesisAllocation struct {
+	Address string       `json:"address"`
+	Amount  block.Amount `json:"amount"`
+}
+
+func DefaultBlockchainServerConfig() *BlockchainServerConfig {
+	return &BlockchainServerConfig{
+		Network:           chaincfg.MainNetParams.Name,
+		MaxOutbound:       p2p.DEFAULT_MAX_OUTBOUND,
+		DialIntervalSec:   p2p.DIAL_INTERVAL_SEC,
+		Mining:            true,
+		MiningIntervalSec: block.MINING_TIMER_SEC,
+		Log:               LogConfig{Level: "info"},
+	}
+}
+
+// LoadBlockchainServerConfig loads the config from the file named by
+// -config or BLOCKCHAIN_CONFIG, BLOCKCHAIN_* environment variables and the
+// flags in args, and fills in the settings derived from others.
+func LoadBlockchainServerConfig(args []string) (*BlockchainServerConfig, error) {
+	cfg := DefaultBlockchainServerConfig()
+	if err := load(cfg, "blockchain_server", "BLOCKCHAIN_", args, func(fs *flag.FlagSet, v interface{}) {
+		v.(*BlockchainServerConfig).bindFlags(fs)
+	}); err != nil {
+		return nil, err
+	}
+
+	params, err := chaincfg.ByName(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	if params, err = cfg.withGenesisAllocations(params); err != nil {
+		return nil, err
+	}
+	cfg.params = params
+	if cfg.Port == 0 {
+		cfg.Port = params.DefaultPort
+	}
+	if cfg.P2PPort == 0 {
+		cfg.P2PPort = cfg.Port + DEFAULT_P2P_PORT_OFFSET
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = filepath.Join("data", strconv.Itoa(int(cfg.Port)))
+		if params.Name != chaincfg.MainNetParams.Name {
+			cfg.DataDir = filepath.Join("data", params.Name, strconv.Itoa(int(cfg.Port)))
+		}
+	}
+	if cfg.LocalPortStart == 0 && cfg.LocalPortEnd == 0 {
+		cfg.LocalPortStart = params.DefaultPort
+		cfg.LocalPortEnd = params.DefaultPort + DEFAULT_LOCAL_PORTS - 1
+	}
+	return cfg, cfg.validate()
+}
+
+// Params returns the parameters of the configured network.
+func (c *BlockchainServerConfig) Params() *chaincfg.Params {
+	return c.params
+}
+
+// withGenesisAllocations returns a copy of params whose genesis block pays
+// out c.GenesisAllocations, or params itself if there are none.
+func (c *BlockchainServerConfig) withGenesisAllocations(params *chaincfg.Params) (*chaincfg.Params, error) {
+	if len(c.GenesisAllocations) == 0 {
+		return params, nil
+	}
+	if !params.CustomGenesis {
+		return nil, fmt.Errorf("genesis_allocations are not allowed on %s", params.Name)
+	}
+
+	p := *params
+	var total block.Amount
+	p.GenesisAllocations = make([]chaincfg.GenesisAllocation, len(c.GenesisAllocations))
+	for i, a := range c.GenesisAllocations {
+		version, err := blockchain_crypto.AddressVersion(a.Address)
+		if err != nil {
+			return nil, fmt.Errorf("genesis allocation %d: %w", i, err)
+		}
+		if version != params.AddressVersion {
+			return nil, fmt.Errorf("genesis allocation %d: %s is not a %s address", i, a.Address, params.Name)
+		}
+		if a.Amount <= 0 {
+			return nil, fmt.Errorf("genesis allocation %d: amount must be positive", i)
+		}
+		p.GenesisAllocations[i] = chaincfg.GenesisAllocation{Address: a.Address, Amount: int64(a.Amount)}
+		if total, err = total.Add(a.Amount); err != nil {
+			return nil, fmt.Errorf("genesis allocations: %w", err)
+		}
+	}
+	if p.MaxSupply > 0 && int64(total) > p.MaxSupply {
+		return nil, fmt.Errorf("genesis allocations of %s exceed the maximum supply of %s", total, block.Amount(p.MaxSupply))
+	}
+	return &p, nil
+}
+
+func (c *BlockchainServerConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Network, "network", c.Network, networkUsage)
+	fs.Var(uint16Value{&c.Port}, "port", "TCP port number for Blockchain Server (default: the network's port)")
+	fs.Var(uint16Value{&c.P2PPort}, "p2pport", "TCP port number for peer connections (default port+1000)")
+	fs.StringVar(&c.DataDir, "datadir", c.DataDir, "Directory for chain data (default data/<port>)")
+	fs.Var(stringList{&c.Seeds}, "seeds", "Comma-separated host:port P2P addresses to bootstrap from (default: scan this machine)")
+	fs.IntVar(&c.MaxOutbound, "maxoutbound", c.MaxOutbound, "Number of outbound peer connections to maintain")
+	fs.IntVar(&c.DialIntervalSec, "dialinterval", c.DialIntervalSec, "Seconds between attempts to fill outbound connections")
+	fs.StringVar(&c.MinerAddress, "mineraddress", c.MinerAddress, "Address to pay block rewards to (default: a new wallet)")
+	fs.BoolVar(&c.Mining, "mining", c.Mining, "Mine blocks automatically (never on regtest)")
+	fs.IntVar(&c.MiningIntervalSec, "mininginterval", c.MiningIntervalSec, "Seconds between mining attempts")
+	fs.IntVar(&c.MiningWorkers, "miningworkers", c.MiningWorkers, "Goroutines to split the proof of work across (default: one per CPU)")
+	c.Log.bindFlags(fs)
+}
+
+func (c *BlockchainServerConfig) validate() error {
+	switch {
+	case c.Port == 0:
+		return errors.New("port must be set")
+	case c.P2PPort == c.Port:
+		return errors.New("p2p_port must differ from port")
+	case c.MaxOutbound < 0:
+		return errors.New("max_outbound must not be negative")
+	case c.DialIntervalSec <= 0:
+		return errors.New("dial_interval_sec must be positive")
+	case c.MiningIntervalSec <= 0:
+		return errors.New("mining_interval_sec must be positive")
+	case c.MiningWorkers < 0:
+		return errors.New("mining_workers must not be negative")
+	case c.LocalIPStart > c.LocalIPEnd || c.LocalPortStart > c.LocalPortEnd:
+		return errors.New("local discovery ranges must not be empty")
+	}
+	if c.MinerAddress != "" {
+		version, err := blockchain_crypto.AddressVersion(c.MinerAddress)
+		if err != nil {
+			return fmt.Errorf("miner_address: %w", err)
+		}
+		if version != c.params.AddressVersion {
+			return fmt.Errorf("miner_address: %s is not a %s address", c.MinerAddress, c.params.Name)
+		}
+	}
+	return c.Log.validate()
+}
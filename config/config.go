@@ -0,0 +1,239 @@
+// Package config loads the settings of the servers. Every setting has a
+// default, which a JSON config file overrides, which environment variables
+// override, which command line flags override.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goblockchain/chaincfg"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var networkUsage = "Network to join, one of " + strings.Join(chaincfg.Names(), ", ")
+
+// LogConfig controls where log lines go and which of them are kept.
+type LogConfig struct {
+	// File is appended to; empty means standard error.
+	File string `json:"file"`
+	// Level is "info" for every line or "error" for errors only.
+	Level string `json:"level"`
+}
+
+func (c *LogConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "logfile", c.File, "File to append log lines to (default standard error)")
+	fs.StringVar(&c.Level, "loglevel", c.Level, `Log level, "info" or "error"`)
+}
+
+func (c *LogConfig) validate() error {
+	if c.Level != "info" && c.Level != "error" {
+		return fmt.Errorf("log level must be info or error, not %q", c.Level)
+	}
+	return nil
+}
+
+// Setup points the standard logger at the configured output with prefix.
+func (c *LogConfig) Setup(prefix string) error {
+	var w io.Writer = os.Stderr
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	if c.Level == "error" {
+		w = errorFilter{w}
+	}
+	log.SetOutput(w)
+	log.SetPrefix(prefix)
+	return nil
+}
+
+// errorFilter passes on only the log lines that report an error, which by
+// convention contain "Error".
+type errorFilter struct {
+	w io.Writer
+}
+
+func (f errorFilter) Write(p []byte) (int, error) {
+	if !bytes.Contains(p, []byte("Error")) {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// uint16Value is a flag holding a port number.
+type uint16Value struct {
+	p *uint16
+}
+
+func (u uint16Value) String() string {
+	if u.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*u.p))
+}
+
+func (u uint16Value) Set(v string) error {
+	n, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		return err
+	}
+	*u.p = uint16(n)
+	return nil
+}
+
+// stringList is a flag holding a comma-separated list.
+type stringList struct {
+	list *[]string
+}
+
+func (s stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s stringList) Set(v string) error {
+	*s.list = splitList(v)
+	return nil
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// load fills cfg, which holds the defaults, from the sources in order of
+// precedence. bind registers the flags on a flag set, pointing them at the
+// config they are given. The config file is named by the -config flag, or
+// by the environment variable envPrefix + "CONFIG".
+func load(cfg interface{}, name, envPrefix string, args []string, bind func(*flag.FlagSet, interface{})) error {
+	// The flags are parsed once to find the config file and a second time
+	// over the loaded config, so that they override it.
+	var path string
+	first := reflect.New(reflect.TypeOf(cfg).Elem()).Interface()
+	copyValue(first, cfg)
+	fs := newFlagSet(name, first, &path, bind)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return err
+	}
+
+	return newFlagSet(name, cfg, &path, bind).Parse(args)
+}
+
+func newFlagSet(name string, cfg interface{}, path *string, bind func(*flag.FlagSet, interface{})) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(path, "config", "", "JSON config file")
+	bind(fs, cfg)
+	return fs
+}
+
+func copyValue(dst, src interface{}) {
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
+// applyEnv sets every field of v that has an environment variable named
+// prefix plus the upper-cased JSON name of the field. Nested structs add
+// their own name to the prefix, so Log.Level is read from prefix+"LOG_LEVEL".
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint8, reflect.Uint16:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		// Lists of strings are comma-separated, other lists are JSON.
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(s), v.Addr().Interface())
+		}
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
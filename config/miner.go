@@ -0,0 +1,93 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"goblockchain/chaincfg"
+	"strconv"
+)
+
+const DEFAULT_MINER_POLL_SEC = 5
+
+// MinerConfig holds the settings of the standalone miner.
+type MinerConfig struct {
+	Network string `json:"network"`
+	// Gateway is the blockchain server the miner gets its work from and
+	// submits blocks to; it defaults to the network's default port on this
+	// machine.
+	Gateway string `json:"gateway"`
+	// Pool is the host:port of a pool's stratum server to mine for instead
+	// of the gateway; it then credits the shares to Address, which must be
+	// set.
+	Pool string `json:"pool"`
+	// Address receives the block rewards; empty means the gateway's miner
+	// address.
+	Address string `json:"address"`
+	// Workers is the number of goroutines the proof of work is split
+	// across; zero means one per CPU.
+	Workers int `json:"workers"`
+	// PollSec is how often the miner asks for a new template, to notice
+	// that another block has taken the tip.
+	PollSec int       `json:"poll_sec"`
+	Log     LogConfig `json:"log"`
+
+	params *chaincfg.Params
+}
+
+func DefaultMinerConfig() *MinerConfig {
+	return &MinerConfig{
+		Network: chaincfg.MainNetParams.Name,
+		PollSec: DEFAULT_MINER_POLL_SEC,
+		Log:     LogConfig{Level: "info"},
+	}
+}
+
+// Params returns the parameters of the configured network.
+func (c *MinerConfig) Params() *chaincfg.Params {
+	return c.params
+}
+
+// LoadMinerConfig loads the config from the file named by -config or
+// MINER_CONFIG, MINER_* environment variables and the flags in args.
+func LoadMinerConfig(args []string) (*MinerConfig, error) {
+	cfg := DefaultMinerConfig()
+	if err := load(cfg, "miner", "MINER_", args, func(fs *flag.FlagSet, v interface{}) {
+		v.(*MinerConfig).bindFlags(fs)
+	}); err != nil {
+		return nil, err
+	}
+
+	params, err := chaincfg.ByName(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	cfg.params = params
+	if cfg.Gateway == "" {
+		cfg.Gateway = "http://localhost:" + strconv.Itoa(int(params.DefaultPort))
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *MinerConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Network, "network", c.Network, networkUsage)
+	fs.StringVar(&c.Gateway, "gateway", c.Gateway, "Blockchain Gateway (default http://localhost:<network port>)")
+	fs.StringVar(&c.Pool, "pool", c.Pool, "Stratum host:port of a pool to mine for instead of the gateway")
+	fs.StringVar(&c.Address, "address", c.Address, "Address to pay block rewards to (default: the gateway's miner address)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "Goroutines to split the proof of work across (default: one per CPU)")
+	fs.IntVar(&c.PollSec, "poll", c.PollSec, "Seconds between checks for a new block template")
+	c.Log.bindFlags(fs)
+}
+
+func (c *MinerConfig) validate() error {
+	switch {
+	case c.Gateway == "":
+		return errors.New("gateway must be set")
+	case c.Pool != "" && c.Address == "":
+		return errors.New("address must be set to mine for a pool")
+	case c.Workers < 0:
+		return errors.New("workers must not be negative")
+	case c.PollSec <= 0:
+		return errors.New("poll_sec must be positive")
+	}
+	return c.Log.validate()
+}
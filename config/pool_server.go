@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"goblockchain/chaincfg"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	DEFAULT_POOL_PORT          = 8090
+	DEFAULT_POOL_STRATUM_PORT  = 3333
+	DEFAULT_POOL_SHARE_FACTOR  = 256
+	DEFAULT_POOL_FEE_PERCENT   = 1
+	DEFAULT_POOL_POLL_SEC      = 2
+	DEFAULT_POOL_JOB_AGE_SEC   = 30
+	DEFAULT_POOL_PAYOUT_SEC    = 10
+	DEFAULT_POOL_FEE_PER_BYTE  = 10
+	DEFAULT_POOL_DATA_DIR_NAME = "pool"
+)
+
+// PoolServerConfig holds the settings of a mining pool server.
+type PoolServerConfig struct {
+	Network string `json:"network"`
+	// Gateway is the blockchain server the pool gets block templates from
+	// and submits blocks and payouts to; it defaults to the network's
+	// default port on this machine.
+	Gateway string `json:"gateway"`
+	// Port serves the pool's statistics over HTTP, StratumPort the miners.
+	Port        uint16 `json:"port"`
+	StratumPort uint16 `json:"stratum_port"`
+	// DataDir keeps the key of the wallet the blocks pay before the pool
+	// pays its miners. It defaults to data/pool, or data/<network>/pool off
+	// mainnet.
+	DataDir string `json:"data_dir"`
+
+	// ShareFactor is how many times easier than the block target a share
+	// is to find.
+	ShareFactor int `json:"share_factor"`
+	// FeePercent of every block reward stays with the pool.
+	FeePercent float64 `json:"fee_percent"`
+	// PollSec is how often the pool asks the gateway for a new template,
+	// and JobAgeSec how old a job may get before the pool hands out a new
+	// one with the transactions that arrived since.
+	PollSec   int `json:"poll_sec"`
+	JobAgeSec int `json:"job_age_sec"`
+	// PayoutSec is how often the pool checks whether the rewards it owes
+	// its miners have matured.
+	PayoutSec int `json:"payout_sec"`
+	// FeePerByte, in base units, is the fee rate the pool's payouts pay so
+	// that they are mined ahead of cheaper transactions.
+	FeePerByte int `json:"fee_per_byte"`
+
+	Log LogConfig `json:"log"`
+
+	params *chaincfg.Params
+}
+
+func DefaultPoolServerConfig() *PoolServerConfig {
+	return &PoolServerConfig{
+		Network:     chaincfg.MainNetParams.Name,
+		Port:        DEFAULT_POOL_PORT,
+		StratumPort: DEFAULT_POOL_STRATUM_PORT,
+		ShareFactor: DEFAULT_POOL_SHARE_FACTOR,
+		FeePercent:  DEFAULT_POOL_FEE_PERCENT,
+		PollSec:     DEFAULT_POOL_POLL_SEC,
+		JobAgeSec:   DEFAULT_POOL_JOB_AGE_SEC,
+		PayoutSec:   DEFAULT_POOL_PAYOUT_SEC,
+		FeePerByte:  DEFAULT_POOL_FEE_PER_BYTE,
+		Log:         LogConfig{Level: "info"},
+	}
+}
+
+// Params returns the parameters of the configured network.
+func (c *PoolServerConfig) Params() *chaincfg.Params {
+	return c.params
+}
+
+// LoadPoolServerConfig loads the config from the file named by -config or
+// POOL_CONFIG, POOL_* environment variables and the flags in args.
+func LoadPoolServerConfig(args []string) (*PoolServerConfig, error) {
+	cfg := DefaultPoolServerConfig()
+	if err := load(cfg, "pool_server", "POOL_", args, func(fs *flag.FlagSet, v interface{}) {
+		v.(*PoolServerConfig).bindFlags(fs)
+	}); err != nil {
+		return nil, err
+	}
+
+	params, err := chaincfg.ByName(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	cfg.params = params
+	if cfg.Gateway == "" {
+		cfg.Gateway = "http://localhost:" + strconv.Itoa(int(params.DefaultPort))
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = filepath.Join("data", DEFAULT_POOL_DATA_DIR_NAME)
+		if params.Name != chaincfg.MainNetParams.Name {
+			cfg.DataDir = filepath.Join("data", params.Name, DEFAULT_POOL_DATA_DIR_NAME)
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *PoolServerConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Network, "network", c.Network, networkUsage)
+	fs.StringVar(&c.Gateway, "gateway", c.Gateway, "Blockchain Gateway (default http://localhost:<network port>)")
+	fs.Var(uint16Value{&c.Port}, "port", "TCP port number for the pool statistics")
+	fs.Var(uint16Value{&c.StratumPort}, "stratumport", "TCP port number for miners")
+	fs.StringVar(&c.DataDir, "datadir", c.DataDir, "Directory for the pool wallet (default data/pool)")
+	fs.IntVar(&c.ShareFactor, "sharefactor", c.ShareFactor, "How many times easier than a block a share is")
+	fs.Float64Var(&c.FeePercent, "fee", c.FeePercent, "Percentage of every block reward the pool keeps")
+	fs.IntVar(&c.PollSec, "poll", c.PollSec, "Seconds between checks for a new block template")
+	fs.IntVar(&c.JobAgeSec, "jobage", c.JobAgeSec, "Seconds before a job is replaced to pick up new transactions")
+	fs.IntVar(&c.PayoutSec, "payoutinterval", c.PayoutSec, "Seconds between attempts to send matured payouts")
+	fs.IntVar(&c.FeePerByte, "feeperbyte", c.FeePerByte, "Fee per byte, in base units, the payouts pay")
+	c.Log.bindFlags(fs)
+}
+
+func (c *PoolServerConfig) validate() error {
+	switch {
+	case c.Gateway == "":
+		return errors.New("gateway must be set")
+	case c.Port == 0 || c.StratumPort == 0:
+		return errors.New("port and stratum_port must be set")
+	case c.Port == c.StratumPort:
+		return errors.New("stratum_port must differ from port")
+	case c.ShareFactor < 1:
+		return errors.New("share_factor must be at least 1")
+	case c.FeePercent < 0 || c.FeePercent > 100:
+		return errors.New("fee_percent must be between 0 and 100")
+	case c.PollSec <= 0 || c.JobAgeSec <= 0 || c.PayoutSec <= 0:
+		return errors.New("poll_sec, job_age_sec and payout_sec must be positive")
+	case c.FeePerByte < 0:
+		return errors.New("fee_per_byte must not be negative")
+	}
+	return c.Log.validate()
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"goblockchain/chaincfg"
+	"strconv"
+)
+
+const DEFAULT_WALLET_PORT = 8080
+
+// WalletServerConfig holds the settings of a wallet server.
+type WalletServerConfig struct {
+	Port uint16 `json:"port"`
+	// Network decides the prefix of the addresses the wallet creates.
+	Network string `json:"network"`
+	// Gateway is the blockchain server the wallet server talks to; it
+	// defaults to the network's default port on this machine.
+	Gateway string    `json:"gateway"`
+	Log     LogConfig `json:"log"`
+
+	params *chaincfg.Params
+}
+
+func DefaultWalletServerConfig() *WalletServerConfig {
+	return &WalletServerConfig{
+		Port:    DEFAULT_WALLET_PORT,
+		Network: chaincfg.MainNetParams.Name,
+		Log:     LogConfig{Level: "info"},
+	}
+}
+
+// Params returns the parameters of the configured network.
+func (c *WalletServerConfig) Params() *chaincfg.Params {
+	return c.params
+}
+
+// LoadWalletServerConfig loads the config from the file named by -config
+// or WALLET_CONFIG, WALLET_* environment variables and the flags in args.
+func LoadWalletServerConfig(args []string) (*WalletServerConfig, error) {
+	cfg := DefaultWalletServerConfig()
+	if err := load(cfg, "wallet_server", "WALLET_", args, func(fs *flag.FlagSet, v interface{}) {
+		v.(*WalletServerConfig).bindFlags(fs)
+	}); err != nil {
+		return nil, err
+	}
+
+	params, err := chaincfg.ByName(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	cfg.params = params
+	if cfg.Gateway == "" {
+		cfg.Gateway = "http://localhost:" + strconv.Itoa(int(params.DefaultPort))
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *WalletServerConfig) bindFlags(fs *flag.FlagSet) {
+	fs.Var(uint16Value{&c.Port}, "port", "TCP port number for Wallet Server")
+	fs.StringVar(&c.Network, "network", c.Network, networkUsage)
+	fs.StringVar(&c.Gateway, "gateway", c.Gateway, "Blockchain Gateway (default http://localhost:<network port>)")
+	c.Log.bindFlags(fs)
+}
+
+func (c *WalletServerConfig) validate() error {
+	switch {
+	case c.Port == 0:
+		return errors.New("port must be set")
+	case c.Gateway == "":
+		return errors.New("gateway must be set")
+	}
+	return c.Log.validate()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"goblockchain/config"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	cfg, err := config.LoadMinerConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Log.Setup("Miner: "); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Pool != "" {
+		pm := NewPoolMiner(cfg.Pool, cfg.Address, cfg.Workers, time.Second*time.Duration(cfg.PollSec))
+		pm.Run()
+		return
+	}
+
+	m := NewMiner(cfg.Gateway, cfg.Address, cfg.Workers, time.Second*time.Duration(cfg.PollSec))
+	m.Run()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"goblockchain/block"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+)
+
+// Miner mines against a blockchain server: it takes a block template from
+// the gateway, solves it and submits the block, and starts over with a new
+// template as soon as the gateway's tip moves.
+type Miner struct {
+	gateway string
+	address string
+	workers int
+	poll    time.Duration
+	client  *http.Client
+}
+
+func NewMiner(gateway, address string, workers int, poll time.Duration) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{
+		gateway: gateway,
+		address: address,
+		workers: workers,
+		poll:    poll,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (m *Miner) Run() {
+	log.Printf("action=MinerStart, gateway=%s, workers=%d", m.gateway, m.workers)
+	for {
+		t, err := m.Template()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			time.Sleep(m.poll)
+			continue
+		}
+		b, err := t.Block()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			time.Sleep(m.poll)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go m.watch(ctx, cancel, t.PrevHash)
+		start := time.Now()
+		hashes, err := block.SolveBlock(ctx, b, m.workers)
+		cancel()
+		rate := float64(hashes) / time.Since(start).Seconds()
+		if err != nil {
+			log.Printf("action=Mining, status=stale, height=%d, hashrate=%.0f", t.Height, rate)
+			continue
+		}
+
+		status, err := m.Submit(b)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			continue
+		}
+		log.Printf("action=Mining, status=%s, height=%d, hash=%x, hashrate=%.0f", status, t.Height, b.Hash(), rate)
+	}
+}
+
+// watch cancels the search once the gateway's template builds on a block
+// other than prevHash.
+func (m *Miner) watch(ctx context.Context, cancel context.CancelFunc, prevHash string) {
+	ticker := time.NewTicker(m.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t, err := m.Template()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			continue
+		}
+		if t.PrevHash != prevHash {
+			cancel()
+			return
+		}
+	}
+}
+
+// Template asks the gateway for a block to mine.
+func (m *Miner) Template() (*block.BlockTemplateResponse, error) {
+	endpoint := fmt.Sprintf("%s/mine/template", m.gateway)
+	if m.address != "" {
+		endpoint += "?address=" + url.QueryEscape(m.address)
+	}
+	response, err := m.client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("gateway returned %s", response.Status)
+	}
+
+	var t block.BlockTemplateResponse
+	if err := json.NewDecoder(response.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Submit hands a solved block to the gateway and returns its verdict.
+func (m *Miner) Submit(b *block.Block) (string, error) {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	endpoint := fmt.Sprintf("%s/mine/submit", m.gateway)
+	response, err := m.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var status struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return "", fmt.Errorf("gateway returned %s", response.Status)
+	}
+	return status.Message, nil
+}
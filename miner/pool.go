@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"goblockchain/block"
+	"goblockchain/stratum"
+	"log"
+	"math/big"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolMiner mines for a pool over stratum: it searches the nonces of its
+// extranonce for each job the pool sends and submits every share it finds,
+// crediting them to its address.
+type PoolMiner struct {
+	pool    string
+	address string
+	workers int
+	retry   time.Duration
+}
+
+func NewPoolMiner(pool, address string, workers int, retry time.Duration) *PoolMiner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &PoolMiner{
+		pool:    pool,
+		address: address,
+		workers: workers,
+		retry:   retry,
+	}
+}
+
+// Run mines for the pool, connecting again whenever the connection is lost.
+func (m *PoolMiner) Run() {
+	log.Printf("action=MinerStart, pool=%s, address=%s, workers=%d", m.pool, m.address, m.workers)
+	for {
+		if err := m.mine(); err != nil {
+			log.Printf("Error: %v\n", err)
+		}
+		time.Sleep(m.retry)
+	}
+}
+
+func (m *PoolMiner) mine() error {
+	c, err := net.DialTimeout("tcp", m.pool, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn := stratum.NewConn(c)
+	defer conn.Close()
+
+	var nextID atomic.Uint64
+	call := func(method string, params ...interface{}) (*stratum.Message, error) {
+		id := nextID.Add(1)
+		req, err := stratum.NewRequest(&id, method, params...)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		// A job may come in ahead of the response; the pool sends it
+		// again once authorized.
+		res, err := conn.Read()
+		for err == nil && res.Method != "" {
+			res, err = conn.Read()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return res, nil
+	}
+
+	res, err := call(stratum.METHOD_SUBSCRIBE)
+	if err != nil {
+		return err
+	}
+	var sub stratum.SubscribeResult
+	if err := json.Unmarshal(res.Result, &sub); err != nil {
+		return err
+	}
+	if _, err := call(stratum.METHOD_AUTHORIZE, m.address); err != nil {
+		return err
+	}
+	log.Printf("action=PoolConnect, pool=%s, extranonce=%d", m.pool, sub.Extranonce)
+
+	// Every search ends with the connection, and each job ends the search
+	// of the one before.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	cancel := context.CancelFunc(func() {})
+	var current string
+	subs := &submissions{conn: conn, nextID: &nextID, jobs: make(map[uint64]string)}
+	var accepted, rejected uint64
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msg.Method == stratum.METHOD_NOTIFY:
+			job, err := stratum.ParseJob(msg)
+			if err != nil {
+				log.Printf("Error: %v\n", err)
+				continue
+			}
+			cancel()
+			jobCtx, jobCancel := context.WithCancel(ctx)
+			cancel, current = jobCancel, job.ID
+			log.Printf("action=NewJob, job=%s, clean=%t, accepted=%d, rejected=%d", job.ID, job.Clean, accepted, rejected)
+			go m.search(jobCtx, subs, sub.Extranonce, job)
+		case msg.ID != nil:
+			jobID := subs.done(*msg.ID)
+			if msg.Error == nil {
+				accepted++
+				continue
+			}
+			rejected++
+			log.Printf("action=Share, status=rejected, job=%s, reason=%s", jobID, msg.Error.Message)
+			// The pool has moved on; wait for its next job.
+			if msg.Error.Code == stratum.ERR_JOB_NOT_FOUND && jobID == current {
+				cancel()
+			}
+		}
+	}
+}
+
+// submissions sends shares to the pool and remembers the job of each one
+// until the pool answers.
+type submissions struct {
+	conn   *stratum.Conn
+	nextID *atomic.Uint64
+
+	mux  sync.Mutex
+	jobs map[uint64]string
+}
+
+func (s *submissions) submit(share *stratum.Share) error {
+	id := s.nextID.Add(1)
+	req, err := share.Request(id)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.jobs[id] = share.JobID
+	s.mux.Unlock()
+	return s.conn.Write(req)
+}
+
+// done returns the job of the share submitted with id, which the pool has
+// answered.
+func (s *submissions) done(id uint64) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	jobID := s.jobs[id]
+	delete(s.jobs, id)
+	return jobID
+}
+
+// search looks for shares of job in the nonces of extranonce until ctx is
+// done, submitting each one.
+func (m *PoolMiner) search(ctx context.Context, subs *submissions, extranonce uint32, job *stratum.Job) {
+	header, err := hex.DecodeString(job.Header)
+	if err != nil {
+		log.Printf("Error: job %s: %v\n", job.ID, err)
+		return
+	}
+	target, ok := new(big.Int).SetString(job.ShareTarget, 16)
+	if !ok {
+		log.Printf("Error: job %s: invalid share target %q\n", job.ID, job.ShareTarget)
+		return
+	}
+
+	_, err = block.SearchHeader(ctx, header, target, uint64(extranonce)<<32, 1<<32, m.workers, func(nonce uint64, timestamp int64) bool {
+		share := &stratum.Share{Worker: m.address, JobID: job.ID, Timestamp: timestamp, Nonce: nonce}
+		if err := subs.submit(share); err != nil {
+			log.Printf("Error: %v\n", err)
+			return false
+		}
+		return ctx.Err() == nil
+	})
+	if err != nil {
+		log.Printf("Error: job %s: %v\n", job.ID, err)
+	}
+}
@@ -0,0 +1,269 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ADDR_BOOK_MAX_SIZE = 2000
+	// ADDR_MAX_FAILURES consecutive failed dials drop an address that has
+	// never been connected to, or not within ADDR_FORGET_SEC.
+	ADDR_MAX_FAILURES = 10
+	ADDR_FORGET_SEC   = 7 * 24 * 60 * 60
+	// ADDR_RETRY_SEC is how long to wait before dialing an address again
+	// after a failure; it doubles with every further failure, up to
+	// ADDR_MAX_RETRY_SEC.
+	ADDR_RETRY_SEC     = 30
+	ADDR_MAX_RETRY_SEC = 60 * 60
+)
+
+// KnownAddress is what the address book remembers about a peer address.
+type KnownAddress struct {
+	Addr        string    `json:"addr"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	Failures    int       `json:"failures"`
+}
+
+// retryAt is the earliest time the address should be dialed again.
+func (ka *KnownAddress) retryAt() time.Time {
+	if ka.Failures == 0 {
+		return ka.LastAttempt
+	}
+	backoff := time.Second * ADDR_RETRY_SEC << (ka.Failures - 1)
+	if backoff > time.Second*ADDR_MAX_RETRY_SEC || backoff <= 0 {
+		backoff = time.Second * ADDR_MAX_RETRY_SEC
+	}
+	return ka.LastAttempt.Add(backoff)
+}
+
+// worse reports whether ka is a worse candidate to dial than other: it has
+// failed more often, or as often and was seen less recently.
+func (ka *KnownAddress) worse(other *KnownAddress) bool {
+	if ka.Failures != other.Failures {
+		return ka.Failures > other.Failures
+	}
+	return ka.LastSeen.Before(other.LastSeen)
+}
+
+// AddrBook keeps the addresses of peers this node has heard of or connected
+// to, with when they were last seen and how often dialing them failed. It is
+// saved to a JSON file so a restarted node does not depend on its seeds.
+type AddrBook struct {
+	path  string
+	addrs map[string]*KnownAddress
+	dirty bool
+	mux   sync.Mutex
+}
+
+// NewAddrBook loads the address book saved at path, or starts an empty one
+// if there is none.
+func NewAddrBook(path string) (*AddrBook, error) {
+	book := &AddrBook{path: path, addrs: make(map[string]*KnownAddress)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*KnownAddress
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		return nil, err
+	}
+	for _, ka := range addrs {
+		book.addrs[ka.Addr] = ka
+	}
+	return book, nil
+}
+
+// Add records that a peer is reachable at addr as of lastSeen. A full book
+// makes room by dropping its worst address, unless addr would be worse.
+func (book *AddrBook) Add(addr string, lastSeen time.Time) {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	if ka, ok := book.addrs[addr]; ok {
+		if lastSeen.After(ka.LastSeen) {
+			ka.LastSeen = lastSeen
+			book.dirty = true
+		}
+		return
+	}
+
+	ka := &KnownAddress{Addr: addr, LastSeen: lastSeen}
+	if len(book.addrs) >= ADDR_BOOK_MAX_SIZE {
+		var worst *KnownAddress
+		for _, other := range book.addrs {
+			if worst == nil || other.worse(worst) {
+				worst = other
+			}
+		}
+		if !worst.worse(ka) {
+			return
+		}
+		delete(book.addrs, worst.Addr)
+	}
+	book.addrs[addr] = ka
+	book.dirty = true
+}
+
+// Has reports whether addr is in the book.
+func (book *AddrBook) Has(addr string) bool {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	_, ok := book.addrs[addr]
+	return ok
+}
+
+func (book *AddrBook) Remove(addr string) {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	if _, ok := book.addrs[addr]; ok {
+		delete(book.addrs, addr)
+		book.dirty = true
+	}
+}
+
+// Attempt records that addr is being dialed.
+func (book *AddrBook) Attempt(addr string) {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	if ka, ok := book.addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+		book.dirty = true
+	}
+}
+
+// Good records a successful connection to addr.
+func (book *AddrBook) Good(addr string) {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	now := time.Now()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		book.addrs[addr] = ka
+	}
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Failures = 0
+	book.dirty = true
+}
+
+// Failed records a failed dial of addr, and forgets the address after
+// ADDR_MAX_FAILURES of them unless it worked recently.
+func (book *AddrBook) Failed(addr string) {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	ka, ok := book.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Failures++
+	if ka.Failures >= ADDR_MAX_FAILURES && time.Since(ka.LastSuccess) > time.Second*ADDR_FORGET_SEC {
+		delete(book.addrs, addr)
+	}
+	book.dirty = true
+}
+
+// Select returns up to n addresses to dial, best first, leaving out those in
+// exclude and those still waiting out their retry backoff.
+func (book *AddrBook) Select(n int, exclude map[string]bool) []string {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	now := time.Now()
+	var candidates []*KnownAddress
+	for _, ka := range book.addrs {
+		if !exclude[ka.Addr] && !now.Before(ka.retryAt()) {
+			candidates = append(candidates, ka)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[j].worse(candidates[i]) })
+
+	var addrs []string
+	for _, ka := range candidates {
+		if len(addrs) == n {
+			break
+		}
+		addrs = append(addrs, ka.Addr)
+	}
+	return addrs
+}
+
+// Sample returns up to n randomly chosen addresses that have not failed
+// since they were last seen, for sharing with peers.
+func (book *AddrBook) Sample(n int) []*KnownAddress {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	var addrs []*KnownAddress
+	for _, ka := range book.addrs {
+		if ka.Failures == 0 && !ka.LastSeen.IsZero() {
+			c := *ka
+			addrs = append(addrs, &c)
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+func (book *AddrBook) Len() int {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	return len(book.addrs)
+}
+
+// Save writes the book to its file if it changed since it was last saved.
+// The file is replaced in one rename, so a crash leaves either the old or
+// the new book.
+func (book *AddrBook) Save() error {
+	book.mux.Lock()
+	defer book.mux.Unlock()
+
+	if !book.dirty || book.path == "" {
+		return nil
+	}
+
+	addrs := make([]*KnownAddress, 0, len(book.addrs))
+	for _, ka := range book.addrs {
+		addrs = append(addrs, ka)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	data, err := json.MarshalIndent(addrs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(book.path), 0o755); err != nil {
+		return err
+	}
+	tmp := book.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, book.path); err != nil {
+		return err
+	}
+	book.dirty = false
+	return nil
+}
@@ -0,0 +1,222 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// BAN_THRESHOLD is the misbehavior score at which a host is banned for
+	// BAN_DURATION_SEC.
+	BAN_THRESHOLD    = 100
+	BAN_DURATION_SEC = 24 * 60 * 60
+	// MISBEHAVIOR_DECAY_SEC is how long a host has to behave for its score
+	// to be forgotten.
+	MISBEHAVIOR_DECAY_SEC = 60 * 60
+
+	MISBEHAVIOR_INVALID_BLOCK = 100
+	MISBEHAVIOR_MALFORMED     = 50
+	MISBEHAVIOR_PROTOCOL      = 20
+	MISBEHAVIOR_INVALID_TX    = 10
+)
+
+var ErrBanned = errors.New("host is banned")
+
+// Ban is an entry of the ban list.
+type Ban struct {
+	Host     string    `json:"host"`
+	Reason   string    `json:"reason"`
+	BannedAt time.Time `json:"banned_at"`
+	Until    time.Time `json:"until"`
+}
+
+type BansResponse struct {
+	Bans []*Ban `json:"bans"`
+}
+
+type misbehavior struct {
+	score   int
+	updated time.Time
+}
+
+// BanManager scores misbehavior by host and bans a host once its score
+// reaches BAN_THRESHOLD. Hosts rather than node IDs are scored and banned,
+// since a new node ID costs nothing. The bans are saved to a JSON file so
+// they outlast a restart.
+type BanManager struct {
+	path   string
+	scores map[string]*misbehavior
+	bans   map[string]*Ban
+	mux    sync.Mutex
+}
+
+// NewBanManager loads the bans saved at path, or starts with none if there
+// is no such file. An empty path keeps the bans in memory only.
+func NewBanManager(path string) (*BanManager, error) {
+	bm := &BanManager{
+		path:   path,
+		scores: make(map[string]*misbehavior),
+		bans:   make(map[string]*Ban),
+	}
+	if path == "" {
+		return bm, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	for _, b := range bans {
+		bm.bans[b.Host] = b
+	}
+	return bm, nil
+}
+
+// Misbehaving adds score to host's misbehavior score and bans the host if
+// that reaches BAN_THRESHOLD. It reports whether the host is now banned.
+func (bm *BanManager) Misbehaving(host string, score int, reason string) bool {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	now := time.Now()
+	m, ok := bm.scores[host]
+	if !ok || now.Sub(m.updated) >= time.Second*MISBEHAVIOR_DECAY_SEC {
+		m = &misbehavior{}
+		bm.scores[host] = m
+	}
+	m.score += score
+	m.updated = now
+	log.Printf("action=Misbehaving, host=%s, score=%d, total=%d, reason=%s", host, score, m.score, reason)
+
+	if m.score < BAN_THRESHOLD {
+		return false
+	}
+	delete(bm.scores, host)
+	bm.ban(host, time.Second*BAN_DURATION_SEC, reason)
+	return true
+}
+
+// Ban bans host for d.
+func (bm *BanManager) Ban(host string, d time.Duration, reason string) {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	bm.ban(host, d, reason)
+}
+
+func (bm *BanManager) ban(host string, d time.Duration, reason string) {
+	now := time.Now()
+	bm.bans[host] = &Ban{Host: host, Reason: reason, BannedAt: now, Until: now.Add(d)}
+	log.Printf("action=Ban, host=%s, until=%s, reason=%s", host, now.Add(d).Format(time.RFC3339), reason)
+	bm.save()
+}
+
+func (bm *BanManager) IsBanned(host string) bool {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	b, ok := bm.bans[host]
+	if ok && time.Now().After(b.Until) {
+		delete(bm.bans, host)
+		bm.save()
+		return false
+	}
+	return ok
+}
+
+// Unban lifts the ban on host and reports whether there was one.
+func (bm *BanManager) Unban(host string) bool {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	if _, ok := bm.bans[host]; !ok {
+		return false
+	}
+	delete(bm.bans, host)
+	bm.save()
+	return true
+}
+
+// Clear lifts every ban and returns how many there were.
+func (bm *BanManager) Clear() int {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	n := len(bm.bans)
+	bm.bans = make(map[string]*Ban)
+	bm.save()
+	return n
+}
+
+// Bans lists the bans in effect, sorted by host.
+func (bm *BanManager) Bans() []*Ban {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	now := time.Now()
+	bans := make([]*Ban, 0, len(bm.bans))
+	for _, b := range bm.bans {
+		if now.Before(b.Until) {
+			c := *b
+			bans = append(bans, &c)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Host < bans[j].Host })
+	return bans
+}
+
+// save writes the bans in effect to the ban file, dropping expired ones.
+// bm.mux must be held.
+func (bm *BanManager) save() {
+	if bm.path == "" {
+		return
+	}
+
+	now := time.Now()
+	bans := make([]*Ban, 0, len(bm.bans))
+	for host, b := range bm.bans {
+		if now.After(b.Until) {
+			delete(bm.bans, host)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Host < bans[j].Host })
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(bm.path), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(bm.path+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(bm.path+".tmp", bm.path)
+	}
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+// HostOf returns the host part of addr, or addr itself if it has no port.
+func HostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
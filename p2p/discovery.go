@@ -0,0 +1,259 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_OUTBOUND = 8
+	DIAL_INTERVAL_SEC    = 10
+	// ADDR_RELAY_MAX is the size of the largest addr message whose new
+	// addresses are passed on, to ADDR_RELAY_PEERS random peers. Larger
+	// messages are answers to getaddr and stay with the node that asked.
+	ADDR_RELAY_MAX   = 10
+	ADDR_RELAY_PEERS = 2
+)
+
+// SetAddrBook replaces the node's in-memory address book with book, which
+// is typically loaded from disk.
+func (n *Node) SetAddrBook(book *AddrBook) {
+	n.addrBook = book
+}
+
+func (n *Node) AddrBook() *AddrBook {
+	return n.addrBook
+}
+
+// SetSeeds sets the addresses dialed when the address book has nothing
+// better to offer.
+func (n *Node) SetSeeds(seeds []string) {
+	n.seeds = seeds
+}
+
+// SetDialInterval sets how often the dialer tops up outbound connections. It
+// must be called before StartDialer.
+func (n *Node) SetDialInterval(d time.Duration) {
+	n.dialInterval = d
+}
+
+// StartDialer keeps up to target outbound connections open, dialing
+// addresses from the address book, and saves the book as it changes.
+func (n *Node) StartDialer(target int) {
+	n.mux.Lock()
+	n.targetOutbound = target
+	n.mux.Unlock()
+
+	n.maintainPeers()
+}
+
+func (n *Node) maintainPeers() {
+	select {
+	case <-n.quit:
+		return
+	default:
+	}
+
+	n.fillOutbound()
+	if err := n.addrBook.Save(); err != nil {
+		log.Printf("Error: %v\n", err)
+	}
+	time.AfterFunc(n.dialInterval, n.maintainPeers)
+}
+
+// fillOutbound dials as many addresses as there are outbound slots free,
+// falling back to the seeds when the book runs out of candidates.
+func (n *Node) fillOutbound() {
+	n.mux.Lock()
+	need := n.targetOutbound - len(n.dialing)
+	exclude := make(map[string]bool)
+	for addr := range n.dialing {
+		exclude[addr] = true
+	}
+	for addr := range n.selfAddrs {
+		exclude[addr] = true
+	}
+	for _, p := range n.peers {
+		if !p.inbound {
+			need--
+		}
+		exclude[p.ListenAddr()] = true
+	}
+	n.mux.Unlock()
+	if need <= 0 {
+		return
+	}
+
+	addrs := n.addrBook.Select(need, exclude)
+	if len(addrs) < need {
+		for _, seed := range n.seeds {
+			if !exclude[seed] && !n.addrBook.Has(seed) {
+				n.addrBook.Add(seed, time.Time{})
+			}
+		}
+		addrs = n.addrBook.Select(need, exclude)
+	}
+
+	for _, addr := range addrs {
+		n.mux.Lock()
+		n.dialing[addr] = true
+		n.mux.Unlock()
+		go n.dial(addr)
+	}
+}
+
+func (n *Node) dial(addr string) {
+	defer func() {
+		n.mux.Lock()
+		delete(n.dialing, addr)
+		n.mux.Unlock()
+	}()
+
+	n.addrBook.Attempt(addr)
+	err := n.Connect(addr)
+	switch {
+	case err == nil, errors.Is(err, ErrPeerConnected), errors.Is(err, ErrBanned):
+	case errors.Is(err, ErrGenesisMismatch):
+		// A node of another chain is no use to us, however often we try.
+		n.addrBook.Remove(addr)
+	case errors.Is(err, ErrSelfConnect):
+		n.addrBook.Remove(addr)
+		n.mux.Lock()
+		n.selfAddrs[addr] = true
+		n.mux.Unlock()
+	default:
+		n.addrBook.Failed(addr)
+	}
+}
+
+// handleGetAddr answers with a sample of the address book.
+func (n *Node) handleGetAddr(p *Peer) {
+	m := &AddrMessage{}
+	for _, ka := range n.addrBook.Sample(MAX_ADDR_PER_MESSAGE) {
+		if a, ok := parseNetAddress(ka.Addr, ka.LastSeen); ok {
+			m.Addrs = append(m.Addrs, a)
+		}
+	}
+	p.Send(NewMessage(MsgAddr, m.Encode()))
+}
+
+// handleAddr adds the addresses p shares to the address book and relays the
+// new ones if there are few of them.
+func (n *Node) handleAddr(p *Peer, msg *Message) error {
+	m, err := DecodeAddrMessage(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var fresh []NetAddress
+	for _, a := range m.Addrs {
+		if a.Port == 0 || a.IP.IsUnspecified() || n.bans.IsBanned(a.IP.String()) {
+			continue
+		}
+		addr := a.String()
+		n.mux.Lock()
+		self := n.selfAddrs[addr]
+		n.mux.Unlock()
+		if self {
+			continue
+		}
+		if a.LastSeen.After(now) {
+			a.LastSeen = now
+		}
+		if !n.addrBook.Has(addr) {
+			fresh = append(fresh, a)
+		}
+		n.addrBook.Add(addr, a.LastSeen)
+	}
+
+	if len(fresh) > 0 && len(m.Addrs) <= ADDR_RELAY_MAX {
+		n.relayAddrs(fresh, p)
+	}
+	return nil
+}
+
+func (n *Node) relayAddrs(addrs []NetAddress, from *Peer) {
+	var peers []*Peer
+	for _, p := range n.Peers() {
+		if p != from {
+			peers = append(peers, p)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > ADDR_RELAY_PEERS {
+		peers = peers[:ADDR_RELAY_PEERS]
+	}
+
+	msg := NewMessage(MsgAddr, (&AddrMessage{Addrs: addrs}).Encode())
+	for _, p := range peers {
+		p.Send(msg)
+	}
+}
+
+// parseNetAddress converts an "ip:port" address for an addr message. Host
+// names, as seeds may use, cannot be shared.
+func parseNetAddress(addr string, lastSeen time.Time) (NetAddress, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return NetAddress{}, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return NetAddress{}, false
+	}
+	return NetAddress{IP: ip, Port: uint16(port), LastSeen: lastSeen}, true
+}
+
+var pattern = regexp.MustCompile(`^(((25[0-5]|2[0-4][0-9]|[10]?[0-9]?[0-9])\.){3})(25[0-5]|2[0-4][0-9]|[10]?[0-9]?[0-9])$`)
+
+// LocalNeighbors lists the addresses from ipStart to ipEnd after myHost on
+// the ports from portStart to portEnd, other than myHost:myPort. They serve
+// as seeds for a development network on one machine.
+func LocalNeighbors(myHost string, myPort uint16, ipStart, ipEnd uint8, portStart, portEnd uint16) []string {
+	myAddress := fmt.Sprintf("%s:%d", myHost, myPort)
+
+	m := pattern.FindStringSubmatch(myHost)
+	if m == nil {
+		log.Printf("Error: no neighbors for host %s, which is not an IPv4 address\n", myHost)
+		return nil
+	}
+
+	prefixHost := m[1]
+	lastIp, _ := strconv.Atoi(m[len(m)-1])
+	var neighbors = make([]string, 0)
+
+	for ip := ipStart; ip <= ipEnd; ip++ {
+		for port := portStart; port <= portEnd; port++ {
+			host := fmt.Sprintf("%s%d", prefixHost, lastIp+int(ip))
+			target := fmt.Sprintf("%s:%d", host, port)
+
+			if myAddress != target {
+				neighbors = append(neighbors, target)
+			}
+		}
+	}
+
+	return neighbors
+}
+
+func GetHost() string {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "127.0.0.1"
+	}
+
+	address, err := net.LookupHost(hostName)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	return address[len(address)-1]
+}
@@ -0,0 +1,450 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	PROTOCOL_VERSION        uint32 = 4
+	MAX_MESSAGE_SIZE               = 32 << 20
+	MAX_INV_ITEMS                  = 50_000
+	MAX_LOCATOR_HASHES             = 101
+	MAX_HEADERS_PER_MESSAGE        = 2000
+	MAX_ADDR_PER_MESSAGE           = 1000
+
+	messageHeaderSize = 13
+)
+
+var ErrMalformedMessage = errors.New("malformed message")
+
+type MessageType uint8
+
+const (
+	MsgVersion MessageType = iota + 1
+	MsgVerAck
+	MsgPing
+	MsgPong
+	MsgInv
+	MsgGetData
+	MsgGetHeaders
+	MsgHeaders
+	MsgBlock
+	MsgTx
+	MsgGetAddr
+	MsgAddr
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgVersion:
+		return "version"
+	case MsgVerAck:
+		return "verack"
+	case MsgPing:
+		return "ping"
+	case MsgPong:
+		return "pong"
+	case MsgInv:
+		return "inv"
+	case MsgGetData:
+		return "getdata"
+	case MsgGetHeaders:
+		return "getheaders"
+	case MsgHeaders:
+		return "headers"
+	case MsgBlock:
+		return "block"
+	case MsgTx:
+		return "tx"
+	case MsgGetAddr:
+		return "getaddr"
+	case MsgAddr:
+		return "addr"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// Message is a single frame on a peer connection. Blocks and transactions
+// travel as their canonical encoding; the other types have their own
+// payload structs below.
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+func NewMessage(t MessageType, payload []byte) *Message {
+	return &Message{Type: t, Payload: payload}
+}
+
+// WriteMessage frames msg as
+//
+//	magic uint32, type uint8, length uint32, checksum [4], payload
+//
+// where checksum is the start of the payload's SHA-256 hash and magic
+// identifies the network.
+func WriteMessage(w io.Writer, magic uint32, msg *Message) error {
+	frame, err := encodeMessage(magic, msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+func encodeMessage(magic uint32, msg *Message) ([]byte, error) {
+	if len(msg.Payload) > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("%s message of %d bytes exceeds the limit", msg.Type, len(msg.Payload))
+	}
+
+	frame := make([]byte, messageHeaderSize, messageHeaderSize+len(msg.Payload))
+	binary.BigEndian.PutUint32(frame[0:4], magic)
+	frame[4] = byte(msg.Type)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(msg.Payload)))
+	sum := sha256.Sum256(msg.Payload)
+	copy(frame[9:13], sum[:4])
+	return append(frame, msg.Payload...), nil
+}
+
+// ReadMessage reads a message framed by WriteMessage, which has to carry
+// magic.
+func ReadMessage(r io.Reader, magic uint32) (*Message, error) {
+	var header [messageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if m := binary.BigEndian.Uint32(header[0:4]); m != magic {
+		return nil, fmt.Errorf("%w: bad magic %08x", ErrMalformedMessage, m)
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("%w: %d byte payload exceeds the limit", ErrMalformedMessage, length)
+	}
+
+	// The buffer grows as the payload arrives rather than being allocated
+	// at the announced length, so a peer cannot make the node set aside
+	// MAX_MESSAGE_SIZE without sending that much.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload := buf.Bytes()
+	sum := sha256.Sum256(payload)
+	if string(sum[:4]) != string(header[9:13]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrMalformedMessage)
+	}
+
+	return &Message{Type: MessageType(header[4]), Payload: payload}, nil
+}
+
+// payloadReader decodes the fixed-size fields of a payload. The first
+// short read sticks, so a sequence of reads can be checked once at the end.
+type payloadReader struct {
+	data []byte
+	err  error
+}
+
+func (r *payloadReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = fmt.Errorf("%w: unexpected end of payload", ErrMalformedMessage)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *payloadReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *payloadReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *payloadReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *payloadReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *payloadReader) hash() [32]byte {
+	var h [32]byte
+	copy(h[:], r.next(32))
+	return h
+}
+
+func (r *payloadReader) bytes(n int) []byte {
+	return append([]byte(nil), r.next(n)...)
+}
+
+// count reads a uint32 item count and rejects it if it exceeds max.
+func (r *payloadReader) count(max int) int {
+	n := r.uint32()
+	if r.err == nil && n > uint32(max) {
+		r.err = fmt.Errorf("%w: %d items exceed the limit of %d", ErrMalformedMessage, n, max)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *payloadReader) end() error {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(r.data))
+	}
+	return r.err
+}
+
+// VersionMessage opens the handshake. Challenge is a random value the peer
+// has to sign with the key behind its own NodeID, along with its
+// SessionKey, an ephemeral X25519 public key the session is derived from.
+type VersionMessage struct {
+	Version     uint32
+	NodeID      NodeID
+	Challenge   [32]byte
+	SessionKey  [32]byte
+	ListenPort  uint16
+	GenesisHash [32]byte
+	TipHash     [32]byte
+	Height      uint64
+}
+
+func (m *VersionMessage) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, m.Version)
+	b = append(b, m.NodeID[:]...)
+	b = append(b, m.Challenge[:]...)
+	b = append(b, m.SessionKey[:]...)
+	b = binary.BigEndian.AppendUint16(b, m.ListenPort)
+	b = append(b, m.GenesisHash[:]...)
+	b = append(b, m.TipHash[:]...)
+	return binary.BigEndian.AppendUint64(b, m.Height)
+}
+
+func DecodeVersionMessage(data []byte) (*VersionMessage, error) {
+	r := payloadReader{data: data}
+	m := &VersionMessage{
+		Version:     r.uint32(),
+		NodeID:      r.hash(),
+		Challenge:   r.hash(),
+		SessionKey:  r.hash(),
+		ListenPort:  r.uint16(),
+		GenesisHash: r.hash(),
+		TipHash:     r.hash(),
+		Height:      r.uint64(),
+	}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VerAckMessage completes the handshake with a signature over the
+// challenge from the peer's VersionMessage and the sender's session key.
+type VerAckMessage struct {
+	Signature []byte
+}
+
+func (m *VerAckMessage) Encode() []byte {
+	return append([]byte(nil), m.Signature...)
+}
+
+func DecodeVerAckMessage(data []byte) (*VerAckMessage, error) {
+	r := payloadReader{data: data}
+	m := &VerAckMessage{Signature: r.bytes(len(data))}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PingMessage is used for both ping and pong; a pong echoes the nonce.
+type PingMessage struct {
+	Nonce uint64
+}
+
+func (m *PingMessage) Encode() []byte {
+	return binary.BigEndian.AppendUint64(nil, m.Nonce)
+}
+
+func DecodePingMessage(data []byte) (*PingMessage, error) {
+	r := payloadReader{data: data}
+	m := &PingMessage{Nonce: r.uint64()}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type InvType uint8
+
+const (
+	InvTx InvType = iota + 1
+	InvBlock
+)
+
+type InvItem struct {
+	Type InvType
+	Hash [32]byte
+}
+
+// InvMessage announces blocks and transactions in an inv message, and asks
+// for them in a getdata message.
+type InvMessage struct {
+	Items []InvItem
+}
+
+func (m *InvMessage) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m.Items)))
+	for _, item := range m.Items {
+		b = append(b, byte(item.Type))
+		b = append(b, item.Hash[:]...)
+	}
+	return b
+}
+
+func DecodeInvMessage(data []byte) (*InvMessage, error) {
+	r := payloadReader{data: data}
+	n := r.count(MAX_INV_ITEMS)
+	m := &InvMessage{Items: make([]InvItem, 0, n)}
+	for i := 0; i < n && r.err == nil; i++ {
+		m.Items = append(m.Items, InvItem{Type: InvType(r.uint8()), Hash: r.hash()})
+	}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetHeadersMessage asks for the headers of the blocks that follow the
+// first hash in Locator the peer has on its active chain, up to Stop or
+// MAX_HEADERS_PER_MESSAGE. A zero Stop asks for as many as the peer will
+// send.
+type GetHeadersMessage struct {
+	Locator [][32]byte
+	Stop    [32]byte
+}
+
+func (m *GetHeadersMessage) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m.Locator)))
+	for _, h := range m.Locator {
+		b = append(b, h[:]...)
+	}
+	return append(b, m.Stop[:]...)
+}
+
+func DecodeGetHeadersMessage(data []byte) (*GetHeadersMessage, error) {
+	r := payloadReader{data: data}
+	n := r.count(MAX_LOCATOR_HASHES)
+	m := &GetHeadersMessage{Locator: make([][32]byte, 0, n)}
+	for i := 0; i < n && r.err == nil; i++ {
+		m.Locator = append(m.Locator, r.hash())
+	}
+	m.Stop = r.hash()
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// HeadersMessage carries block headers in their canonical encoding, parent
+// before child. It answers a getheaders message and also announces a newly
+// accepted block.
+type HeadersMessage struct {
+	Headers [][]byte
+}
+
+func (m *HeadersMessage) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m.Headers)))
+	for _, h := range m.Headers {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(h)))
+		b = append(b, h...)
+	}
+	return b
+}
+
+func DecodeHeadersMessage(data []byte) (*HeadersMessage, error) {
+	r := payloadReader{data: data}
+	n := r.count(MAX_HEADERS_PER_MESSAGE)
+	m := &HeadersMessage{Headers: make([][]byte, 0, n)}
+	for i := 0; i < n && r.err == nil; i++ {
+		m.Headers = append(m.Headers, r.bytes(int(r.uint16())))
+	}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NetAddress is a peer's listening address as shared in an addr message,
+// with when it was last seen.
+type NetAddress struct {
+	IP       net.IP
+	Port     uint16
+	LastSeen time.Time
+}
+
+func (a *NetAddress) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
+
+// AddrMessage shares known peer addresses, in reply to a getaddr message or
+// to relay addresses a node has just learned. getaddr has no payload.
+type AddrMessage struct {
+	Addrs []NetAddress
+}
+
+func (m *AddrMessage) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m.Addrs)))
+	for _, a := range m.Addrs {
+		b = append(b, a.IP.To16()...)
+		b = binary.BigEndian.AppendUint16(b, a.Port)
+		b = binary.BigEndian.AppendUint64(b, uint64(a.LastSeen.Unix()))
+	}
+	return b
+}
+
+func DecodeAddrMessage(data []byte) (*AddrMessage, error) {
+	r := payloadReader{data: data}
+	n := r.count(MAX_ADDR_PER_MESSAGE)
+	m := &AddrMessage{Addrs: make([]NetAddress, 0, n)}
+	for i := 0; i < n && r.err == nil; i++ {
+		m.Addrs = append(m.Addrs, NetAddress{
+			IP:       net.IP(r.bytes(net.IPv6len)),
+			Port:     r.uint16(),
+			LastSeen: time.Unix(int64(r.uint64()), 0),
+		})
+	}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
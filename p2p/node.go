@@ -0,0 +1,406 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrSelfConnect   = errors.New("connected to self")
+	ErrPeerConnected = errors.New("peer is already connected")
+	// ErrGenesisMismatch means the other side follows a chain that starts
+	// from a different genesis block, which can never sync with ours.
+	ErrGenesisMismatch = errors.New("genesis block does not match")
+)
+
+// Handler is what a Node hands its peers' messages to. Ping, pong, address
+// gossip and the handshake are dealt with by the Node itself.
+type Handler interface {
+	// ChainTip reports the tip announced in the handshake.
+	ChainTip() (hash [32]byte, height uint64)
+	// GenesisHash identifies the chain; peers must share it.
+	GenesisHash() [32]byte
+	// PeerConnected is called once the handshake with p has succeeded.
+	PeerConnected(p *Peer)
+	// HandleMessage is called from p's read loop for every other message,
+	// so messages from one peer are handled in order.
+	HandleMessage(p *Peer, msg *Message)
+	// PeerDisconnected is called once p's connection has been closed.
+	PeerDisconnected(p *Peer)
+}
+
+// Node accepts and dials peer connections. Every connection starts with a
+// handshake in which both sides prove they hold the private key for their
+// NodeID and agree on a session key that authenticates every message after
+// it, so a peer cannot claim another node's identity, at connect time or by
+// taking over the connection later. The addresses of
+// other nodes are learned from peers and kept in an address book.
+type Node struct {
+	key        ed25519.PrivateKey
+	id         NodeID
+	magic      uint32
+	listenPort uint16
+	handler    Handler
+	listener   net.Listener
+	addrBook   *AddrBook
+	bans       *BanManager
+	seeds      []string
+	quit       chan struct{}
+	closeOnce  sync.Once
+
+	peers          map[NodeID]*Peer
+	targetOutbound int
+	// dialing holds the addresses being dialed, and selfAddrs those that
+	// turned out to be this node.
+	dialing   map[string]bool
+	selfAddrs map[string]bool
+	// dialInterval is how often the dialer tops up outbound connections.
+	dialInterval time.Duration
+	mux          sync.Mutex
+}
+
+// NewNode returns a node of the network identified by magic, with an empty
+// address book and ban list that are not saved; see SetAddrBook and
+// SetBanManager.
+func NewNode(key ed25519.PrivateKey, magic uint32, listenPort uint16, handler Handler) *Node {
+	bans, _ := NewBanManager("")
+	n := &Node{
+		key:        key,
+		magic:      magic,
+		listenPort: listenPort,
+		handler:    handler,
+		addrBook:   &AddrBook{addrs: make(map[string]*KnownAddress)},
+		bans:       bans,
+		quit:       make(chan struct{}),
+		peers:      make(map[NodeID]*Peer),
+		dialing:    make(map[string]bool),
+		selfAddrs:  make(map[string]bool),
+
+		dialInterval: time.Second * DIAL_INTERVAL_SEC,
+	}
+	copy(n.id[:], key.Public().(ed25519.PublicKey))
+	return n
+}
+
+func (n *Node) ID() NodeID {
+	return n.id
+}
+
+func (n *Node) ListenPort() uint16 {
+	return n.listenPort
+}
+
+// Start listens for inbound peers in the background.
+func (n *Node) Start() error {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(int(n.listenPort)))
+	if err != nil {
+		return err
+	}
+	n.listener = l
+	log.Printf("action=P2PListen, port=%d, node=%s", n.listenPort, n.id)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Error: %v\n", err)
+				}
+				return
+			}
+			if n.bans.IsBanned(HostOf(conn.RemoteAddr().String())) {
+				conn.Close()
+				continue
+			}
+			go n.setupPeer(conn, true)
+		}
+	}()
+
+	return nil
+}
+
+// Connect dials addr and completes the handshake, unless a peer listening
+// on addr is already connected or its host is banned.
+func (n *Node) Connect(addr string) error {
+	if n.bans.IsBanned(HostOf(addr)) {
+		return ErrBanned
+	}
+	for _, p := range n.Peers() {
+		if p.ListenAddr() == addr {
+			return nil
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second*HANDSHAKE_TIMEOUT_SEC)
+	if err != nil {
+		return err
+	}
+	if err := n.setupPeer(conn, false); err != nil {
+		return err
+	}
+	n.addrBook.Good(addr)
+	return nil
+}
+
+func (n *Node) setupPeer(conn net.Conn, inbound bool) error {
+	version, s, err := n.handshake(conn)
+	if err != nil {
+		conn.Close()
+		// Neighbor discovery probes the port without handshaking.
+		if !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
+			log.Printf("action=Handshake, status=fail, addr=%s, err=%v", conn.RemoteAddr(), err)
+		}
+		return err
+	}
+
+	p := newPeer(n, conn, version, s, inbound)
+	if err := n.addPeer(p); err != nil {
+		conn.Close()
+		return err
+	}
+	log.Printf("action=PeerConnected, peer=%s, inbound=%t, height=%d", p, inbound, version.Height)
+
+	// An inbound peer's listening address is only its claim, so it goes in
+	// the book as seen rather than as known to work.
+	if inbound {
+		n.addrBook.Add(p.ListenAddr(), time.Now())
+	} else {
+		p.Send(NewMessage(MsgGetAddr, nil))
+	}
+
+	n.handler.PeerConnected(p)
+	go p.run()
+	return nil
+}
+
+// handshakeDomain is prefixed to every handshake signature so that it
+// cannot be mistaken for a signature over anything else.
+const handshakeDomain = "goblockchain handshake"
+
+func handshakeSigningBytes(challenge [32]byte, signer NodeID, sessionKey [32]byte) []byte {
+	b := append([]byte(handshakeDomain), challenge[:]...)
+	b = append(b, signer[:]...)
+	return append(b, sessionKey[:]...)
+}
+
+// handshake exchanges version messages with the other end of conn, then
+// signs its challenge and checks the signature over ours. Since each side
+// signs its session key, a man in the middle cannot substitute its own and
+// the session derived from them is known only to the two ends.
+func (n *Node) handshake(conn net.Conn) (*VersionMessage, *session, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * HANDSHAKE_TIMEOUT_SEC))
+	defer conn.SetDeadline(time.Time{})
+
+	tipHash, height := n.handler.ChainTip()
+	local := &VersionMessage{
+		Version:     PROTOCOL_VERSION,
+		NodeID:      n.id,
+		ListenPort:  n.listenPort,
+		GenesisHash: n.handler.GenesisHash(),
+		TipHash:     tipHash,
+		Height:      height,
+	}
+	if _, err := rand.Read(local.Challenge[:]); err != nil {
+		return nil, nil, err
+	}
+	sessionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(local.SessionKey[:], sessionKey.PublicKey().Bytes())
+	if err := WriteMessage(conn, n.magic, NewMessage(MsgVersion, local.Encode())); err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := ReadMessage(conn, n.magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Type != MsgVersion {
+		return nil, nil, fmt.Errorf("expected version, got %s", msg.Type)
+	}
+	remote, err := DecodeVersionMessage(msg.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if remote.Version != PROTOCOL_VERSION {
+		return nil, nil, fmt.Errorf("unsupported protocol version %d", remote.Version)
+	}
+	if remote.NodeID == n.id {
+		return nil, nil, ErrSelfConnect
+	}
+	if remote.GenesisHash != local.GenesisHash {
+		return nil, nil, fmt.Errorf("%w: peer has %x", ErrGenesisMismatch, remote.GenesisHash)
+	}
+
+	ack := &VerAckMessage{Signature: ed25519.Sign(n.key, handshakeSigningBytes(remote.Challenge, n.id, local.SessionKey))}
+	if err := WriteMessage(conn, n.magic, NewMessage(MsgVerAck, ack.Encode())); err != nil {
+		return nil, nil, err
+	}
+
+	msg, err = ReadMessage(conn, n.magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Type != MsgVerAck {
+		return nil, nil, fmt.Errorf("expected verack, got %s", msg.Type)
+	}
+	remoteAck, err := DecodeVerAckMessage(msg.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(remote.NodeID[:], handshakeSigningBytes(local.Challenge, remote.NodeID, remote.SessionKey), remoteAck.Signature) {
+		return nil, nil, errors.New("peer failed to prove its node ID")
+	}
+
+	s, err := newSession(sessionKey, remote.SessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, s, nil
+}
+
+// addPeer registers p. When two nodes dial each other at the same time,
+// both ends keep the connection dialed by the node with the lower ID and
+// drop the other.
+func (n *Node) addPeer(p *Peer) error {
+	for {
+		n.mux.Lock()
+		old, ok := n.peers[p.id]
+		if !ok {
+			n.peers[p.id] = p
+			n.mux.Unlock()
+			return nil
+		}
+		n.mux.Unlock()
+
+		newDialer, oldDialer := n.dialer(p), n.dialer(old)
+		if bytes.Compare(newDialer[:], oldDialer[:]) >= 0 {
+			return fmt.Errorf("%w: %s", ErrPeerConnected, p.id)
+		}
+		old.Close()
+	}
+}
+
+// dialer returns the ID of the node that opened the connection to p.
+func (n *Node) dialer(p *Peer) NodeID {
+	if p.inbound {
+		return p.id
+	}
+	return n.id
+}
+
+func (n *Node) removePeer(p *Peer) {
+	n.mux.Lock()
+	removed := n.peers[p.id] == p
+	if removed {
+		delete(n.peers, p.id)
+	}
+	n.mux.Unlock()
+
+	if removed {
+		log.Printf("action=PeerDisconnected, peer=%s", p)
+		n.handler.PeerDisconnected(p)
+	}
+}
+
+func (n *Node) Peers() []*Peer {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (n *Node) SetBanManager(bans *BanManager) {
+	n.bans = bans
+}
+
+func (n *Node) BanManager() *BanManager {
+	return n.bans
+}
+
+// Misbehaving scores misbehavior by whoever is at host, a peer or an API
+// client, and disconnects every peer from host if that gets it banned.
+func (n *Node) Misbehaving(host string, score int, reason string) {
+	if !n.bans.Misbehaving(host, score, reason) {
+		return
+	}
+	for _, p := range n.Peers() {
+		if p.Host() == host {
+			// Closing calls back into the handler, whose locks the caller
+			// may hold.
+			go p.Close()
+		}
+	}
+}
+
+// Broadcast queues msg for every peer but except, which may be nil.
+func (n *Node) Broadcast(msg *Message, except *Peer) {
+	for _, p := range n.Peers() {
+		if p != except {
+			p.Send(msg)
+		}
+	}
+}
+
+// Close stops the listener and the dialer, disconnects every peer and saves
+// the address book.
+func (n *Node) Close() {
+	n.closeOnce.Do(func() { close(n.quit) })
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for _, p := range n.Peers() {
+		p.Close()
+	}
+	if err := n.addrBook.Save(); err != nil {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+// LoadNodeKey reads the node's private key from path, creating a new one
+// there if it does not exist yet, so the node keeps its ID across restarts.
+func LoadNodeKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: invalid node key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
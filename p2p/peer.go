@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PEER_SEND_QUEUE       = 256
+	PING_INTERVAL_SEC     = 30
+	PEER_TIMEOUT_SEC      = 90
+	HANDSHAKE_TIMEOUT_SEC = 10
+)
+
+// NodeID identifies a node by its ed25519 public key.
+type NodeID [32]byte
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:8])
+}
+
+// Peer is an established connection to another node whose messages are
+// authenticated by the session agreed on in the handshake.
+// Messages to it are queued and written by a goroutine of its own, so a
+// slow peer never blocks the caller. Address gossip is handled by the Node;
+// everything else goes to its Handler.
+type Peer struct {
+	conn    net.Conn
+	node    *Node
+	id      NodeID
+	version *VersionMessage
+	session *session
+	inbound bool
+
+	send      chan *Message
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(node *Node, conn net.Conn, version *VersionMessage, s *session, inbound bool) *Peer {
+	return &Peer{
+		conn:    conn,
+		node:    node,
+		id:      version.NodeID,
+		version: version,
+		session: s,
+		inbound: inbound,
+		send:    make(chan *Message, PEER_SEND_QUEUE),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (p *Peer) ID() NodeID {
+	return p.id
+}
+
+// Version is the version message the peer opened the connection with,
+// including its chain tip at the time.
+func (p *Peer) Version() *VersionMessage {
+	return p.version
+}
+
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+func (p *Peer) RemoteAddr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// Host is the peer's IP address, which bans apply to.
+func (p *Peer) Host() string {
+	return HostOf(p.RemoteAddr())
+}
+
+// Misbehaving adds score to the misbehavior score of the peer's host, which
+// is banned and disconnected once the score reaches BAN_THRESHOLD.
+func (p *Peer) Misbehaving(score int, reason string) {
+	p.node.Misbehaving(p.Host(), score, reason)
+}
+
+// ListenAddr is the address the peer accepts connections on.
+func (p *Peer) ListenAddr() string {
+	host, _, err := net.SplitHostPort(p.RemoteAddr())
+	if err != nil {
+		return p.RemoteAddr()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.version.ListenPort)))
+}
+
+func (p *Peer) String() string {
+	return p.id.String() + "@" + p.RemoteAddr()
+}
+
+// Send queues msg for the peer. A peer whose queue is full is not keeping up
+// and is disconnected. The disconnect happens in the background, since it
+// calls back into the handler, so Send is safe to call with the handler's
+// locks held.
+func (p *Peer) Send(msg *Message) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+
+	select {
+	case p.send <- msg:
+		return true
+	default:
+		log.Printf("Error: peer %s send queue is full, disconnecting\n", p)
+		go p.Close()
+		return false
+	}
+}
+
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.node.removePeer(p)
+	})
+}
+
+func (p *Peer) run() {
+	go p.writeLoop()
+	p.readLoop()
+}
+
+func (p *Peer) readLoop() {
+	defer p.Close()
+
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(time.Second * PEER_TIMEOUT_SEC))
+		msg, err := p.session.ReadMessage(p.conn, p.node.magic)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error: peer %s: %v\n", p, err)
+			}
+			if errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrBadMAC) {
+				p.Misbehaving(MISBEHAVIOR_MALFORMED, err.Error())
+			}
+			return
+		}
+
+		switch msg.Type {
+		case MsgPing:
+			p.Send(NewMessage(MsgPong, msg.Payload))
+		case MsgPong:
+		case MsgVersion, MsgVerAck:
+			log.Printf("Error: peer %s repeated the handshake\n", p)
+			p.Misbehaving(MISBEHAVIOR_PROTOCOL, "repeated handshake")
+			return
+		case MsgGetAddr:
+			p.node.handleGetAddr(p)
+		case MsgAddr:
+			if err := p.node.handleAddr(p, msg); err != nil {
+				log.Printf("Error: addr from peer %s: %v\n", p, err)
+				p.Misbehaving(MISBEHAVIOR_MALFORMED, err.Error())
+			}
+		default:
+			p.node.handler.HandleMessage(p, msg)
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	ticker := time.NewTicker(time.Second * PING_INTERVAL_SEC)
+	defer ticker.Stop()
+
+	for {
+		var msg *Message
+		select {
+		case <-p.quit:
+			return
+		case msg = <-p.send:
+		case <-ticker.C:
+			var nonce [8]byte
+			rand.Read(nonce[:])
+			msg = NewMessage(MsgPing, (&PingMessage{Nonce: binary.BigEndian.Uint64(nonce[:])}).Encode())
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(time.Second * PEER_TIMEOUT_SEC))
+		if err := p.session.WriteMessage(p.conn, p.node.magic, msg); err != nil {
+			log.Printf("Error: peer %s: %v\n", p, err)
+			p.Close()
+			return
+		}
+	}
+}
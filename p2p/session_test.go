@@ -0,0 +1,251 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+const testMagic = 0x0b110907
+
+// testSessions returns the two ends of a session agreed on as in the
+// handshake.
+func testSessions(t *testing.T) (*session, *session) {
+	t.Helper()
+	a, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aPub, bPub [32]byte
+	copy(aPub[:], a.PublicKey().Bytes())
+	copy(bPub[:], b.PublicKey().Bytes())
+
+	sa, err := newSession(a, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := newSession(b, aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa, sb
+}
+
+// seal returns msg as sa frames it.
+func seal(t *testing.T, sa *session, msg *Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := sa.WriteMessage(&buf, testMagic, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	sa, sb := testSessions(t)
+	for i, msg := range []*Message{
+		NewMessage(MsgPing, []byte{1, 2, 3, 4, 5, 6, 7, 8}),
+		NewMessage(MsgGetAddr, nil),
+		NewMessage(MsgPong, []byte{8, 7, 6, 5, 4, 3, 2, 1}),
+	} {
+		got, err := sb.ReadMessage(bytes.NewReader(seal(t, sa, msg)), testMagic)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if got.Type != msg.Type || !bytes.Equal(got.Payload, msg.Payload) {
+			t.Fatalf("message %d: got %s %x, want %s %x", i, got.Type, got.Payload, msg.Type, msg.Payload)
+		}
+	}
+}
+
+func TestSessionRejectsForgedFrames(t *testing.T) {
+	ping := NewMessage(MsgPing, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	t.Run("altered payload", func(t *testing.T) {
+		sa, sb := testSessions(t)
+		frame := seal(t, sa, ping)
+		frame[messageHeaderSize] ^= 0xff
+		// Keep the checksum in step so that only the tag gives it away.
+		forged, _ := encodeMessage(testMagic, &Message{Type: ping.Type, Payload: frame[messageHeaderSize : messageHeaderSize+len(ping.Payload)]})
+		copy(frame, forged[:messageHeaderSize])
+		if _, err := sb.ReadMessage(bytes.NewReader(frame), testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+
+	t.Run("no tag", func(t *testing.T) {
+		_, sb := testSessions(t)
+		var buf bytes.Buffer
+		WriteMessage(&buf, testMagic, ping)
+		buf.Write(make([]byte, frameMACSize))
+		if _, err := sb.ReadMessage(&buf, testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		sa, sb := testSessions(t)
+		frame := seal(t, sa, ping)
+		if _, err := sb.ReadMessage(bytes.NewReader(frame), testMagic); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sb.ReadMessage(bytes.NewReader(frame), testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		sa, sb := testSessions(t)
+		seal(t, sa, ping)
+		second := seal(t, sa, NewMessage(MsgGetAddr, nil))
+		if _, err := sb.ReadMessage(bytes.NewReader(second), testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+
+	t.Run("reflected", func(t *testing.T) {
+		sa, _ := testSessions(t)
+		frame := seal(t, sa, ping)
+		if _, err := sa.ReadMessage(bytes.NewReader(frame), testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+
+	t.Run("other session", func(t *testing.T) {
+		sa, _ := testSessions(t)
+		_, sb := testSessions(t)
+		if _, err := sb.ReadMessage(bytes.NewReader(seal(t, sa, ping)), testMagic); !errors.Is(err, ErrBadMAC) {
+			t.Fatalf("got %v, want %v", err, ErrBadMAC)
+		}
+	})
+}
+
+func TestReadMessageShortPayload(t *testing.T) {
+	frame, err := encodeMessage(testMagic, NewMessage(MsgPing, make([]byte, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Announce the largest payload allowed but send only a few bytes.
+	binary.BigEndian.PutUint32(frame[5:9], MAX_MESSAGE_SIZE)
+	if _, err := ReadMessage(bytes.NewReader(frame), testMagic); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+type testHandler struct{}
+
+func (testHandler) ChainTip() ([32]byte, uint64)  { return [32]byte{}, 0 }
+func (testHandler) GenesisHash() [32]byte         { return [32]byte{1} }
+func (testHandler) PeerConnected(*Peer)           {}
+func (testHandler) HandleMessage(*Peer, *Message) {}
+func (testHandler) PeerDisconnected(*Peer)        {}
+
+func testNode(t *testing.T) *Node {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNode(key, testMagic, 0, testHandler{})
+}
+
+// connPair returns the two ends of a loopback TCP connection, which unlike
+// net.Pipe lets both ends write their version message at once.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+type handshakeResult struct {
+	version *VersionMessage
+	session *session
+	err     error
+}
+
+func handshakeAsync(n *Node, conn net.Conn) <-chan handshakeResult {
+	done := make(chan handshakeResult, 1)
+	go func() {
+		version, s, err := n.handshake(conn)
+		done <- handshakeResult{version, s, err}
+	}()
+	return done
+}
+
+func TestHandshakeAgreesOnSession(t *testing.T) {
+	a, b := testNode(t), testNode(t)
+	ca, cb := connPair(t)
+
+	ra, rb := handshakeAsync(a, ca), handshakeAsync(b, cb)
+	resA, resB := <-ra, <-rb
+	if resA.err != nil || resB.err != nil {
+		t.Fatalf("handshake: %v, %v", resA.err, resB.err)
+	}
+	if resA.version.NodeID != b.ID() || resB.version.NodeID != a.ID() {
+		t.Fatal("handshake reported the wrong node IDs")
+	}
+
+	msg := NewMessage(MsgPing, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	frame := seal(t, resA.session, msg)
+	if _, err := resB.session.ReadMessage(bytes.NewReader(frame), testMagic); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHandshakeRejectsSubstitutedSessionKey replaces the session key in
+// the version message b receives, as a man in the middle would.
+func TestHandshakeRejectsSubstitutedSessionKey(t *testing.T) {
+	a, b := testNode(t), testNode(t)
+	ca, mitmA := connPair(t)
+	mitmB, cb := connPair(t)
+
+	go io.Copy(mitmA, mitmB)
+	go func() {
+		msg, err := ReadMessage(mitmA, testMagic)
+		if err != nil {
+			return
+		}
+		version, err := DecodeVersionMessage(msg.Payload)
+		if err != nil {
+			return
+		}
+		key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		copy(version.SessionKey[:], key.PublicKey().Bytes())
+		WriteMessage(mitmB, testMagic, NewMessage(MsgVersion, version.Encode()))
+		io.Copy(mitmB, mitmA)
+	}()
+
+	ra, rb := handshakeAsync(a, ca), handshakeAsync(b, cb)
+	if res := <-rb; res.err == nil {
+		t.Fatal("handshake accepted a substituted session key")
+	}
+	cb.Close()
+	<-ra
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"goblockchain/config"
+	"log"
+	"os"
+)
+
+func main() {
+	cfg, err := config.LoadPoolServerConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Log.Setup("Pool: "); err != nil {
+		log.Fatal(err)
+	}
+
+	ps := NewPoolServer(cfg)
+	ps.Start()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/wallet"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// PAYOUT_ORPHAN_BLOCKS is how many blocks past its maturity the pool waits
+// for the reward of a block to become spendable before it takes the block
+// for one that left the chain and drops its payout.
+const PAYOUT_ORPHAN_BLOCKS = 10
+
+// PAYOUT_CONFIRMATIONS is how deep the transaction of a payout has to be
+// buried before the pool counts its miners as paid.
+const PAYOUT_CONFIRMATIONS = 6
+
+const (
+	PAYOUT_PENDING  = "pending"
+	PAYOUT_SENT     = "sent"
+	PAYOUT_PAID     = "paid"
+	PAYOUT_ORPHANED = "orphaned"
+)
+
+// payout is what the reward of a block the pool found owes each miner.
+type payout struct {
+	height   int
+	coinbase [32]byte
+	payments []*block.TxOutput
+	stats    *BlockStats
+	// txHash is the transaction that pays it once sent, until it is
+	// confirmed or drops out of the gateway's mempool.
+	txHash string
+}
+
+// closeRound splits the reward of b, found by worker for j, among the
+// shares of the round and starts a new round. The pool keeps its fee and
+// whatever the proportional split rounds off.
+func (ps *PoolServer) closeRound(j *job, b *block.Block, worker string) {
+	coinbase := b.Transactions()[0]
+	reward := coinbase.Outputs()[0].Value()
+
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	round := ps.round
+	ps.round = make(map[string]uint64)
+
+	stats := &BlockStats{
+		Height: j.height,
+		Hash:   fmt.Sprintf("%x", b.Hash()),
+		Worker: worker,
+		Reward: reward,
+		Payout: PAYOUT_PENDING,
+	}
+	ps.blocks = append(ps.blocks, stats)
+
+	payments := splitReward(reward, ps.cfg.FeePercent, round)
+	if len(payments) == 0 {
+		stats.Payout = PAYOUT_PAID
+		return
+	}
+	ps.payouts = append(ps.payouts, &payout{
+		height:   j.height,
+		coinbase: coinbase.Hash(),
+		payments: payments,
+		stats:    stats,
+	})
+	log.Printf("action=CloseRound, height=%d, reward=%s, miners=%d", j.height, reward, len(payments))
+}
+
+// splitReward takes the pool's fee, in percent, off reward and splits the
+// rest in proportion to shares, one payment per address in address order.
+func splitReward(reward block.Amount, feePercent float64, shares map[string]uint64) []*block.TxOutput {
+	var total uint64
+	addresses := make([]string, 0, len(shares))
+	for address, n := range shares {
+		total += n
+		addresses = append(addresses, address)
+	}
+	if total == 0 {
+		return nil
+	}
+	sort.Strings(addresses)
+
+	// The fee is applied in basis points so that the split is exact.
+	feeBasisPoints := int64(math.Round(feePercent * 100))
+	miners := new(big.Int).Mul(big.NewInt(int64(reward)), big.NewInt(10000-feeBasisPoints))
+	miners.Div(miners, big.NewInt(10000))
+
+	payments := make([]*block.TxOutput, 0, len(addresses))
+	for _, address := range addresses {
+		value := new(big.Int).Mul(miners, new(big.Int).SetUint64(shares[address]))
+		value.Div(value, new(big.Int).SetUint64(total))
+		if value.Sign() > 0 {
+			payments = append(payments, block.NewTxOutput(address, block.Amount(value.Int64())))
+		}
+	}
+	return payments
+}
+
+// StartPayouts pays out the rewards that have matured, checking every
+// payout interval.
+func (ps *PoolServer) StartPayouts() {
+	ps.payPending()
+	time.AfterFunc(time.Second*time.Duration(ps.cfg.PayoutSec), ps.StartPayouts)
+}
+
+func (ps *PoolServer) payPending() {
+	ps.mux.Lock()
+	pending := append([]*payout(nil), ps.payouts...)
+	height := ps.height
+	ps.mux.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	utxos, err := ps.utxos()
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	spendable := make(map[string]*block.UTXOResponse)
+	for _, u := range utxos {
+		spendable[fmt.Sprintf("%s:%d", u.TxHash, u.OutputIndex)] = u
+	}
+
+	for _, p := range pending {
+		if p.txHash != "" {
+			confirmations, ok, err := ps.confirmations(p.txHash)
+			if err != nil {
+				log.Printf("Error: %v\n", err)
+				continue
+			}
+			if ok {
+				if confirmations >= PAYOUT_CONFIRMATIONS {
+					log.Printf("action=Payout, status=success, height=%d, transaction=%s", p.height, p.txHash)
+					ps.finishPayout(p, PAYOUT_PAID)
+				}
+				continue
+			}
+			// The gateway dropped the transaction, or the block that had it
+			// left the chain and took it along; send it again.
+			log.Printf("action=Payout, status=dropped, height=%d, transaction=%s", p.height, p.txHash)
+			ps.setPayoutSent(p, "")
+		}
+
+		u, ok := spendable[fmt.Sprintf("%x:0", p.coinbase)]
+		if !ok {
+			if height > p.height+ps.cfg.Params().CoinbaseMaturity+PAYOUT_ORPHAN_BLOCKS {
+				log.Printf("action=Payout, status=orphaned, height=%d", p.height)
+				ps.finishPayout(p, PAYOUT_ORPHANED)
+			}
+			continue
+		}
+
+		txHash, err := ps.pay(p, u)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			continue
+		}
+		log.Printf("action=Payout, status=sent, height=%d, miners=%d, transaction=%s", p.height, len(p.payments), txHash)
+		ps.setPayoutSent(p, txHash)
+	}
+}
+
+// pay sends the payments of p from u, the reward of its block, returning
+// the rest to the pool less the fee, and returns the hash of the
+// transaction.
+func (ps *PoolServer) pay(p *payout, u *block.UTXOResponse) (string, error) {
+	transaction, err := ps.payoutTransaction(p, u)
+	if err != nil {
+		return "", fmt.Errorf("payout of block %d: %w", p.height, err)
+	}
+	signatureStr := transaction.GenerateSignature().String()
+	publicKeyStr := ps.wallet.PublicKeyStr()
+
+	btr := block.TransactionRequest{
+		Transaction: transaction.Transaction(),
+		PublicKey:   &publicKeyStr,
+		Signature:   &signatureStr,
+	}
+	m, _ := json.Marshal(btr)
+	response, err := ps.client.Post(ps.cfg.Gateway+"/transactions", "application/json", bytes.NewReader(m))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 201 {
+		return "", fmt.Errorf("payout of block %d: gateway returned %s", p.height, response.Status)
+	}
+	return fmt.Sprintf("%x", transaction.Transaction().Hash()), nil
+}
+
+// payoutTransaction builds the transaction of p, paying FeePerByte on its
+// size once signed. The size does not depend on the fee, except that a fee
+// that takes all the change drops the change output and makes it smaller.
+func (ps *PoolServer) payoutTransaction(p *payout, u *block.UTXOResponse) (*wallet.Transaction, error) {
+	var fee block.Amount
+	for {
+		transaction, err := wallet.NewPayments(ps.wallet.PrivateKey(), ps.wallet.PublicKey(), ps.wallet.BlockchainAddress(), p.payments, fee, []*block.UTXOResponse{u})
+		if err != nil {
+			return nil, err
+		}
+		t := transaction.Transaction()
+		t.SetSignature(ps.wallet.PublicKey(), transaction.GenerateSignature())
+		required := block.Amount(ps.cfg.FeePerByte) * block.Amount(t.Size())
+		if fee >= required {
+			return transaction, nil
+		}
+		fee = required
+	}
+}
+
+// confirmations asks the gateway how deep the transaction txHash is on its
+// chain; ok is false if the gateway knows no such transaction, and
+// confirmations is 0 while it waits in the mempool.
+func (ps *PoolServer) confirmations(txHash string) (confirmations int, ok bool, err error) {
+	response, err := ps.client.Get(ps.cfg.Gateway + "/transactions/" + txHash)
+	if err != nil {
+		return 0, false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case 200:
+	case 404:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("gateway returned %s", response.Status)
+	}
+
+	var info block.TransactionInfoResponse
+	if err := json.NewDecoder(response.Body).Decode(&info); err != nil {
+		return 0, false, err
+	}
+	return info.Confirmations, true, nil
+}
+
+// setPayoutSent records that txHash pays p, or that p is waiting to be sent
+// again if txHash is empty.
+func (ps *PoolServer) setPayoutSent(p *payout, txHash string) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	p.txHash = txHash
+	p.stats.Payout = PAYOUT_SENT
+	if txHash == "" {
+		p.stats.Payout = PAYOUT_PENDING
+	}
+}
+
+func (ps *PoolServer) finishPayout(p *payout, status string) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	p.stats.Payout = status
+	for i, q := range ps.payouts {
+		if q == p {
+			ps.payouts = append(ps.payouts[:i], ps.payouts[i+1:]...)
+			break
+		}
+	}
+}
+
+// utxos asks the gateway for the outputs the pool can spend.
+func (ps *PoolServer) utxos() ([]*block.UTXOResponse, error) {
+	endpoint := fmt.Sprintf("%s/utxos?blockchain_address=%s", ps.cfg.Gateway, ps.wallet.BlockchainAddress())
+	response, err := ps.client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("gateway returned %s", response.Status)
+	}
+
+	var utxos block.UTXOsResponse
+	if err := json.NewDecoder(response.Body).Decode(&utxos); err != nil {
+		return nil, err
+	}
+	return utxos.UTXOs, nil
+}
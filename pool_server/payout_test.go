@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/chaincfg"
+	"goblockchain/config"
+	"goblockchain/wallet"
+	"testing"
+)
+
+func TestSplitReward(t *testing.T) {
+	tests := []struct {
+		name       string
+		reward     block.Amount
+		feePercent float64
+		shares     map[string]uint64
+		want       []string
+	}{
+		{"no shares", 100, 1, nil, nil},
+		{"one miner", 10000, 1, map[string]uint64{"a": 5}, []string{"a 9900"}},
+		{"proportional", 10000, 0, map[string]uint64{"a": 1, "b": 3}, []string{"a 2500", "b 7500"}},
+		{"address order", 10000, 0, map[string]uint64{"c": 1, "a": 1, "b": 2}, []string{"a 2500", "b 5000", "c 2500"}},
+		{"rounded down", 100, 0, map[string]uint64{"a": 1, "b": 1, "c": 1}, []string{"a 33", "b 33", "c 33"}},
+		{"fractional fee", 10000, 2.5, map[string]uint64{"a": 1}, []string{"a 9750"}},
+		{"whole reward as fee", 10000, 100, map[string]uint64{"a": 1}, nil},
+		{"too small to pay", 10, 0, map[string]uint64{"a": 1, "b": 99}, []string{"b 9"}},
+		{"largest reward", block.MAX_AMOUNT, 0, map[string]uint64{"a": 1, "b": 1}, []string{
+			fmt.Sprintf("a %d", int64(block.MAX_AMOUNT/2)),
+			fmt.Sprintf("b %d", int64(block.MAX_AMOUNT/2)),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payments := splitReward(tt.reward, tt.feePercent, tt.shares)
+			var got []string
+			for _, p := range payments {
+				got = append(got, fmt.Sprintf("%s %d", p.RecipientBlockchainAddress(), int64(p.Value())))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("splitReward = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayoutTransactionFee(t *testing.T) {
+	params := &chaincfg.RegTestParams
+	ps := &PoolServer{cfg: config.DefaultPoolServerConfig(), wallet: wallet.NewWallet(params)}
+	miner := wallet.NewWallet(params).BlockchainAddress()
+	p := &payout{payments: []*block.TxOutput{block.NewTxOutput(miner, block.COIN)}}
+	utxo := func(value block.Amount) *block.UTXOResponse {
+		return &block.UTXOResponse{TxHash: fmt.Sprintf("%x", [32]byte{1}), Value: value}
+	}
+
+	ps.cfg.FeePerByte = 0
+	free, err := ps.payoutTransaction(p, utxo(2*block.COIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := free.Transaction().Size()
+
+	tests := []struct {
+		name       string
+		value      block.Amount
+		feePerByte int
+		change     bool
+	}{
+		{"with change", 2 * block.COIN, 10, true},
+		{"no fee", 2 * block.COIN, 0, true},
+		// The fee takes all the change, which leaves the smaller
+		// transaction paying a little more than it has to.
+		{"fee takes the change", block.COIN + block.Amount(10*size), 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps.cfg.FeePerByte = tt.feePerByte
+			transaction, err := ps.payoutTransaction(p, utxo(tt.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx := transaction.Transaction()
+			if want := block.Amount(tt.feePerByte * tx.Size()); tx.Fee() < want {
+				t.Errorf("fee %d for %d bytes, want at least %d", tx.Fee(), tx.Size(), want)
+			}
+			if got := len(tx.Outputs()) == 2; got != tt.change {
+				t.Errorf("change output %t, want %t", got, tt.change)
+			}
+			out, err := tx.OutputValue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total, _ := out.Add(tx.Fee()); total != tt.value {
+				t.Errorf("outputs and fee add up to %d, want %d", total, tt.value)
+			}
+		})
+	}
+}
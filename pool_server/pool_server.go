@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/config"
+	"goblockchain/stratum"
+	"goblockchain/wallet"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PoolServer mines for the miners connected to it: it hands them jobs from
+// the gateway's block templates with a share target easier than the
+// block's, credits every share they find to their address and, when a share
+// turns out to solve the block, submits it and pays the reward out in
+// proportion to the shares of the round. The blocks pay the pool's own
+// wallet, which pays the miners once the reward has matured.
+type PoolServer struct {
+	cfg    *config.PoolServerConfig
+	wallet *wallet.Wallet
+	client *http.Client
+
+	mux            sync.Mutex
+	current        *job
+	jobs           map[string]*job
+	nextJobID      uint64
+	nextExtranonce uint32
+	sessions       map[*session]bool
+	height         int
+	// round holds the shares of each address since the last block.
+	round   map[string]uint64
+	workers map[string]*WorkerStats
+	blocks  []*BlockStats
+	payouts []*payout
+}
+
+// job is a block template handed out to the miners, with the shares found
+// for it so far.
+type job struct {
+	id          string
+	height      int
+	prevHash    string
+	block       *block.Block
+	target      *big.Int
+	shareTarget *big.Int
+	created     time.Time
+	shares      map[shareKey]bool
+}
+
+type shareKey struct {
+	timestamp int64
+	nonce     uint64
+}
+
+func NewPoolServer(cfg *config.PoolServerConfig) *PoolServer {
+	return &PoolServer{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		jobs:     make(map[string]*job),
+		sessions: make(map[*session]bool),
+		round:    make(map[string]uint64),
+		workers:  make(map[string]*WorkerStats),
+	}
+}
+
+func (ps *PoolServer) Start() {
+	w, err := wallet.LoadWallet(filepath.Join(ps.cfg.DataDir, "pool.key"), ps.cfg.Params())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ps.wallet = w
+	log.Printf("action=PoolStart, address=%s, gateway=%s", w.BlockchainAddress(), ps.cfg.Gateway)
+
+	if err := ps.ListenStratum(); err != nil {
+		log.Fatal(err)
+	}
+	ps.StartJobs()
+	ps.StartPayouts()
+
+	http.HandleFunc("/stats", ps.Stats)
+	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(ps.cfg.Port)), nil))
+}
+
+// StartJobs keeps the job the miners work on current: a new job replaces
+// it when the gateway's tip moves, and also once it is older than the job
+// age, so that new transactions make it into the pool's blocks.
+func (ps *PoolServer) StartJobs() {
+	ps.refreshJob(false)
+	time.AfterFunc(time.Second*time.Duration(ps.cfg.PollSec), ps.StartJobs)
+}
+
+func (ps *PoolServer) refreshJob(force bool) {
+	t, err := ps.template()
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	b, err := t.Block()
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+
+	ps.mux.Lock()
+	clean := ps.current == nil || ps.current.prevHash != t.PrevHash
+	expired := ps.current != nil && time.Since(ps.current.created) > time.Second*time.Duration(ps.cfg.JobAgeSec)
+	if !clean && !expired && !force {
+		ps.mux.Unlock()
+		return
+	}
+
+	target := block.CompactToBig(t.Bits)
+	shareTarget := new(big.Int).Mul(target, big.NewInt(int64(ps.cfg.ShareFactor)))
+	if maxTarget := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)); shareTarget.Cmp(maxTarget) > 0 {
+		shareTarget = maxTarget
+	}
+	ps.nextJobID++
+	j := &job{
+		id:          strconv.FormatUint(ps.nextJobID, 16),
+		height:      t.Height,
+		prevHash:    t.PrevHash,
+		block:       b,
+		target:      target,
+		shareTarget: shareTarget,
+		created:     time.Now(),
+		shares:      make(map[shareKey]bool),
+	}
+	if clean {
+		ps.jobs = make(map[string]*job)
+	}
+	ps.jobs[j.id] = j
+	ps.current = j
+	ps.height = t.Height - 1
+	sessions := ps.authorizedSessions()
+	ps.mux.Unlock()
+
+	log.Printf("action=NewJob, job=%s, height=%d, clean=%t, miners=%d", j.id, j.height, clean, len(sessions))
+	for _, s := range sessions {
+		s.notify(j, clean)
+	}
+}
+
+// template asks the gateway for a block paying the pool.
+func (ps *PoolServer) template() (*block.BlockTemplateResponse, error) {
+	endpoint := fmt.Sprintf("%s/mine/template?address=%s", ps.cfg.Gateway, ps.wallet.BlockchainAddress())
+	response, err := ps.client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("gateway returned %s", response.Status)
+	}
+
+	var t block.BlockTemplateResponse
+	if err := json.NewDecoder(response.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// submitShare checks a share of the miner with extranonce and credits it
+// to the share's worker. A share that also meets the block target is
+// submitted to the gateway.
+func (ps *PoolServer) submitShare(extranonce uint32, share *stratum.Share) *stratum.Error {
+	ps.mux.Lock()
+	j, ok := ps.jobs[share.JobID]
+	if !ok {
+		ps.mux.Unlock()
+		return stratum.NewError(stratum.ERR_JOB_NOT_FOUND, "job %s not found or stale", share.JobID)
+	}
+	if uint32(share.Nonce>>32) != extranonce {
+		ps.mux.Unlock()
+		return stratum.NewError(stratum.ERR_OTHER, "nonce outside the extranonce %d", extranonce)
+	}
+	if share.Timestamp < j.block.Timestamp() || share.Timestamp > time.Now().Add(block.MINING_MAX_FUTURE_SEC*time.Second).UnixNano() {
+		ps.mux.Unlock()
+		return stratum.NewError(stratum.ERR_OTHER, "timestamp out of range")
+	}
+	key := shareKey{share.Timestamp, share.Nonce}
+	if j.shares[key] {
+		ps.mux.Unlock()
+		return stratum.NewError(stratum.ERR_DUPLICATE_SHARE, "duplicate share")
+	}
+
+	b := j.block.Solved(share.Nonce, share.Timestamp)
+	hash := block.HashToBig(b.Hash())
+	if hash.Cmp(j.shareTarget) > 0 {
+		ps.mux.Unlock()
+		return stratum.NewError(stratum.ERR_LOW_DIFFICULTY, "share above target")
+	}
+	j.shares[key] = true
+	ps.round[share.Worker]++
+	w, ok := ps.workers[share.Worker]
+	if !ok {
+		w = &WorkerStats{Address: share.Worker}
+		ps.workers[share.Worker] = w
+	}
+	w.TotalShares++
+	w.LastShareTime = time.Now().UnixNano()
+	ps.mux.Unlock()
+
+	if hash.Cmp(j.target) <= 0 {
+		ps.submitBlock(j, b, share.Worker)
+	}
+	return nil
+}
+
+// submitBlock hands a block found by worker to the gateway and, if it
+// became the tip, closes the round.
+func (ps *PoolServer) submitBlock(j *job, b *block.Block, worker string) {
+	m, _ := json.Marshal(b)
+	response, err := ps.client.Post(ps.cfg.Gateway+"/mine/submit", "application/json", bytes.NewReader(m))
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	defer response.Body.Close()
+
+	var status struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(response.Body).Decode(&status)
+	log.Printf("action=SubmitBlock, status=%s, height=%d, hash=%x, worker=%s", status.Message, j.height, b.Hash(), worker)
+	if status.Message != "success" {
+		return
+	}
+
+	ps.closeRound(j, b, worker)
+	go ps.refreshJob(true)
+}
+
+// authorizedSessions must be called with ps.mux held.
+func (ps *PoolServer) authorizedSessions() []*session {
+	sessions := make([]*session, 0, len(ps.sessions))
+	for s := range ps.sessions {
+		if s.authorized() {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// WorkerStats is what a worker address has contributed.
+type WorkerStats struct {
+	Address       string `json:"address"`
+	RoundShares   uint64 `json:"round_shares"`
+	TotalShares   uint64 `json:"total_shares"`
+	LastShareTime int64  `json:"last_share_time,omitempty"`
+	Miners        int    `json:"miners"`
+}
+
+// BlockStats is a block the pool found and the state of its payout.
+type BlockStats struct {
+	Height int          `json:"height"`
+	Hash   string       `json:"hash"`
+	Worker string       `json:"worker"`
+	Reward block.Amount `json:"reward"`
+	Payout string       `json:"payout"`
+}
+
+type PoolStatsResponse struct {
+	Address     string         `json:"address"`
+	Height      int            `json:"height"`
+	ShareFactor int            `json:"share_factor"`
+	FeePercent  float64        `json:"fee_percent"`
+	Miners      int            `json:"miners"`
+	RoundShares uint64         `json:"round_shares"`
+	Workers     []*WorkerStats `json:"workers"`
+	Blocks      []*BlockStats  `json:"blocks"`
+}
+
+// Stats reports the pool's miners, their contributions and the blocks
+// found.
+func (ps *PoolServer) Stats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ps.mux.Lock()
+		stats := &PoolStatsResponse{
+			Address:     ps.wallet.BlockchainAddress(),
+			Height:      ps.height,
+			ShareFactor: ps.cfg.ShareFactor,
+			FeePercent:  ps.cfg.FeePercent,
+			Miners:      len(ps.sessions),
+			Workers:     make([]*WorkerStats, 0, len(ps.workers)),
+			Blocks:      make([]*BlockStats, 0, len(ps.blocks)),
+		}
+		miners := make(map[string]int)
+		for s := range ps.sessions {
+			if s.authorized() {
+				miners[s.address()]++
+			}
+		}
+		for _, ws := range ps.workers {
+			c := *ws
+			c.RoundShares = ps.round[ws.Address]
+			c.Miners = miners[ws.Address]
+			stats.RoundShares += c.RoundShares
+			stats.Workers = append(stats.Workers, &c)
+		}
+		for _, b := range ps.blocks {
+			c := *b
+			stats.Blocks = append(stats.Blocks, &c)
+		}
+		ps.mux.Unlock()
+
+		m, _ := json.Marshal(stats)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+	default:
+		log.Println("Error: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
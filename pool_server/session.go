@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goblockchain/blockchain_crypto"
+	"goblockchain/stratum"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ACCEPT_RETRY_MIN and ACCEPT_RETRY_MAX bound the pause after a failed
+	// accept, which doubles while accepts keep failing.
+	ACCEPT_RETRY_MIN = 5 * time.Millisecond
+	ACCEPT_RETRY_MAX = time.Second
+)
+
+// session is the stratum connection of a miner. Its extranonce is set by
+// mining.subscribe and its worker, the address its shares are credited to,
+// by mining.authorize.
+type session struct {
+	ps   *PoolServer
+	conn *stratum.Conn
+
+	mux        sync.Mutex
+	subscribed bool
+	extranonce uint32
+	worker     string
+}
+
+// ListenStratum accepts miners on the stratum port, serving each one on
+// its own goroutine.
+func (ps *PoolServer) ListenStratum() error {
+	l, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(int(ps.cfg.StratumPort)))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// Running out of file descriptors and the like passes;
+				// wait for it, backing off, rather than spin.
+				if delay == 0 {
+					delay = ACCEPT_RETRY_MIN
+				} else {
+					delay *= 2
+				}
+				if delay > ACCEPT_RETRY_MAX {
+					delay = ACCEPT_RETRY_MAX
+				}
+				log.Printf("Error: %v, retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			s := &session{ps: ps, conn: stratum.NewConn(conn)}
+			ps.mux.Lock()
+			ps.sessions[s] = true
+			ps.mux.Unlock()
+			go s.serve()
+		}
+	}()
+	return nil
+}
+
+func (s *session) serve() {
+	log.Printf("action=MinerConnect, remote=%s", s.conn.RemoteAddr())
+	defer func() {
+		s.ps.mux.Lock()
+		delete(s.ps.sessions, s)
+		s.ps.mux.Unlock()
+		s.conn.Close()
+		log.Printf("action=MinerDisconnect, remote=%s, worker=%s", s.conn.RemoteAddr(), s.address())
+	}()
+
+	for {
+		m, err := s.conn.Read()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error: %v\n", err)
+			}
+			return
+		}
+		if m.ID == nil {
+			// Miners have nothing to notify the pool of.
+			continue
+		}
+
+		result, serr := s.handle(m)
+		response, err := stratum.NewResponse(m.ID, result, serr)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			return
+		}
+		if err := s.conn.Write(response); err != nil {
+			log.Printf("Error: %v\n", err)
+			return
+		}
+
+		if m.Method == stratum.METHOD_AUTHORIZE && serr == nil {
+			s.ps.mux.Lock()
+			j := s.ps.current
+			s.ps.mux.Unlock()
+			if j != nil {
+				s.notify(j, true)
+			}
+		}
+	}
+}
+
+func (s *session) handle(m *stratum.Message) (interface{}, *stratum.Error) {
+	switch m.Method {
+	case stratum.METHOD_SUBSCRIBE:
+		s.mux.Lock()
+		subscribed, extranonce := s.subscribed, s.extranonce
+		s.mux.Unlock()
+		if !subscribed {
+			s.ps.mux.Lock()
+			extranonce = s.ps.nextExtranonce
+			s.ps.nextExtranonce++
+			s.ps.mux.Unlock()
+
+			s.mux.Lock()
+			s.subscribed, s.extranonce = true, extranonce
+			s.mux.Unlock()
+		}
+		return &stratum.SubscribeResult{Extranonce: extranonce}, nil
+
+	case stratum.METHOD_AUTHORIZE:
+		s.mux.Lock()
+		subscribed := s.subscribed
+		s.mux.Unlock()
+		if !subscribed {
+			return nil, stratum.NewError(stratum.ERR_NOT_SUBSCRIBED, "not subscribed")
+		}
+		var address string
+		if err := m.ParseParams(&address); err != nil {
+			return nil, stratum.NewError(stratum.ERR_OTHER, "%v", err)
+		}
+		if v, err := blockchain_crypto.AddressVersion(address); err != nil || v != s.ps.cfg.Params().AddressVersion {
+			return nil, stratum.NewError(stratum.ERR_UNAUTHORIZED, "invalid address %q", address)
+		}
+
+		s.mux.Lock()
+		s.worker = address
+		s.mux.Unlock()
+		log.Printf("action=MinerAuthorize, remote=%s, worker=%s", s.conn.RemoteAddr(), address)
+		return true, nil
+
+	case stratum.METHOD_SUBMIT:
+		s.mux.Lock()
+		worker, extranonce := s.worker, s.extranonce
+		s.mux.Unlock()
+		if worker == "" {
+			return nil, stratum.NewError(stratum.ERR_UNAUTHORIZED, "not authorized")
+		}
+		share, err := stratum.ParseShare(m)
+		if err != nil {
+			return nil, stratum.NewError(stratum.ERR_OTHER, "%v", err)
+		}
+		if share.Worker != worker {
+			return nil, stratum.NewError(stratum.ERR_UNAUTHORIZED, "worker %q not authorized", share.Worker)
+		}
+		if serr := s.ps.submitShare(extranonce, share); serr != nil {
+			log.Printf("action=Share, status=rejected, worker=%s, job=%s, reason=%s", worker, share.JobID, serr.Message)
+			return nil, serr
+		}
+		return true, nil
+
+	default:
+		return nil, stratum.NewError(stratum.ERR_OTHER, "unknown method %q", m.Method)
+	}
+}
+
+// notify sends j to the miner.
+func (s *session) notify(j *job, clean bool) {
+	sj := &stratum.Job{
+		ID:          j.id,
+		Header:      fmt.Sprintf("%x", j.block.Header().Encode()),
+		ShareTarget: fmt.Sprintf("%064x", j.shareTarget),
+		Clean:       clean,
+	}
+	m, err := sj.Notification()
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return
+	}
+	if err := s.conn.Write(m); err != nil {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+func (s *session) authorized() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.worker != ""
+}
+
+func (s *session) address() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.worker
+}
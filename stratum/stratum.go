@@ -0,0 +1,196 @@
+// Package stratum is the protocol between a mining pool and its miners:
+// newline-delimited JSON-RPC over TCP after the stratum protocol.
+//
+//	-> {"id": 1, "method": "mining.subscribe", "params": []}
+//	<- {"id": 1, "result": {"extranonce": 7}}
+//	-> {"id": 2, "method": "mining.authorize", "params": ["<address>"]}
+//	<- {"id": 2, "result": true}
+//	<- {"id": null, "method": "mining.notify", "params": ["<job id>", "<header>", "<share target>", <clean>]}
+//	-> {"id": 3, "method": "mining.submit", "params": ["<address>", "<job id>", <timestamp>, <nonce>]}
+//	<- {"id": 3, "result": true}
+//
+// The header is a hex encoded block header and the share target a hex
+// number its hash must not exceed. The upper 32 bits of every nonce a miner
+// submits must be its extranonce, so that no two miners do the same work;
+// when a miner runs out of nonces it moves the timestamp forward. A job
+// with clean set builds on a new tip, and shares of the jobs before it are
+// stale.
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	METHOD_SUBSCRIBE = "mining.subscribe"
+	METHOD_AUTHORIZE = "mining.authorize"
+	METHOD_NOTIFY    = "mining.notify"
+	METHOD_SUBMIT    = "mining.submit"
+
+	// MAX_LINE_SIZE bounds a single message.
+	MAX_LINE_SIZE = 16 * 1024
+)
+
+// Error codes, those of the stratum protocol.
+const (
+	ERR_OTHER           = 20
+	ERR_JOB_NOT_FOUND   = 21
+	ERR_DUPLICATE_SHARE = 22
+	ERR_LOW_DIFFICULTY  = 23
+	ERR_UNAUTHORIZED    = 24
+	ERR_NOT_SUBSCRIBED  = 25
+)
+
+// Message is a request, a response or, without an ID, a notification.
+type Message struct {
+	ID     *uint64           `json:"id"`
+	Method string            `json:"method,omitempty"`
+	Params []json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  *Error            `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("stratum error %d: %s", e.Code, e.Message)
+}
+
+// NewRequest builds a request, or a notification if id is nil.
+func NewRequest(id *uint64, method string, params ...interface{}) (*Message, error) {
+	m := &Message{ID: id, Method: method, Params: make([]json.RawMessage, 0, len(params))}
+	for _, p := range params {
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		m.Params = append(m.Params, raw)
+	}
+	return m, nil
+}
+
+// NewResponse answers the request with ID id with result, or with err if it
+// is not nil.
+func NewResponse(id *uint64, result interface{}, err *Error) (*Message, error) {
+	m := &Message{ID: id, Error: err}
+	if err == nil {
+		raw, e := json.Marshal(result)
+		if e != nil {
+			return nil, e
+		}
+		m.Result = raw
+	}
+	return m, nil
+}
+
+// ParseParams decodes the params of m into v, one pointer per param.
+func (m *Message) ParseParams(v ...interface{}) error {
+	if len(m.Params) != len(v) {
+		return fmt.Errorf("%s takes %d params, got %d", m.Method, len(v), len(m.Params))
+	}
+	for i, p := range m.Params {
+		if err := json.Unmarshal(p, v[i]); err != nil {
+			return fmt.Errorf("%s param %d: %w", m.Method, i, err)
+		}
+	}
+	return nil
+}
+
+// SubscribeResult is the result of mining.subscribe.
+type SubscribeResult struct {
+	Extranonce uint32 `json:"extranonce"`
+}
+
+// Job is the work of a mining.notify.
+type Job struct {
+	ID          string
+	Header      string
+	ShareTarget string
+	Clean       bool
+}
+
+func (j *Job) Notification() (*Message, error) {
+	return NewRequest(nil, METHOD_NOTIFY, j.ID, j.Header, j.ShareTarget, j.Clean)
+}
+
+func ParseJob(m *Message) (*Job, error) {
+	j := new(Job)
+	return j, m.ParseParams(&j.ID, &j.Header, &j.ShareTarget, &j.Clean)
+}
+
+// Share is the solution of a mining.submit.
+type Share struct {
+	Worker    string
+	JobID     string
+	Timestamp int64
+	Nonce     uint64
+}
+
+func (s *Share) Request(id uint64) (*Message, error) {
+	return NewRequest(&id, METHOD_SUBMIT, s.Worker, s.JobID, s.Timestamp, s.Nonce)
+}
+
+func ParseShare(m *Message) (*Share, error) {
+	s := new(Share)
+	return s, m.ParseParams(&s.Worker, &s.JobID, &s.Timestamp, &s.Nonce)
+}
+
+// Conn reads and writes messages on a connection. Writes may come from
+// several goroutines; reads must not.
+type Conn struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+
+	mux sync.Mutex
+}
+
+func NewConn(conn net.Conn) *Conn {
+	s := bufio.NewScanner(conn)
+	s.Buffer(make([]byte, 0, 4096), MAX_LINE_SIZE)
+	return &Conn{conn: conn, scanner: s}
+}
+
+func (c *Conn) Read() (*Message, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, net.ErrClosed
+	}
+	m := new(Message)
+	if err := json.Unmarshal(c.scanner.Bytes(), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *Conn) Write(m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
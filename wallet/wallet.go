@@ -4,14 +4,17 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"goblockchain/block"
 	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
 	"log"
-
-	"github.com/btcsuite/btcutil/base58"
-	"golang.org/x/crypto/ripemd160"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Wallet struct {
@@ -20,7 +23,9 @@ type Wallet struct {
 	blockchainAddress string
 }
 
-func NewWallet() *Wallet {
+// NewWallet creates a key pair and its address on the network params
+// describes.
+func NewWallet(params *chaincfg.Params) *Wallet {
 	w := new(Wallet)
 
 	// 1. Creating ECDSA private key (32 bytes) public key (64 bytes)
@@ -31,45 +36,44 @@ func NewWallet() *Wallet {
 	w.privateKey = privateKey
 	w.publicKey = &privateKey.PublicKey
 
-	// 2. Perform SHA-256 hashing on the public key (32 bytes).
-	h2 := sha256.New()
-	h2.Write(w.publicKey.X.Bytes())
-	h2.Write(w.publicKey.Y.Bytes())
-	digest2 := h2.Sum(nil)
-
-	// 3. Perform RIPEMD-160 hashing on the result of SHA-256 (20 bytes).
-	h3 := ripemd160.New()
-	h3.Write(digest2)
-	digest3 := h3.Sum(nil)
-
-	// 4. Add version byte in front of RIPEMD-160 hash (0x00 for Main Network).
-	vd4 := make([]byte, 21)
-	vd4[0] = 0x00
-	copy(vd4[1:], digest3[:])
-
-	// 5. Perform SHA-256 hash on the extended RIPEMD-160 result.
-	h5 := sha256.New()
-	h5.Write(vd4)
-	digest5 := h5.Sum(nil)
+	// 2. Derive the blockchain address from the public key.
+	w.blockchainAddress = blockchain_crypto.PublicKeyToAddress(w.publicKey, params.AddressVersion)
 
-	// 6. Perform SHA-256 hash on the result of the previous SHA-256 hash.
-	h6 := sha256.New()
-	h6.Write(digest5)
-	digest6 := h6.Sum(nil)
-
-	// 7. Take the first 4 bytes of the second SHA-256 hash for checksum.
-	chsum := digest6[:4]
-
-	// 8. Add the 4 checksum bytes from 7 at the end of extended RIPEMD-160 hash from 4 (25 bytes).
-	dc8 := make([]byte, 25)
-	copy(dc8[:21], vd4[:])
-	copy(dc8[21:], chsum[:])
+	return w
+}
 
-	// 9. Convert the result from a byte string into base58.
-	address := base58.Encode(dc8)
-	w.blockchainAddress = address
+// LoadWallet reads the private key kept at path, or creates a wallet and
+// keeps its key there if the file does not exist yet.
+func LoadWallet(path string, params *chaincfg.Params) (*Wallet, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		w := NewWallet(params)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(w.PrivateKeyStr()+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return w
+	d, ok := new(big.Int).SetString(strings.TrimSpace(string(data)), 16)
+	curve := elliptic.P256()
+	if !ok || d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("%s: invalid private key", path)
+	}
+	privateKey := &ecdsa.PrivateKey{D: d}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+
+	return &Wallet{
+		privateKey:        privateKey,
+		publicKey:         &privateKey.PublicKey,
+		blockchainAddress: blockchain_crypto.PublicKeyToAddress(&privateKey.PublicKey, params.AddressVersion),
+	}, nil
 }
 
 func (w *Wallet) PrivateKey() *ecdsa.PrivateKey {
@@ -85,7 +89,7 @@ func (w *Wallet) PublicKey() *ecdsa.PublicKey {
 }
 
 func (w *Wallet) PublicKeyStr() string {
-	return fmt.Sprintf("%064x%064x", w.publicKey.X.Bytes(), w.publicKey.Y.Bytes())
+	return blockchain_crypto.PublicKeyToStr(w.publicKey)
 }
 
 func (w *Wallet) BlockchainAddress() string {
@@ -105,20 +109,85 @@ func (w *Wallet) MarshalJSON() ([]byte, error) {
 }
 
 type Transaction struct {
-	senderPrivateKey           *ecdsa.PrivateKey
-	senderPublicKey            *ecdsa.PublicKey
-	senderBlockchainAddress    string
-	recipientBlockchainAddress string
-	value                      float32
+	senderPrivateKey *ecdsa.PrivateKey
+	senderPublicKey  *ecdsa.PublicKey
+	transaction      *block.Transaction
+}
+
+// NewTransaction builds a transfer of value from sender to recipient that
+// pays fee to the miner. It spends utxos in the given order until value plus
+// fee is covered and returns the excess to sender as a change output.
+func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender, recipient string, value, fee block.Amount, utxos []*block.UTXOResponse) (*Transaction, error) {
+	if value <= 0 {
+		return nil, errors.New("value must be positive")
+	}
+	return NewPayments(privateKey, publicKey, sender, []*block.TxOutput{block.NewTxOutput(recipient, value)}, fee, utxos)
 }
 
-func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender, recipient string, value float32) *Transaction {
-	return &Transaction{privateKey, publicKey, sender, recipient, value}
+// NewPayments is NewTransaction for any number of recipients, one per
+// output in payments.
+func NewPayments(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, payments []*block.TxOutput, fee block.Amount, utxos []*block.UTXOResponse) (*Transaction, error) {
+	if len(payments) == 0 {
+		return nil, errors.New("no payments")
+	}
+	if fee < 0 {
+		return nil, errors.New("fee must not be negative")
+	}
+	// Coins can only be sent to addresses of the sender's own network.
+	version, err := blockchain_crypto.AddressVersion(sender)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", sender, err)
+	}
+	required := fee
+	for _, p := range payments {
+		if v, err := blockchain_crypto.AddressVersion(p.RecipientBlockchainAddress()); err != nil || v != version {
+			return nil, fmt.Errorf("invalid recipient address %q", p.RecipientBlockchainAddress())
+		}
+		if p.Value() <= 0 {
+			return nil, errors.New("value must be positive")
+		}
+		if required, err = required.Add(p.Value()); err != nil {
+			return nil, err
+		}
+	}
+
+	var inputs []*block.TxInput
+	var total block.Amount
+	for _, u := range utxos {
+		if total >= required {
+			break
+		}
+		h, err := block.HashStrToHash(u.TxHash)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, block.NewTxInput(h, u.OutputIndex))
+		if total, err = total.Add(u.Value); err != nil {
+			return nil, err
+		}
+	}
+	if total < required {
+		return nil, errors.New("not enough balance in a wallet")
+	}
+
+	outputs := append([]*block.TxOutput(nil), payments...)
+	if change := total - required; change > 0 {
+		outputs = append(outputs, block.NewTxOutput(sender, change))
+	}
+
+	return &Transaction{
+		senderPrivateKey: privateKey,
+		senderPublicKey:  publicKey,
+		transaction:      block.NewTransaction(sender, inputs, outputs, fee),
+	}, nil
+}
+
+func (t *Transaction) Transaction() *block.Transaction {
+	return t.transaction
 }
 
 func (t *Transaction) GenerateSignature() *blockchain_crypto.Signature {
-	m, _ := json.Marshal(t)
-	h := sha256.Sum256(m)
+	h := t.transaction.Hash()
 	r, s, _ := ecdsa.Sign(rand.Reader, t.senderPrivateKey, h[:])
 
 	return &blockchain_crypto.Signature{
@@ -128,15 +197,7 @@ func (t *Transaction) GenerateSignature() *blockchain_crypto.Signature {
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
-	}{
-		Sender:    t.senderBlockchainAddress,
-		Recipient: t.recipientBlockchainAddress,
-		Value:     t.value,
-	})
+	return json.Marshal(t.transaction)
 }
 
 type TransactionRequest struct {
@@ -145,6 +206,8 @@ type TransactionRequest struct {
 	SenderBlockchainAddress    *string `json:"sender_blockchain_address"`
 	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
 	Value                      *string `json:"value"`
+	// Fee is optional and defaults to no fee.
+	Fee *string `json:"fee"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
@@ -1,12 +1,25 @@
 package main
 
-import "flag"
+import (
+	"errors"
+	"flag"
+	"goblockchain/config"
+	"log"
+	"os"
+)
 
 func main() {
-	port := flag.Uint("port", 8080, "TCP port number for Wallet Server")
-	gateway := flag.String("gateway", "http://localhost:5000", "Blockchain Gateway")
-	flag.Parse()
+	cfg, err := config.LoadWalletServerConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Log.Setup(""); err != nil {
+		log.Fatal(err)
+	}
 
-	ws := NewWalletServer(uint16(*port), *gateway)
+	ws := NewWalletServer(cfg.Port, cfg.Gateway, cfg.Params())
 	ws.Start()
 }
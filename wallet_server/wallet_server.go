@@ -7,6 +7,7 @@ import (
 	"goblockchain/api"
 	"goblockchain/block"
 	"goblockchain/blockchain_crypto"
+	"goblockchain/chaincfg"
 	"goblockchain/wallet"
 	"html/template"
 	"io"
@@ -21,10 +22,11 @@ var templDir = "templates"
 type WalletServer struct {
 	port    uint16
 	gateway string
+	params  *chaincfg.Params
 }
 
-func NewWalletServer(port uint16, gateway string) *WalletServer {
-	return &WalletServer{port, gateway}
+func NewWalletServer(port uint16, gateway string, params *chaincfg.Params) *WalletServer {
+	return &WalletServer{port, gateway, params}
 }
 
 func (ws *WalletServer) Port() uint16 {
@@ -53,7 +55,7 @@ func (ws *WalletServer) Wallet(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		w.Header().Add("Content-Type", "application/json")
-		myWallet := wallet.NewWallet()
+		myWallet := wallet.NewWallet(ws.params)
 		m, _ := json.Marshal(myWallet)
 		io.WriteString(w, string(m))
 	default:
@@ -78,27 +80,54 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, r *http.Request
 			return
 		}
 
+		if v, err := blockchain_crypto.AddressVersion(*tr.RecipientBlockchainAddress); err != nil || v != ws.params.AddressVersion {
+			log.Printf("Error: invalid recipient address %q\n", *tr.RecipientBlockchainAddress)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("invalid recipient address")))
+			return
+		}
+
 		publicKey := blockchain_crypto.PublicKeyStrToPublicKey(*tr.SenderPublicKey)
 		privateKey := blockchain_crypto.PrivateKeyStrToPrivateKey(*tr.SenderPrivateKey, publicKey)
-		value64, err := strconv.ParseFloat(*tr.Value, 32)
+		value, err := block.ParseAmount(*tr.Value)
 		if err != nil {
 			log.Printf("Error: %v\n", err)
 			w.WriteHeader(http.StatusBadRequest)
 			io.WriteString(w, string(api.JsonStatus("failed")))
 			return
 		}
-		value := float32(value64)
+		var fee block.Amount
+		if tr.Fee != nil && *tr.Fee != "" {
+			if fee, err = block.ParseAmount(*tr.Fee); err != nil {
+				log.Printf("Error: %v\n", err)
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(api.JsonStatus("failed")))
+				return
+			}
+		}
+
+		utxos, err := ws.UTXOs(*tr.SenderBlockchainAddress)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(api.JsonStatus("failed")))
+			return
+		}
 
-		transaction := wallet.NewTransaction(privateKey, publicKey, *tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, value)
+		transaction, err := wallet.NewTransaction(privateKey, publicKey, *tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, value, fee, utxos)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(api.JsonStatus("failed")))
+			return
+		}
 		signature := transaction.GenerateSignature()
 		signatureStr := signature.String()
 
 		btr := block.TransactionRequest{
-			SenderBlockchainAddress:    tr.SenderBlockchainAddress,
-			RecipientBlockchainAddress: tr.RecipientBlockchainAddress,
-			Value:                      &value,
-			PublicKey:                  tr.SenderPublicKey,
-			Signature:                  &signatureStr,
+			Transaction: transaction.Transaction(),
+			PublicKey:   tr.SenderPublicKey,
+			Signature:   &signatureStr,
 		}
 		m, _ := json.Marshal(btr)
 		buf := bytes.NewBuffer(m)
@@ -127,6 +156,36 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// UTXOs asks the gateway for the outputs blockchainAddress can spend.
+func (ws *WalletServer) UTXOs(blockchainAddress string) ([]*block.UTXOResponse, error) {
+	endpoint := fmt.Sprintf("%s/utxos", ws.gateway)
+	bcsReq, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := bcsReq.URL.Query()
+	q.Add("blockchain_address", blockchainAddress)
+	bcsReq.URL.RawQuery = q.Encode()
+
+	client := &http.Client{}
+	response, err := client.Do(bcsReq)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("gateway returned %s", response.Status)
+	}
+
+	var utxos block.UTXOsResponse
+	if err := json.NewDecoder(response.Body).Decode(&utxos); err != nil {
+		return nil, err
+	}
+
+	return utxos.UTXOs, nil
+}
+
 func (ws *WalletServer) WalletAmount(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -165,11 +224,15 @@ func (ws *WalletServer) WalletAmount(w http.ResponseWriter, r *http.Request) {
 			}
 
 			m, _ := json.Marshal(struct {
-				Message string  `json:"message"`
-				Amount  float32 `json:"amount"`
+				Message  string       `json:"message"`
+				Amount   block.Amount `json:"amount"`
+				Mature   block.Amount `json:"mature"`
+				Immature block.Amount `json:"immature"`
 			}{
-				Message: "success",
-				Amount:  amount.Amount,
+				Message:  "success",
+				Amount:   amount.Amount,
+				Mature:   amount.Mature,
+				Immature: amount.Immature,
 			})
 
 			io.WriteString(w, string(m))